@@ -0,0 +1,55 @@
+package tasklocker
+
+import (
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// auditMode configures the audit entry the acquire and release scripts append, see WithAuditStream.
+type auditMode struct {
+	stream string // the stream key
+	fatal  bool   // fail the operation when the entry is not written
+	logger Logger // logs the entries that are not written
+}
+
+// auditMode returns the audit mode set by the options, nil without WithAuditStream.
+func (o *Options) auditMode() *auditMode {
+	if o.AuditStream == "" {
+		return nil
+	}
+	return &auditMode{stream: o.AuditStream, fatal: o.AuditFatal, logger: o.Logger}
+}
+
+// acquireScript returns the acquire script to run, the audited one with WithAuditStream.
+func (o *Options) acquireScript() *redis.Script {
+	if o.AuditStream != "" {
+		return auditedAcquireScript
+	}
+	return acquireScript
+}
+
+// takeAudit removes the audit result the audited scripts append to their reply (see auditScript) from the
+// reply of cmd, so it decodes like the reply of the plain script. When the entry was not written, it logs
+// the failure and, with audit.fatal, returns an error wrapping ErrAuditFailed. It does nothing when audit
+// is nil, or when the script failed.
+func takeAudit(cmd *redis.Cmd, audit *auditMode, key string) error {
+	if audit == nil || cmd.Err() != nil {
+		return nil
+	}
+	reply, ok := cmd.Val().([]any)
+	if !ok || len(reply) == 0 {
+		return nil // decoded as an unexpected reply
+	}
+	cmd.SetVal(reply[:len(reply)-1])
+	msg, failed := reply[len(reply)-1].(string)
+	if !failed {
+		return nil
+	}
+	err := fmt.Errorf("%w: %s: %s", ErrAuditFailed, audit.stream, msg)
+	audit.logger.Warn("tasklocker: audit entry not written", "key", key, "stream", audit.stream, "error", err)
+	if audit.fatal {
+		return err
+	}
+	return nil
+}
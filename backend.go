@@ -0,0 +1,235 @@
+package tasklocker
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Backend stores the locks of the acquire, release and refresh functions in place of the Redis scripts, for
+// environments without Redis, e.g. a SQL table or etcd. The logic above the store stays in the package:
+// the options, the owner ids, the retries while the limit is reached, the Lock handles, the logs, metrics
+// and traces. Pass it with WithBackend. The methods must be safe for concurrent use, and, since every
+// process shares the store, Acquire must check the limit and set the lock atomically, e.g. in a transaction.
+// NewRedisBackend and NewMemoryBackend return the implementations of the package.
+type Backend interface {
+	// Acquire sets the lock unless its key exists, and only when the units of the unexpired locks of its
+	// scope plus its weight do not exceed limit, or limit is Unlimited. A lock whose expiry passed does not
+	// exist anymore.
+	Acquire(ctx context.Context, lock BackendLock, limit int) (BackendResult, error)
+	// Release deletes the lock of lock.Key when it holds lock.Owner, or whatever it holds when lock.Owner is
+	// empty, and reports whether it did.
+	Release(ctx context.Context, lock BackendLock) (bool, error)
+	// Refresh sets the expiry of the lock of lock.Key to lock.Expiry while it exists and holds lock.Owner,
+	// and reports whether it did.
+	Refresh(ctx context.Context, lock BackendLock) (bool, error)
+	// Count returns the units of the unexpired locks of the scope.
+	Count(ctx context.Context, scope string) (int, error)
+}
+
+// BackendLock is a lock as stored by a Backend. Only the fields a method documents are set.
+type BackendLock struct {
+	// Key is the task key, e.g. prefix:postfix, including the namespace, hash tag and separator.
+	Key string
+	// Scope is the group whose limit the lock counts towards, the active set key of the prefix (e.g.
+	// prefix:__active), or of its count scope.
+	Scope string
+	// Member identifies the lock in its scope: its postfix, or prefix:postfix when the count scope is shared.
+	Member string
+	// Owner is the owner id stored in the lock.
+	Owner string
+	// Weight is the number of units of the limit the lock takes.
+	Weight int
+	// Expiry is when the lock expires, the zero time for a lock without expiry.
+	Expiry time.Time
+}
+
+// BackendResult is the outcome of Backend.Acquire.
+type BackendResult struct {
+	// Acquired reports whether the lock was set.
+	Acquired bool
+	// Exists reports whether the key exists, in which case the lock was not set.
+	Exists bool
+	// Expiry is when the existing lock expires, the zero time when it has no expiry.
+	Expiry time.Time
+	// Active is the number of units in use in the scope, including the lock's when it was acquired.
+	Active int
+}
+
+// WithBackend stores the locks in b instead of Redis: Acquire (and every function built on it, e.g. AcquireLock
+// or a Locker), Release, Refresh, CountActive and the Unlock and Refresh methods of the locks acquired use b,
+// and the client passed to them is not used. The options needing the Redis scripts (fencing tokens, pending
+// locks, versions, tenants, fair mode, bursts, dedup windows, audit streams, reentrant, extended, refreshed or
+// resumed locks) fail with an error wrapping ErrInvalidOption. Every other function still runs against Redis.
+func WithBackend(b Backend) Option {
+	return func(o *Options) {
+		o.Backend = b
+	}
+}
+
+// backendLock returns the BackendLock of the postfix, held by owner.
+func (o *Options) backendLock(keys keyspace, postfix, owner string) BackendLock {
+	return BackendLock{Key: keys.task(postfix), Scope: keys.active(), Member: keys.member(postfix), Owner: owner, Weight: o.Weight}
+}
+
+// acquireBackend acquires the lock of the postfix in o.Backend, like the acquire script with the options a
+// Backend supports. The lock handle releases and refreshes it in o.Backend.
+func acquireBackend(ctx context.Context, client redis.UniversalClient, keys keyspace, postfix string, o *Options) (acquireReply, error) {
+	switch {
+	case o.FencingToken, o.Pending > 0, o.VersionKey != "", o.Tenant != "", o.Fair, o.Burst > 0, o.DedupWindow > 0, o.AuditStream != "", o.ownedMode() != "0":
+		return acquireReply{}, fmt.Errorf("%w: the options need Redis, they can't be used with a backend", ErrInvalidOption)
+	}
+	taskKey := keys.task(postfix)
+	now := o.Clock()
+	lock := o.backendLock(keys, postfix, o.Owner)
+	switch {
+	case !o.Deadline.IsZero():
+		lock.Expiry = o.Deadline
+	case o.Timeout != NoExpiry:
+		lock.Expiry = now.Add(o.jitteredTimeout())
+	}
+
+	opCtx, cancel := o.opContext(ctx)
+	defer cancel()
+	result, err := o.Backend.Acquire(opCtx, lock, o.limit())
+	if err != nil {
+		o.Logger.Warn("tasklocker: acquire failed", "key", taskKey, "error", err)
+		return acquireReply{}, err
+	}
+	o.Metrics.ObserveActive(keys.prefix, result.Active)
+	switch {
+	case result.Acquired:
+		o.Logger.Debug("tasklocker: lock acquired", "key", taskKey, "active", result.Active, "limit", o.Limit)
+		o.Metrics.IncAcquired(keys.prefix)
+		o.recordContention(ctx, keys.prefix, false)
+		handle := &Lock{ctx: ctx, client: client, keys: keys, postfix: postfix, key: taskKey, owner: o.Owner, attempts: 1, active: result.Active, mode: o.releaseMode(), acquiredAt: now, clock: o.Clock, onHoldTime: o.OnHoldTime, opTimeout: o.OpTimeout, opDefault: o.DefaultOpTimeout, lifetime: o.MaxLifetime}
+		handle.funcs = &lockFuncs{
+			unlock: func() error {
+				ctx, cancel := withOpTimeout(ctx, o.OpTimeout, o.DefaultOpTimeout)
+				defer cancel()
+				_, err := o.Backend.Release(ctx, lock)
+				return err
+			},
+			refresh: func(timeout time.Duration) (bool, error) {
+				ctx, cancel := withOpTimeout(ctx, o.OpTimeout, o.DefaultOpTimeout)
+				defer cancel()
+				refreshed := lock
+				refreshed.Expiry = o.Clock().Add(timeout)
+				return o.Backend.Refresh(ctx, refreshed)
+			},
+		}
+		return acquireReply{lock: handle}, nil
+	case result.Exists:
+		ttl := time.Duration(-1)
+		if !result.Expiry.IsZero() {
+			ttl = result.Expiry.Sub(now)
+		}
+		o.Logger.Debug("tasklocker: key exists", "key", taskKey, "active", result.Active, "ttl", ttl)
+		o.Metrics.IncDuplicate(keys.prefix)
+		return acquireReply{exists: true, ttl: ttl}, nil
+	default:
+		o.Logger.Debug("tasklocker: limit reached", "key", taskKey, "active", result.Active, "limit", o.limit())
+		o.Metrics.IncRejected(keys.prefix)
+		o.recordContention(ctx, keys.prefix, true)
+		return acquireReply{active: result.Active}, nil
+	}
+}
+
+// NewRedisBackend returns the Backend storing the locks in Redis, in the same keys as the acquire functions
+// without WithBackend, so the locks of either are seen by the other; it is what the package uses by default,
+// reduced to the operations of a Backend, e.g. to wrap it with instrumentation or a fallback.
+func NewRedisBackend(client redis.UniversalClient) Backend {
+	return redisBackend{client: client}
+}
+
+// redisBackend is the Backend of NewRedisBackend.
+type redisBackend struct {
+	client redis.UniversalClient
+}
+
+func (r redisBackend) Acquire(ctx context.Context, lock BackendLock, limit int) (BackendResult, error) {
+	var expiry int64 // 0 for no expiry
+	if !lock.Expiry.IsZero() {
+		expiry = lock.Expiry.UnixMilli()
+	}
+	reply, err := runScript(ctx, r.client, backendAcquireScript, []string{lock.Key, lock.Scope}, lock.Member, limit, expiry, lock.Owner, lock.Weight).Int64Slice()
+	if err != nil {
+		return BackendResult{}, wrapRedisError("run backend acquire script", err)
+	}
+	result := BackendResult{Acquired: reply[0] == statusAcquired, Exists: reply[0] == statusExists, Active: int(reply[2])}
+	if result.Exists && reply[1] >= 0 {
+		result.Expiry = time.Now().Add(time.Duration(reply[1]) * time.Millisecond)
+	}
+	return result, nil
+}
+
+func (r redisBackend) Release(ctx context.Context, lock BackendLock) (bool, error) {
+	scriptKeys := []string{lock.Key, lock.Scope}
+	var cmd *redis.Cmd
+	if lock.Owner != "" {
+		cmd = runScript(ctx, r.client, releaseOwnedScript, scriptKeys, lock.Member, lock.Owner, flag(false), "", flag(false), 0)
+	} else {
+		cmd = runScript(ctx, r.client, releaseScript, scriptKeys, lock.Member, "", flag(false), 0)
+	}
+	released, _, err := decodeRelease(cmd, lock.Key, releaseMode{})
+	return released, err
+}
+
+func (r redisBackend) Refresh(ctx context.Context, lock BackendLock) (bool, error) {
+	if lock.Expiry.IsZero() {
+		return false, fmt.Errorf("%w: refresh needs an expiry", ErrInvalidTimeout)
+	}
+	ttl := time.Until(lock.Expiry).Milliseconds()
+	if ttl <= 0 {
+		// PEXPIRE with a non-positive TTL would delete the key instead of extending it
+		return false, fmt.Errorf("%w: expiry %s already passed", ErrInvalidTimeout, lock.Expiry.Format(time.RFC3339))
+	}
+	refreshed, err := runScript(ctx, r.client, refreshScript, []string{lock.Key, lock.Scope}, ttl, lock.Owner, lock.Member, 0).Int()
+	if err != nil {
+		return false, wrapRedisError("run refresh script", err)
+	}
+	return refreshed == 1, nil
+}
+
+func (r redisBackend) Count(ctx context.Context, scope string) (int, error) {
+	units, err := r.client.ZCount(ctx, scope, "("+strconv.FormatInt(time.Now().UnixMilli(), 10), "+inf").Result()
+	if err != nil {
+		return 0, wrapRedisError("count active units", err)
+	}
+	return int(units), nil
+}
+
+// NewMemoryBackend returns a Backend storing the locks in-process, so they only exclude the holders of the
+// same process, e.g. for tests or a single-process deployment without Redis.
+func NewMemoryBackend() Backend {
+	return &memoryBackend{table: localTable{locks: make(map[string]localLock)}}
+}
+
+// memoryBackend is the Backend of NewMemoryBackend, a localTable of its own.
+type memoryBackend struct {
+	table localTable
+}
+
+func (m *memoryBackend) Acquire(_ context.Context, lock BackendLock, limit int) (BackendResult, error) {
+	acquired, existing, active := m.table.acquire(lock.Key, localLock{owner: lock.Owner, scope: lock.Scope, weight: lock.Weight, expiry: lock.Expiry}, limit, time.Now())
+	result := BackendResult{Acquired: acquired, Exists: existing != nil, Active: active}
+	if existing != nil {
+		result.Expiry = *existing
+	}
+	return result, nil
+}
+
+func (m *memoryBackend) Release(_ context.Context, lock BackendLock) (bool, error) {
+	return m.table.release(lock.Key, lock.Owner), nil
+}
+
+func (m *memoryBackend) Refresh(_ context.Context, lock BackendLock) (bool, error) {
+	return m.table.refresh(lock.Key, lock.Owner, lock.Expiry, time.Now()), nil
+}
+
+func (m *memoryBackend) Count(_ context.Context, scope string) (int, error) {
+	return m.table.count(scope, time.Now()), nil
+}
@@ -0,0 +1,299 @@
+package tasklocker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// AcquireLockBatch tries to acquire a lock for every postfix of the prefix in a single round-trip,
+// so a scheduler can claim up to len(postfixes) tasks at once and start only the ones it locked.
+// The acquire script runs once per postfix in a pipeline, in order, and every run counts the locks
+// acquired by the previous ones, so the batch never exceeds allowedConcurrentTasks.
+// It returns a map telling for every postfix whether it was acquired: partial success is expected,
+// postfixes are false when the limit was reached or their key already exists.
+// On a Redis error the map still reports the postfixes acquired before it, and the error is returned.
+// Parameters:
+// - ctx: The context for the Redis operations.
+// - client: The Redis client instance.
+// - prefix: The prefix for the task keys.
+// - postfixes: The unique identifiers of the tasks (e.g., task ids).
+// - allowedConcurrentTasks: The maximum number of concurrent tasks allowed.
+// - timeout: The duration after which the locks should be automatically released.
+func AcquireLockBatch(ctx context.Context, client redis.UniversalClient, prefix string, postfixes []string, allowedConcurrentTasks int, timeout time.Duration) (map[string]bool, error) {
+	replies, _, err := acquireBatch(ctx, client, prefix, postfixes, allowedConcurrentTasks, timeout, spanAcquireBatch)
+	if replies == nil {
+		return nil, err
+	}
+
+	acquired := make(map[string]bool, len(postfixes))
+	for i, postfix := range postfixes {
+		acquired[postfix] = acquired[postfix] || replies[i].lock != nil
+	}
+	return acquired, err
+}
+
+// TryFill acquires as many of the candidates as the remaining capacity of the prefix allows,
+// in order, and returns the acquired postfixes. Unlike AcquireLockBatch it is meant to stop at
+// capacity: a dispatcher passes its backlog and starts exactly the tasks it got.
+// Candidates whose key already exists are skipped and the next ones are tried.
+// Like AcquireLockBatch, the acquire script runs once per candidate in a single pipelined round-trip,
+// and every run counts the locks acquired before it, so the prefix never exceeds allowedConcurrentTasks.
+// Pass a bounded backlog, since every candidate after the limit is reached still costs a (cheap) script run.
+// On a Redis error the postfixes acquired before it are returned along with the error.
+// Parameters:
+// - ctx: The context for the Redis operations.
+// - client: The Redis client instance.
+// - prefix: The prefix for the task keys.
+// - candidates: The unique identifiers of the candidate tasks, in order of preference.
+// - allowedConcurrentTasks: The maximum number of concurrent tasks allowed.
+// - timeout: The duration after which the locks should be automatically released.
+func TryFill(ctx context.Context, client redis.UniversalClient, prefix string, candidates []string, allowedConcurrentTasks int, timeout time.Duration) ([]string, error) {
+	replies, _, err := acquireBatch(ctx, client, prefix, candidates, allowedConcurrentTasks, timeout, spanTryFill)
+	var acquired []string
+	for i, reply := range replies {
+		if reply.lock != nil {
+			acquired = append(acquired, candidates[i])
+		}
+	}
+	return acquired, err
+}
+
+// BatchOutcome is the logical outcome of one postfix of a batch, see BatchResult.
+type BatchOutcome int
+
+// The outcomes of the postfixes of a batch. The zero value means no outcome, because the command of the
+// postfix failed with BatchResult.Err.
+const (
+	// BatchFailed means the command of the postfix failed, BatchResult.Err tells why.
+	BatchFailed BatchOutcome = iota
+	// BatchAcquired means the lock of the postfix was acquired.
+	BatchAcquired
+	// BatchAtCapacity means the concurrency limit of the prefix was reached before the postfix.
+	BatchAtCapacity
+	// BatchExists means the task key already exists, or the task was released within the dedup window.
+	BatchExists
+	// BatchReleased means the lock of the postfix was released.
+	BatchReleased
+	// BatchNotReleased means nothing was released: the key was missing, or held by another owner.
+	BatchNotReleased
+	// BatchVersionMismatch means the version key did not hold the version expected with WithVersion.
+	BatchVersionMismatch
+)
+
+// String returns the name of the outcome.
+func (b BatchOutcome) String() string {
+	switch b {
+	case BatchFailed:
+		return "Failed"
+	case BatchAcquired:
+		return "Acquired"
+	case BatchAtCapacity:
+		return "AtCapacity"
+	case BatchExists:
+		return "Exists"
+	case BatchReleased:
+		return "Released"
+	case BatchNotReleased:
+		return "NotReleased"
+	case BatchVersionMismatch:
+		return "VersionMismatch"
+	default:
+		return "BatchOutcome(" + strconv.Itoa(int(b)) + ")"
+	}
+}
+
+// BatchResult is the result of one postfix of a batch: its logical outcome, or the error its command failed
+// with, so the failed postfixes can be retried apart from the ones legitimately rejected.
+type BatchResult struct {
+	Postfix string
+	Outcome BatchOutcome
+	Err     error // the error of the postfix's command, not nil exactly when Outcome is BatchFailed
+}
+
+// Transient reports whether the command of the postfix failed with an error that may go away when it is
+// retried: Redis being unreachable, loading or failing over.
+func (r BatchResult) Transient() bool {
+	return isTransient(r.Err)
+}
+
+// AcquireLockBatchResults tries to acquire a lock for every postfix of the prefix in a single round-trip
+// like AcquireLockBatch, but returns a BatchResult per postfix, in order, telling the postfixes whose command
+// failed apart from the ones rejected because the limit was reached or their key exists. The error joins the
+// errors of the failed postfixes with errors.Join, each prefixed with its postfix, so errors.Is still works.
+// The results are nil when a key is invalid.
+// Parameters:
+// - ctx: The context for the Redis operations.
+// - client: The Redis client instance.
+// - prefix: The prefix for the task keys.
+// - postfixes: The unique identifiers of the tasks (e.g., task ids).
+// - allowedConcurrentTasks: The maximum number of concurrent tasks allowed.
+// - timeout: The duration after which the locks should be automatically released.
+func AcquireLockBatchResults(ctx context.Context, client redis.UniversalClient, prefix string, postfixes []string, allowedConcurrentTasks int, timeout time.Duration) ([]BatchResult, error) {
+	replies, errs, err := acquireBatch(ctx, client, prefix, postfixes, allowedConcurrentTasks, timeout, spanAcquireBatch)
+	if replies == nil {
+		return nil, err
+	}
+
+	results := make([]BatchResult, len(postfixes))
+	for i, postfix := range postfixes {
+		results[i] = BatchResult{Postfix: postfix, Err: errs[i]}
+		switch {
+		case errs[i] != nil:
+			results[i].Outcome = BatchFailed
+		case replies[i].lock != nil:
+			results[i].Outcome = BatchAcquired
+		case replies[i].exists:
+			results[i].Outcome = BatchExists
+		case replies[i].mismatch:
+			results[i].Outcome = BatchVersionMismatch
+		default:
+			results[i].Outcome = BatchAtCapacity
+		}
+	}
+	return results, joinBatchErrors(results)
+}
+
+// joinBatchErrors joins the errors of the failed results, each prefixed with its postfix, nil when none failed.
+func joinBatchErrors(results []BatchResult) error {
+	var errs []error
+	for _, result := range results {
+		if result.Err != nil {
+			errs = append(errs, fmt.Errorf("postfix %q: %w", result.Postfix, result.Err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// acquireBatch runs the acquire script for every postfix in a single pipeline, in order,
+// and returns the decoded replies and the error of every postfix, along with the first error.
+// The replies are nil when a key is invalid.
+func acquireBatch(ctx context.Context, client redis.UniversalClient, prefix string, postfixes []string, allowedConcurrentTasks int, timeout time.Duration, spanName string) ([]acquireReply, []error, error) {
+	o := newPrefixOptions(prefix, []Option{WithLimit(allowedConcurrentTasks), WithTimeout(timeout), WithOwner(defaultValue)})
+	for _, postfix := range postfixes {
+		if err := o.validate(prefix, postfix); err != nil {
+			return nil, nil, err
+		}
+	}
+	keys := o.keyspace(prefix)
+
+	spanCtx, span := o.Tracer.Start(ctx, spanName)
+	defer span.End()
+	span.SetAttribute("prefix", keys.prefix)
+	span.SetAttribute("postfixes", len(postfixes))
+	span.SetAttribute("allowed_concurrent", o.Limit)
+
+	// Queue one acquire script per postfix and send them together
+	pipe := client.Pipeline()
+	cmds := make([]*redis.Cmd, len(postfixes))
+	for i, postfix := range postfixes {
+		cmds[i] = o.acquireCmd(spanCtx, pipe, keys, postfix, -1)
+	}
+	_, _ = pipe.Exec(spanCtx) // errors are decoded per command below
+
+	replies := make([]acquireReply, len(postfixes))
+	errs := make([]error, len(postfixes))
+	var firstErr error
+	for i, postfix := range postfixes {
+		replies[i], errs[i] = decodeAcquire(ctx, client, keys, postfix, o, cmds[i], nopSpan{})
+		if errs[i] != nil && firstErr == nil {
+			firstErr = errs[i]
+		}
+	}
+	if firstErr != nil {
+		span.RecordError(firstErr)
+	}
+	return replies, errs, firstErr
+}
+
+// ReleaseLockBatch releases the locks of several postfixes of the prefix in a single round-trip,
+// running the release script once per postfix in a pipeline.
+// With WithOwner, each key is only deleted while it still holds that owner id, so keys owned by
+// someone else are skipped; without it, the keys are deleted unconditionally like ReleaseLock.
+// It returns a map telling for every postfix whether its lock was released: false means the key
+// was missing or skipped because of its owner. Count the true values to reconcile.
+// On a Redis error the map still reports the postfixes released before it, and the error is returned.
+// Parameters:
+// - ctx: The context for the Redis operations.
+// - client: The Redis client instance.
+// - prefix: The prefix for the task keys.
+// - postfixes: The unique identifiers of the tasks (e.g., task ids).
+// - opts: The options, e.g. WithOwner or WithHashTag.
+func ReleaseLockBatch(ctx context.Context, client redis.UniversalClient, prefix string, postfixes []string, opts ...Option) (map[string]bool, error) {
+	results, err := ReleaseLockBatchResults(ctx, client, prefix, postfixes, opts...)
+	if results == nil {
+		return nil, err
+	}
+
+	released := make(map[string]bool, len(postfixes))
+	var firstErr error
+	for _, result := range results {
+		if result.Err != nil && firstErr == nil {
+			firstErr = result.Err
+		}
+		released[result.Postfix] = released[result.Postfix] || result.Outcome == BatchReleased
+	}
+	return released, firstErr
+}
+
+// ReleaseLockBatchResults releases the locks of several postfixes of the prefix in a single round-trip like
+// ReleaseLockBatch, but returns a BatchResult per postfix, in order, telling the postfixes whose command failed
+// (BatchFailed) apart from the ones with nothing to release (BatchNotReleased). The error joins the errors of
+// the failed postfixes with errors.Join, each prefixed with its postfix. The results are nil when a key is invalid.
+// Parameters:
+// - ctx: The context for the Redis operations.
+// - client: The Redis client instance.
+// - prefix: The prefix for the task keys.
+// - postfixes: The unique identifiers of the tasks (e.g., task ids).
+// - opts: The options, e.g. WithOwner or WithHashTag.
+func ReleaseLockBatchResults(ctx context.Context, client redis.UniversalClient, prefix string, postfixes []string, opts ...Option) ([]BatchResult, error) {
+	o := newPrefixOptions(prefix, opts)
+	client = o.clientFor(prefix, client)
+	ctx, cancel := o.opContext(ctx)
+	defer cancel()
+	for _, postfix := range postfixes {
+		if err := o.validateKey(prefix, postfix); err != nil {
+			return nil, err
+		}
+	}
+	keys := o.keyspace(prefix)
+
+	spanCtx, span := o.Tracer.Start(ctx, spanReleaseBatch)
+	defer span.End()
+	span.SetAttribute("prefix", keys.prefix)
+	span.SetAttribute("postfixes", len(postfixes))
+
+	// Queue one release script per postfix and send them together
+	pipe := client.Pipeline()
+	cmds := make([]*redis.Cmd, len(postfixes))
+	for i, postfix := range postfixes {
+		cmds[i] = releaseCmd(spanCtx, pipe, keys, postfix, o.Owner, o.releaseMode())
+	}
+	_, _ = pipe.Exec(spanCtx) // errors are decoded per command below
+
+	results := make([]BatchResult, len(postfixes))
+	for i, postfix := range postfixes {
+		results[i] = BatchResult{Postfix: postfix}
+		ok, _, err := decodeRelease(cmds[i], keys.task(postfix), o.releaseMode())
+		if err != nil {
+			o.Logger.Warn("tasklocker: release failed", "key", keys.task(postfix), "error", err)
+			results[i].Err = err
+			continue
+		}
+		o.Logger.Debug("tasklocker: lock released", "key", keys.task(postfix), "deleted", ok)
+		o.Metrics.IncReleased(keys.prefix)
+		results[i].Outcome = BatchNotReleased
+		if ok {
+			results[i].Outcome = BatchReleased
+		}
+	}
+	err := joinBatchErrors(results)
+	if err != nil {
+		span.RecordError(err)
+	}
+	return results, err
+}
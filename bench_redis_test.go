@@ -0,0 +1,43 @@
+//go:build redis
+
+package tasklocker_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/youssefsiam38/tasklocker"
+)
+
+// BenchmarkAcquireLockRedis runs the cases of BenchmarkAcquireLock against a real Redis, at the address of
+// TASKLOCKER_REDIS_ADDR (localhost:6379 by default), with go test -tags redis -bench AcquireLockRedis.
+// The keys are written under a prefix of their own and cleared after each case.
+func BenchmarkAcquireLockRedis(b *testing.B) {
+	addr := os.Getenv("TASKLOCKER_REDIS_ADDR")
+	if addr == "" {
+		addr = "localhost:6379"
+	}
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	b.Cleanup(func() { client.Close() })
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		b.Skipf("redis at %s: %v", addr, err)
+	}
+
+	run := func(name string, bench func(b *testing.B, prefix string)) {
+		b.Run(name, func(b *testing.B) {
+			prefix := "tasklocker_bench"
+			b.Cleanup(func() { tasklocker.ClearPrefix(context.Background(), client, prefix) })
+			bench(b, prefix)
+		})
+	}
+	for _, n := range activeCounts {
+		run(fmt.Sprintf("active=%d", n), func(b *testing.B, prefix string) { benchAcquire(b, client, prefix, n, false) })
+	}
+	for _, n := range activeCounts {
+		run(fmt.Sprintf("scan/active=%d", n), func(b *testing.B, prefix string) { benchAcquire(b, client, prefix, n, true) })
+	}
+	run("contention", func(b *testing.B, prefix string) { benchContention(b, client, prefix) })
+}
@@ -0,0 +1,109 @@
+package tasklocker_test
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/youssefsiam38/tasklocker"
+)
+
+// activeCounts are the numbers of locks held in the prefix while the benchmarks acquire.
+var activeCounts = []int{0, 100, 1000, 10000}
+
+// BenchmarkAcquireLock measures an AcquireLock and ReleaseLock round trip against miniredis, with a growing
+// number of locks held in the prefix, and under contention. The scan sub-benchmarks run AcquireLockScan
+// instead, whose SCAN is O(n) in the keys of the database, against the count of the active set, O(log n) on
+// Redis. The sorted sets of miniredis are slices, so the active set costs O(n) there too: compare the real
+// shapes with BenchmarkAcquireLockRedis.
+func BenchmarkAcquireLock(b *testing.B) {
+	for _, n := range activeCounts {
+		b.Run(fmt.Sprintf("active=%d", n), func(b *testing.B) {
+			_, client := newRedis(b)
+			benchAcquire(b, client, "bench", n, false)
+		})
+	}
+	for _, n := range activeCounts {
+		b.Run(fmt.Sprintf("scan/active=%d", n), func(b *testing.B) {
+			_, client := newRedis(b)
+			benchAcquire(b, client, "bench", n, true)
+		})
+	}
+	b.Run("contention", func(b *testing.B) {
+		_, client := newRedis(b)
+		benchContention(b, client, "bench")
+	})
+}
+
+// holdLocks writes n locks held for an hour in the prefix: a task key hash like the acquire script writes, and
+// its member in the active set. They are written in a pipeline, n acquisitions would cost O(n²) on miniredis.
+func holdLocks(b *testing.B, client redis.UniversalClient, prefix string, n int) {
+	b.Helper()
+	ctx := context.Background()
+	expiry := float64(time.Now().Add(time.Hour).UnixMilli())
+	pipe := client.Pipeline()
+	for i := 0; i < n; i++ {
+		postfix := "held-" + strconv.Itoa(i)
+		pipe.HSet(ctx, prefix+":"+postfix, "value", "1", "count", 1, "weight", 1)
+		pipe.PExpire(ctx, prefix+":"+postfix, time.Hour)
+		pipe.ZAdd(ctx, prefix+":__active", redis.Z{Score: expiry, Member: postfix})
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		b.Fatal(err)
+	}
+}
+
+// benchAcquire acquires and releases a lock b.N times while n others are held in the prefix, with
+// AcquireLockScan when scan is true.
+func benchAcquire(b *testing.B, client redis.UniversalClient, prefix string, n int, scan bool) {
+	holdLocks(b, client, prefix, n)
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var acquired bool
+		var err error
+		if scan {
+			acquired, _, err = tasklocker.AcquireLockScan(ctx, client, prefix, "task", n+1, time.Minute, 1000)
+		} else {
+			acquired, _, err = tasklocker.AcquireLock(ctx, client, prefix, "task", n+1, time.Minute)
+		}
+		if err != nil || !acquired {
+			b.Fatalf("acquire = %v, %v", acquired, err)
+		}
+		if err := tasklocker.ReleaseLock(ctx, client, prefix, "task"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchContention acquires and releases locks of distinct postfixes from 8 goroutines per CPU, more than the
+// limit of 2 allows at once, so part of the attempts find the limit reached; the ratio is reported.
+func benchContention(b *testing.B, client redis.UniversalClient, prefix string) {
+	ctx := context.Background()
+	var next, rejected atomic.Int64
+	b.SetParallelism(8)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			postfix := strconv.FormatInt(next.Add(1), 10)
+			acquired, _, err := tasklocker.AcquireLock(ctx, client, prefix, postfix, 2, time.Minute)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			if !acquired {
+				rejected.Add(1)
+				continue
+			}
+			if err := tasklocker.ReleaseLock(ctx, client, prefix, postfix); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+	b.ReportMetric(float64(rejected.Load())/float64(b.N), "rejected/op")
+}
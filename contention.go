@@ -0,0 +1,192 @@
+package tasklocker
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// contentionKeyPrefix prefixes the Redis hashes counting the attempts of a prefix, see NewRedisContention.
+const contentionKeyPrefix = "tasklocker:contention:"
+
+// contentionBuckets is the number of buckets the retention of a Contention is split in.
+const contentionBuckets = 60
+
+// Contention counts the acquire attempts of every prefix that were decided by the limit, acquired or rejected
+// because the limit (or the tenant limit) was reached, over a rolling window, for capacity-planning alerts.
+// Attempts reporting an existing task key, a recent duplicate or a version mismatch are not counted. Pass it
+// to the acquire functions with WithContention, and read it with Ratio or Counts. The counts are kept in
+// buckets of a sixtieth of the retention (at least a second), so windows are rounded up to whole buckets and
+// capped at the retention. A Contention is safe for concurrent use.
+type Contention struct {
+	store     contentionStore
+	bucket    time.Duration    // the width of a bucket
+	retention time.Duration    // how long the buckets are kept
+	clock     func() time.Time // the time source of the buckets
+}
+
+// contentionStore keeps the counts of the buckets of a Contention.
+type contentionStore interface {
+	// add counts an attempt of the prefix in the bucket, rejected or not.
+	add(ctx context.Context, prefix string, bucket int64, rejected bool) error
+	// sum returns the attempts and rejections of the prefix in the buckets from first to last, both included.
+	sum(ctx context.Context, prefix string, first, last int64) (int64, int64, error)
+}
+
+// NewContention returns a Contention counting in-process, for the attempts of this process only. The counts
+// are kept for retention, the longest window Ratio can cover.
+func NewContention(retention time.Duration) *Contention {
+	return newContention(&memoryContention{counts: make(map[string]map[int64]*[2]int64)}, retention)
+}
+
+// NewRedisContention returns a Contention counting in Redis with HINCRBY, for the attempts of every process
+// using it: the bucket of a prefix is a hash at tasklocker:contention:<prefix>:<bucket>, expiring after the
+// retention. Recording an attempt costs a round-trip, whose failure is logged and does not fail the attempt.
+func NewRedisContention(client redis.UniversalClient, retention time.Duration) *Contention {
+	store := &redisContention{client: client}
+	c := newContention(store, retention)
+	store.expiry = c.retention + c.bucket // the last bucket of a window started a bucket before its end
+	return c
+}
+
+// newContention returns a Contention keeping its counts in store for retention.
+func newContention(store contentionStore, retention time.Duration) *Contention {
+	bucket := max(retention/contentionBuckets, time.Second)
+	return &Contention{store: store, bucket: bucket, retention: max(retention, bucket), clock: time.Now}
+}
+
+// Counts returns the attempts of the prefix decided by the limit over the last window, and how many of them
+// were rejected. The prefix is the key prefix as stored in Redis, including the hash tag with WithHashTag.
+func (c *Contention) Counts(ctx context.Context, prefix string, window time.Duration) (int64, int64, error) {
+	window = min(window, c.retention)
+	last := c.bucketOf(c.clock())
+	first := last - int64((window+c.bucket-1)/c.bucket) + 1
+	return c.store.sum(ctx, prefix, min(first, last), last)
+}
+
+// Ratio returns the fraction of the attempts of the prefix decided by the limit over the last window that
+// were rejected because the limit was reached, from 0 (no contention) to 1, and 0 without attempts.
+func (c *Contention) Ratio(ctx context.Context, prefix string, window time.Duration) (float64, error) {
+	attempts, rejected, err := c.Counts(ctx, prefix, window)
+	if err != nil || attempts == 0 {
+		return 0, err
+	}
+	return float64(rejected) / float64(attempts), nil
+}
+
+// record counts an attempt of the prefix in the current bucket.
+func (c *Contention) record(ctx context.Context, prefix string, rejected bool) error {
+	return c.store.add(ctx, prefix, c.bucketOf(c.clock()), rejected)
+}
+
+// bucketOf returns the bucket of t.
+func (c *Contention) bucketOf(t time.Time) int64 {
+	return t.UnixNano() / int64(c.bucket)
+}
+
+// recordContention counts an attempt decided by the limit in o.Contention, logging a failure.
+func (o *Options) recordContention(ctx context.Context, prefix string, rejected bool) {
+	if o.Contention == nil {
+		return
+	}
+	if err := o.Contention.record(ctx, prefix, rejected); err != nil {
+		o.Logger.Warn("tasklocker: contention not recorded", "prefix", prefix, "error", err)
+	}
+}
+
+// memoryContention keeps the counts of a Contention in-process, as {attempts, rejected} by bucket.
+type memoryContention struct {
+	mu     sync.Mutex
+	counts map[string]map[int64]*[2]int64
+}
+
+func (m *memoryContention) add(_ context.Context, prefix string, bucket int64, rejected bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	buckets := m.counts[prefix]
+	if buckets == nil {
+		buckets = make(map[int64]*[2]int64)
+		m.counts[prefix] = buckets
+	}
+	count := buckets[bucket]
+	if count == nil {
+		count = new([2]int64)
+		buckets[bucket] = count
+		// A new bucket starts, drop the ones past the retention
+		for old := range buckets {
+			if old <= bucket-contentionBuckets-1 {
+				delete(buckets, old)
+			}
+		}
+	}
+	count[0]++
+	if rejected {
+		count[1]++
+	}
+	return nil
+}
+
+func (m *memoryContention) sum(_ context.Context, prefix string, first, last int64) (int64, int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var attempts, rejected int64
+	for bucket, count := range m.counts[prefix] {
+		if bucket >= first && bucket <= last {
+			attempts, rejected = attempts+count[0], rejected+count[1]
+		}
+	}
+	return attempts, rejected, nil
+}
+
+// redisContention keeps the counts of a Contention in Redis hashes, one per prefix and bucket.
+type redisContention struct {
+	client redis.UniversalClient
+	expiry time.Duration // the TTL of the hashes
+}
+
+// key returns the hash counting the attempts of the prefix in the bucket.
+func (r *redisContention) key(prefix string, bucket int64) string {
+	return contentionKeyPrefix + prefix + ":" + strconv.FormatInt(bucket, 10)
+}
+
+func (r *redisContention) add(ctx context.Context, prefix string, bucket int64, rejected bool) error {
+	key := r.key(prefix, bucket)
+	pipe := r.client.Pipeline()
+	pipe.HIncrBy(ctx, key, "attempts", 1)
+	if rejected {
+		pipe.HIncrBy(ctx, key, "rejected", 1)
+	}
+	pipe.PExpire(ctx, key, r.expiry)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return wrapRedisError("record contention", err)
+	}
+	return nil
+}
+
+func (r *redisContention) sum(ctx context.Context, prefix string, first, last int64) (int64, int64, error) {
+	pipe := r.client.Pipeline()
+	cmds := make([]*redis.SliceCmd, 0, last-first+1)
+	for bucket := first; bucket <= last; bucket++ {
+		cmds = append(cmds, pipe.HMGet(ctx, r.key(prefix, bucket), "attempts", "rejected"))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, 0, wrapRedisError("read contention", err)
+	}
+	var attempts, rejected int64
+	for _, cmd := range cmds {
+		values := cmd.Val()
+		attempts += parseCount(values[0])
+		rejected += parseCount(values[1])
+	}
+	return attempts, rejected, nil
+}
+
+// parseCount returns the count of an HMGET value, 0 for a missing field.
+func parseCount(value any) int64 {
+	s, _ := value.(string)
+	n, _ := strconv.ParseInt(s, 10, 64)
+	return n
+}
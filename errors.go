@@ -0,0 +1,141 @@
+package tasklocker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Sentinel errors returned (wrapped) by the package. Check them with errors.Is.
+var (
+	// ErrRedisUnavailable means Redis could not be reached (connection refused, closed, timed out, ...).
+	// The original go-redis or network error is kept in the chain.
+	ErrRedisUnavailable = errors.New("tasklocker: redis unavailable")
+	// ErrLockNotHeld means the operation needs a held lock, but the key is missing or owned by someone else.
+	ErrLockNotHeld = errors.New("tasklocker: lock not held")
+	// ErrInvalidSeparator means the separator is empty or appears in the prefix or postfix.
+	ErrInvalidSeparator = errors.New("tasklocker: invalid separator")
+	// ErrEmptyPrefix means the prefix is empty, which would make its keys match a huge keyspace.
+	ErrEmptyPrefix = errors.New("tasklocker: empty prefix")
+	// ErrEmptyPostfix means the postfix is empty, which would produce a bare "prefix:" key.
+	ErrEmptyPostfix = errors.New("tasklocker: empty postfix")
+	// ErrInvalidLimit means the number of allowed concurrent tasks is not positive, so nothing could ever acquire.
+	ErrInvalidLimit = errors.New("tasklocker: invalid limit")
+	// ErrInvalidWeight means the weight of an acquisition is not positive or exceeds the limit, so it could never acquire.
+	ErrInvalidWeight = errors.New("tasklocker: invalid weight")
+	// ErrInvalidTimeout means the lock timeout is not positive.
+	ErrInvalidTimeout = errors.New("tasklocker: invalid timeout")
+	// ErrRejected means the WithOnRejected callback turned an acquisition without the lock into a failure.
+	ErrRejected = errors.New("tasklocker: acquisition rejected")
+	// ErrNotPaused means ResumeLock found no paused task key: it is missing, held or was released.
+	ErrNotPaused = errors.New("tasklocker: lock not paused")
+	// ErrScanBudgetExceeded means a SCAN enumeration stopped after the iterations set with WithMaxScanIterations,
+	// before covering the keyspace: the count or list returned with it is partial, a lower bound.
+	ErrScanBudgetExceeded = errors.New("tasklocker: scan budget exceeded")
+	// ErrTimeoutTooShort means the lock timeout is below the floor set with WithMinTimeout or SetMinTimeout.
+	ErrTimeoutTooShort = errors.New("tasklocker: timeout too short")
+	// ErrRedisOutOfMemory means Redis refused a write because it reached its maxmemory limit (an OOM
+	// command not allowed error), e.g. to shed load. It is not transient: the write is not retried.
+	// The original go-redis error is kept in the chain.
+	ErrRedisOutOfMemory = errors.New("tasklocker: redis out of memory")
+	// ErrClusterRedirect means a Redis Cluster node answered with a MOVED or ASK redirect, which happens when
+	// a single-node client such as *redis.Client is pointed at a cluster. Use a *redis.ClusterClient instead.
+	// The original redirect error is kept in the chain.
+	ErrClusterRedirect = errors.New("tasklocker: cluster redirect (use a redis.ClusterClient for Redis Cluster)")
+	// ErrAcquireTimeout means a retrying acquire exhausted its Backoff budget (MaxAttempts or MaxElapsed)
+	// while the concurrency limit was still reached.
+	ErrAcquireTimeout = errors.New("tasklocker: acquire timeout")
+	// ErrLockExists means the task key already exists: the task is a duplicate of one already running.
+	ErrLockExists = errors.New("tasklocker: lock exists")
+	// ErrStaleLock means a release was refused because the task key no longer holds the caller's fencing token
+	// or owner id (see ReleaseLockToken and WithStrictRelease): the lock expired, and was possibly acquired by
+	// someone else in the meantime.
+	ErrStaleLock = errors.New("tasklocker: stale lock")
+	// ErrInvalidQuorum means the quorum of a Redlock is not a majority of its nodes, or exceeds their number.
+	ErrInvalidQuorum = errors.New("tasklocker: invalid quorum")
+	// ErrInvalidOption means a value or a combination of options can't be used, e.g. fencing tokens with
+	// reentrant locks. NewLocker reports it, along with the other validation errors, at construction.
+	ErrInvalidOption = errors.New("tasklocker: invalid option")
+	// ErrUnregisteredPrefix means no options are registered for the prefix while RequireRegistered is on.
+	ErrUnregisteredPrefix = errors.New("tasklocker: unregistered prefix")
+	// ErrNotStructured means the lock holds no JSON metadata to decode (see GetMetadata), e.g. a key
+	// written by AcquireLock, or by an earlier version, holding "1".
+	ErrNotStructured = errors.New("tasklocker: lock value not structured")
+	// ErrAuditFailed means the entry of an acquire or release was not appended to the stream set with
+	// WithAuditStream, and the option made that fatal. The Redis error is kept in the message.
+	ErrAuditFailed = errors.New("tasklocker: audit entry not written")
+	// ErrLockerClosed means the Locker is draining or closed (see Locker.Drain and Locker.Close) and no longer
+	// acquires locks, or starts background work after Close.
+	ErrLockerClosed = errors.New("tasklocker: locker closed")
+	// ErrUnhealthy means HealthCheck failed: Redis did not answer the ping, or the read-write probe failed.
+	// The underlying error is kept in the chain.
+	ErrUnhealthy = errors.New("tasklocker: health check failed")
+	// ErrUnexpectedReply means a script returned a reply the package does not understand.
+	ErrUnexpectedReply = errors.New("tasklocker: unexpected reply")
+)
+
+// wrapRedisError describes a failed Redis operation, wrapping err with %w so its type survives,
+// and adding ErrRedisUnavailable to the chain when it is a connectivity error, ErrClusterRedirect
+// when a cluster node redirected a single-node client, or ErrRedisOutOfMemory when Redis reached maxmemory.
+func wrapRedisError(op string, err error) error {
+	if isRedirect(err) {
+		return fmt.Errorf("failed to %s: %w: %w", op, ErrClusterRedirect, err)
+	}
+	if isOutOfMemory(err) {
+		return fmt.Errorf("failed to %s: %w: %w", op, ErrRedisOutOfMemory, err)
+	}
+	if isUnavailable(err) {
+		return fmt.Errorf("failed to %s: %w: %w", op, ErrRedisUnavailable, err)
+	}
+	return fmt.Errorf("failed to %s: %w", op, err)
+}
+
+// isUnavailable reports whether err means Redis could not be reached.
+// Context errors are the caller giving up, not Redis being unavailable, even though
+// context.DeadlineExceeded also implements net.Error.
+func isUnavailable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, redis.ErrClosed) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// isRedirect reports whether err is a MOVED or ASK redirect returned by a Redis Cluster node.
+func isRedirect(err error) bool {
+	return redis.HasErrorPrefix(err, "MOVED ") || redis.HasErrorPrefix(err, "ASK ")
+}
+
+// isOutOfMemory reports whether err is the OOM error of a Redis server at its maxmemory limit, replied to
+// the command, or to a write of a script (prefixed by the script error on servers before Redis 7).
+func isOutOfMemory(err error) bool {
+	return redis.HasErrorPrefix(err, "OOM ") || strings.Contains(err.Error(), "OOM command not allowed")
+}
+
+// isUnknownCommand reports whether err means the server does not support the command (e.g. UNLINK before Redis 4).
+func isUnknownCommand(err error) bool {
+	return redis.HasErrorPrefix(err, "unknown command")
+}
+
+// isTransient reports whether a Redis operation failing with err may succeed when retried:
+// Redis could not be reached, or it is busy loading, resharding or electing a new master.
+// A closed client never recovers, so redis.ErrClosed is not transient, and neither is an OOM error: retrying
+// writes against a full server only adds to its load.
+func isTransient(err error) bool {
+	if err == nil || errors.Is(err, redis.ErrClosed) {
+		return false
+	}
+	return isUnavailable(err) ||
+		redis.HasErrorPrefix(err, "LOADING") ||
+		redis.HasErrorPrefix(err, "TRYAGAIN") ||
+		redis.HasErrorPrefix(err, "CLUSTERDOWN") ||
+		redis.HasErrorPrefix(err, "MASTERDOWN")
+}
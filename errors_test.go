@@ -0,0 +1,125 @@
+package tasklocker_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/youssefsiam38/tasklocker"
+)
+
+// redisError is an error reply of the server, as go-redis returns them.
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+func (redisError) RedisError()     {}
+
+// failScripts is a go-redis hook failing the script calls with its error, and counting them.
+type failScripts struct {
+	err   error
+	calls atomic.Int64
+}
+
+func (h *failScripts) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (h *failScripts) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if !strings.HasPrefix(cmd.Name(), "eval") {
+			return next(ctx, cmd)
+		}
+		h.calls.Add(1)
+		cmd.SetErr(h.err)
+		return h.err
+	}
+}
+
+func (h *failScripts) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+// countCommands is a go-redis hook counting the commands sent.
+type countCommands struct {
+	calls atomic.Int64
+}
+
+func (h *countCommands) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (h *countCommands) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		h.calls.Add(1)
+		return next(ctx, cmd)
+	}
+}
+
+func (h *countCommands) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		h.calls.Add(int64(len(cmds)))
+		return next(ctx, cmds)
+	}
+}
+
+func TestValidation(t *testing.T) {
+	_, client := newRedis(t)
+	ctx := context.Background()
+	count := &countCommands{}
+	client.AddHook(count)
+
+	acquire := func(prefix, postfix string, opts ...tasklocker.Option) error {
+		_, _, _, err := tasklocker.Acquire(ctx, client, prefix, postfix, append([]tasklocker.Option{tasklocker.WithTimeout(time.Minute)}, opts...)...)
+		return err
+	}
+	for _, tc := range []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"empty prefix", acquire("", "1"), tasklocker.ErrEmptyPrefix},
+		{"empty postfix", acquire("jobs", ""), tasklocker.ErrEmptyPostfix},
+		{"zero limit", acquire("jobs", "1", tasklocker.WithLimit(0)), tasklocker.ErrInvalidLimit},
+		{"weight above the limit", acquire("jobs", "1", tasklocker.WithLimit(2), tasklocker.WithWeight(3)), tasklocker.ErrInvalidWeight},
+		{"zero timeout", acquire("jobs", "1", tasklocker.WithTimeout(0)), tasklocker.ErrInvalidTimeout},
+		{"jitter of 1", acquire("jobs", "1", tasklocker.WithTimeoutJitter(1)), tasklocker.ErrInvalidTimeout},
+		{"separator in the postfix", acquire("jobs", "a|b", tasklocker.WithSeparator("|")), tasklocker.ErrInvalidSeparator},
+		{"reserved postfix", acquire("jobs", "__active"), tasklocker.ErrInvalidOption},
+		{"reserved postfix with a key", acquire("jobs", "__done:1"), tasklocker.ErrInvalidOption},
+		{"release of a reserved postfix", tasklocker.ReleaseLock(ctx, client, "jobs", "__seq"), tasklocker.ErrInvalidOption},
+	} {
+		if !errors.Is(tc.err, tc.want) {
+			t.Errorf("%s: err = %v, want %v", tc.name, tc.err, tc.want)
+		}
+	}
+	if n := count.calls.Load(); n != 0 {
+		t.Fatalf("%d commands sent, want none", n)
+	}
+}
+
+func TestOutOfMemoryNotRetried(t *testing.T) {
+	_, client := newRedis(t)
+	ctx := context.Background()
+	retry := tasklocker.WithRedisRetry(3, tasklocker.Backoff{BaseDelay: time.Millisecond})
+
+	// A busy server is retried, so the hook sees every attempt
+	loading := &failScripts{err: redisError("LOADING Redis is loading the dataset in memory")}
+	client.AddHook(loading)
+	if _, _, err := tasklocker.AcquireLock(ctx, client, "jobs", "1", 1, time.Minute, retry); err == nil {
+		t.Fatal("AcquireLock succeeded while loading")
+	}
+	if n := loading.calls.Load(); n != 4 {
+		t.Fatalf("LOADING: %d script calls, want 4", n)
+	}
+
+	_, client = newRedis(t)
+	oom := &failScripts{err: redisError("OOM command not allowed when used memory > 'maxmemory'.")}
+	client.AddHook(oom)
+	_, _, err := tasklocker.AcquireLock(ctx, client, "jobs", "1", 1, time.Minute, retry)
+	if !errors.Is(err, tasklocker.ErrRedisOutOfMemory) || errors.Is(err, tasklocker.ErrRedisUnavailable) {
+		t.Fatalf("AcquireLock = %v, want ErrRedisOutOfMemory", err)
+	}
+	if n := oom.calls.Load(); n != 1 {
+		t.Fatalf("OOM: %d script calls, want 1", n)
+	}
+}
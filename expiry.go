@@ -0,0 +1,93 @@
+package tasklocker
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// keyeventExpiredPattern matches the channels of the expired key events of every database.
+const keyeventExpiredPattern = "__keyevent@*__:expired"
+
+// WatchExpired calls fn with the postfix of every task key of the prefix that expires by its TTL instead of
+// being released, so in-process bookkeeping can catch up with locks their holders lost, until the returned
+// stop function is called or ctx is done. With WithNotify, every expiry is also published on the prefix's
+// channel, waking up WaitForSlot.
+// The events come from Redis keyspace notifications, which have to be enabled with a notify-keyspace-events
+// setting including "Ex". When they are disabled, fn is never called; CONFIG GET is used to log a warning
+// in that case, when the server allows it. Notifications are published by the node of the key only, so on
+// Redis Cluster only the expiries of the node the subscription lands on are seen.
+// The subscription is confirmed before WatchExpired returns. fn is called from a single goroutine, one
+// expiry at a time. The stop function waits for the goroutine to exit and is safe to call more than once.
+// Parameters:
+// - ctx: The context for the subscription; watching stops when it is done.
+// - client: The Redis client instance.
+// - prefix: The prefix for the task keys.
+// - fn: The callback receiving the postfix of every expired task key.
+// - opts: The key options, e.g. WithSeparator or WithHashTag, and WithNotify.
+func WatchExpired(ctx context.Context, client redis.UniversalClient, prefix string, fn func(postfix string), opts ...Option) (func(), error) {
+	o := newPrefixOptions(prefix, opts)
+	client = o.clientFor(prefix, client)
+	if err := o.validatePrefix(prefix); err != nil {
+		return nil, err
+	}
+	keys := o.keyspace(prefix)
+
+	if config, err := client.ConfigGet(ctx, "notify-keyspace-events").Result(); err == nil {
+		if events := config["notify-keyspace-events"]; !expiredEventsEnabled(events) {
+			o.Logger.Warn("tasklocker: keyspace notifications for expired keys are disabled", "notify-keyspace-events", events)
+		}
+	}
+
+	pubsub := client.PSubscribe(ctx, keyeventExpiredPattern)
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, wrapRedisError("subscribe to expired key events", err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer pubsub.Close()
+		events := pubsub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-events:
+				if !ok {
+					return
+				}
+				key := msg.Payload
+				if !keys.matches(key) || keys.isInternal(key) {
+					continue
+				}
+				postfix := keys.postfix(key)
+				o.Logger.Debug("tasklocker: lock expired", "key", key)
+				if o.Notify {
+					if err := client.Publish(ctx, keys.freed(), keys.member(postfix)).Err(); err != nil && ctx.Err() == nil {
+						o.Logger.Warn("tasklocker: publish freed slot failed", "key", key, "error", err)
+					}
+				}
+				fn(postfix)
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			cancel()
+			<-done
+		})
+	}, nil
+}
+
+// expiredEventsEnabled reports whether a notify-keyspace-events setting publishes the expired key events:
+// it needs the keyevent class (E) and the expired events (x, or A for all events).
+func expiredEventsEnabled(events string) bool {
+	return strings.Contains(events, "E") && strings.ContainsAny(events, "xA")
+}
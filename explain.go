@@ -0,0 +1,94 @@
+package tasklocker
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Explanation describes what an acquisition would do, as returned by Explain: the keys and patterns computed
+// from the options, and the script call that Acquire would send to Redis.
+type Explanation struct {
+	// Key is the task key of the postfix.
+	Key string
+	// ActiveKey is the key of the sorted set counting the active tasks of the count scope.
+	ActiveKey string
+	// Pattern is the SCAN match pattern of the prefix, used by AcquireLockScan, ListActive and ClearPrefix.
+	Pattern string
+	// Channel is the pub/sub channel published to when a slot frees up, with WithNotify.
+	Channel string
+	// Limit is the number of units the acquisition may use, after the reservations of higher priorities.
+	Limit int
+	// TTL is the expiration of the task key, NoExpiry for none. It is zero when the lock expires at a Deadline.
+	TTL time.Duration
+	// Deadline is the time at which the task key expires, zero unless set with WithDeadline.
+	Deadline time.Time
+	// Script is the SHA1 digest of the acquire script, run with EVALSHA.
+	Script string
+	// ScriptKeys are the keys passed to the acquire script.
+	ScriptKeys []string
+	// ScriptArgs are the arguments passed to the acquire script. With WithTimeoutJitter, the TTL is one
+	// random sample, and without WithOwner the owner id is one generated for the explanation.
+	ScriptArgs []any
+}
+
+// String returns the explanation as the Redis command the acquisition would send, followed by the keys,
+// e.g. for a log line while checking a configuration.
+func (e Explanation) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "EVALSHA %s %d", e.Script, len(e.ScriptKeys))
+	for _, key := range e.ScriptKeys {
+		fmt.Fprintf(&b, " %q", key)
+	}
+	for _, arg := range e.ScriptArgs {
+		switch arg := arg.(type) {
+		case string, []byte:
+			fmt.Fprintf(&b, " %q", arg)
+		default:
+			fmt.Fprintf(&b, " %v", arg)
+		}
+	}
+	fmt.Fprintf(&b, " (key %q, active %q, pattern %q, limit %d)", e.Key, e.ActiveKey, e.Pattern, e.Limit)
+	return b.String()
+}
+
+// Explain describes what Acquire would do for the postfix with opts, without touching Redis: the computed
+// keys, SCAN pattern and channel, and the acquire script call with its keys and arguments. It validates the
+// options like Acquire, so a configuration that would fail is reported too. It is a superset of KeyFor and
+// ScanPatternFor, meant to check namespaces, separators, hash tags and key functions before going live.
+// Parameters:
+// - prefix: The prefix for the task key.
+// - postfix: The unique identifier for the task (e.g., task id).
+// - opts: The options, as passed to Acquire.
+func Explain(prefix, postfix string, opts ...Option) (Explanation, error) {
+	o := newPrefixOptions(prefix, opts)
+	if err := o.validate(prefix, postfix); err != nil {
+		return Explanation{}, err
+	}
+	if o.Owner == "" && !o.FencingToken {
+		owner, err := o.newOwner()
+		if err != nil {
+			return Explanation{}, err
+		}
+		o.Owner = owner
+	}
+
+	keys := o.keyspace(prefix)
+	scriptKeys, args := o.acquireArgs(keys, postfix, -1)
+	e := Explanation{
+		Key:        keys.task(postfix),
+		ActiveKey:  keys.active(),
+		Pattern:    keys.pattern(),
+		Channel:    keys.freed(),
+		Limit:      o.limit(),
+		Deadline:   o.Deadline,
+		Script:     o.acquireScript().Hash(),
+		ScriptKeys: scriptKeys,
+		ScriptArgs: args,
+	}
+	if o.Deadline.IsZero() {
+		e.TTL = o.Timeout
+	}
+	o.Logger.Debug("tasklocker: explain", "explanation", e.String())
+	return e, nil
+}
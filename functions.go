@@ -0,0 +1,135 @@
+package tasklocker
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// functionLibrary is the name of the Redis Function library loaded by RegisterFunctions.
+const functionLibrary = "tasklocker"
+
+// functionVersion is the function of the library returning its version.
+const functionVersion = functionLibrary + "_version"
+
+// scriptSources holds the source of every script of the package by SHA1, for RegisterFunctions.
+var scriptSources = map[string]string{}
+
+// functionClients holds the clients RegisterFunctions loaded the library on, whose scripts run with FCALL.
+var functionClients sync.Map
+
+// newScript returns the script of src, recording its source for the function library.
+func newScript(src string) *redis.Script {
+	script := redis.NewScript(src)
+	scriptSources[script.Hash()] = src
+	return script
+}
+
+// functionName returns the name of the function of the library running the script.
+func functionName(script *redis.Script) string {
+	return functionLibrary + "_" + script.Hash()
+}
+
+// functionCode returns the code of the function library, registering every script of the package as a
+// function named after its SHA1 and taking KEYS and ARGV as parameters, and the version of the library,
+// derived from the scripts, which the library returns from its version function.
+func functionCode() (string, string) {
+	hashes := make([]string, 0, len(scriptSources))
+	for hash := range scriptSources {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	sum := sha1.Sum([]byte(strings.Join(hashes, ",")))
+	version := hex.EncodeToString(sum[:8])
+
+	var code strings.Builder
+	code.WriteString("#!lua name=" + functionLibrary + "\n")
+	code.WriteString("redis.register_function('" + functionVersion + "', function() return '" + version + "' end)\n")
+	for _, hash := range hashes {
+		code.WriteString("redis.register_function('" + functionLibrary + "_" + hash + "', function(KEYS, ARGV)\n")
+		code.WriteString(scriptSources[hash])
+		code.WriteString("\nend)\n")
+	}
+	return code.String(), version
+}
+
+// RegisterFunctions loads the scripts of the package as the Redis Function library "tasklocker", for Redis 7
+// and later, so the acquire, release and other scripts of the package run with FCALL on client instead of
+// EVALSHA: the logic is registered once server-side and a call no longer depends on the script cache. Call
+// it at startup, with every client passed to the package (on Redis Cluster, the library is loaded on every
+// master). It is idempotent: the library is versioned by the scripts it contains, and it is only loaded when
+// the server holds no library of that version, replacing the library of another version in place, e.g. after
+// an upgrade of the package.
+// It returns false, and the scripts keep running with EVALSHA, when the server does not support functions.
+// A process whose functions were replaced by another version of the package (or removed with FUNCTION FLUSH)
+// falls back to EVALSHA as well, until it calls RegisterFunctions again. In a pipeline, the scripts run with
+// EVAL regardless. Processes of different versions sharing a server replace each other's library on every
+// registration, so upgrade them together.
+// Parameters:
+// - ctx: The context for the Redis operations.
+// - client: The Redis client instance.
+func RegisterFunctions(ctx context.Context, client redis.UniversalClient) (bool, error) {
+	code, version := functionCode()
+	supported := true
+	load := func(ctx context.Context, node redis.Cmdable) error {
+		current, err := node.FCall(ctx, functionVersion, nil).Text()
+		if err == nil && current == version {
+			return nil
+		}
+		if err := node.FunctionLoadReplace(ctx, code).Err(); err != nil {
+			if isUnknownCommand(err) {
+				supported = false
+				return nil
+			}
+			return wrapRedisError("load function library", err)
+		}
+		return nil
+	}
+
+	var err error
+	if cluster, ok := client.(*redis.ClusterClient); ok {
+		var mu sync.Mutex
+		err = cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+			mu.Lock()
+			defer mu.Unlock()
+			return load(ctx, node)
+		})
+	} else {
+		err = load(ctx, client)
+	}
+	if err != nil || !supported {
+		functionClients.Delete(client)
+		return false, err
+	}
+	functionClients.Store(client, struct{}{})
+	return true, nil
+}
+
+// functionCaller is the client of a script running with FCALL.
+type functionCaller interface {
+	FCall(ctx context.Context, function string, keys []string, args ...any) *redis.Cmd
+}
+
+// fcall runs the script as a function of the library when RegisterFunctions loaded it on client, and
+// reports whether it did. A missing function drops client from the registered ones, the script then runs
+// with EVALSHA.
+func fcall(ctx context.Context, client redis.Scripter, script *redis.Script, keys []string, args ...any) (*redis.Cmd, bool) {
+	caller, ok := client.(functionCaller)
+	if !ok {
+		return nil, false
+	}
+	if _, ok := functionClients.Load(client); !ok {
+		return nil, false
+	}
+	cmd := caller.FCall(ctx, functionName(script), keys, args...)
+	if err := cmd.Err(); err != nil && strings.Contains(err.Error(), "Function not found") {
+		functionClients.Delete(client)
+		return nil, false
+	}
+	return cmd, true
+}
@@ -0,0 +1,56 @@
+package tasklocker
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// healthKeyPrefix prefixes the probe keys written by HealthCheck.
+const healthKeyPrefix = "tasklocker:health:"
+
+// probeTimeout is the TTL of the probe key, so it does not linger if the DEL fails.
+const probeTimeout = 10 * time.Second
+
+// HealthCheck verifies that Redis is reachable, for startup checks and readiness probes.
+// It pings Redis and, with WithWriteProbe, also sets a short-lived probe key (under the WithNamespace namespace),
+// reads it back and deletes it, to confirm that the node accepts writes (e.g. it is not a read-only replica).
+// It returns nil when Redis is healthy, and an error wrapping ErrUnhealthy otherwise
+// (along with ErrRedisUnavailable when Redis could not be reached).
+// Parameters:
+// - ctx: The context for the Redis operations.
+// - client: The Redis client instance.
+// - opts: The options, e.g. WithWriteProbe or WithNamespace.
+func HealthCheck(ctx context.Context, client redis.UniversalClient, opts ...Option) error {
+	o := newOptions(opts)
+	ctx, cancel := o.opContext(ctx)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		return fmt.Errorf("%w: %w", ErrUnhealthy, wrapRedisError("ping redis", err))
+	}
+	if !o.WriteProbe {
+		return nil
+	}
+
+	value, err := newUUID()
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrUnhealthy, err)
+	}
+	key := o.Namespace + healthKeyPrefix + value
+	if err := client.Set(ctx, key, value, probeTimeout).Err(); err != nil {
+		return fmt.Errorf("%w: %w", ErrUnhealthy, wrapRedisError("set probe key", err))
+	}
+	got, err := client.Get(ctx, key).Result()
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrUnhealthy, wrapRedisError("get probe key", err))
+	}
+	if got != value {
+		return fmt.Errorf("%w: probe key %q holds %q, want %q", ErrUnhealthy, key, got, value)
+	}
+	if err := client.Del(ctx, key).Err(); err != nil {
+		return fmt.Errorf("%w: %w", ErrUnhealthy, wrapRedisError("delete probe key", err))
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package tasklocker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// metadataPrefix prefixes the task key fields holding the metadata set with WithMetadata.
+const metadataPrefix = "meta:"
+
+// LockInfo describes a held lock, as returned by GetLockInfo.
+type LockInfo struct {
+	// Key is the fully-qualified Redis key of the lock, as returned by Lock.Key.
+	Key string
+	// Owner is the value stored in the task key: the owner id, the fencing token, or "1" for AcquireLock.
+	Owner string
+	// Holds is the number of reentrant holds, 1 unless the lock was re-acquired with WithReentrant.
+	Holds int
+	// TTL is the remaining time before the lock expires, -1 when it has no expiry.
+	TTL time.Duration
+	// AcquiredAt is when the lock was first acquired, zero for keys written by earlier versions.
+	AcquiredAt time.Time
+	// Age is how long the lock has been held according to the Redis server clock, 0 when AcquiredAt is zero.
+	Age time.Duration
+	// Metadata holds the fields set with WithMetadata, empty when none were given.
+	Metadata map[string]string
+	// Data is the JSON document set with WithJSONMetadata, nil when none was given.
+	Data json.RawMessage
+}
+
+// GetLockInfo returns who holds a lock and the metadata stored with it, without modifying it,
+// so operators can inspect the tasks returned by ListActive. The key, its value, TTL and fields are read
+// together in a single script, so the info is a consistent snapshot of the lock.
+// It returns the lock info (nil when the key does not exist), a boolean indicating whether the key exists,
+// and an error if something goes wrong.
+// Parameters:
+// - ctx: The context for the Redis operations.
+// - client: The Redis client instance.
+// - prefix: The prefix for the task key.
+// - postfix: The unique identifier for the task (e.g., task id).
+// - opts: The key options, e.g. WithSeparator or WithHashTag.
+func GetLockInfo(ctx context.Context, client redis.UniversalClient, prefix, postfix string, opts ...Option) (*LockInfo, bool, error) {
+	o := newPrefixOptions(prefix, opts)
+	client = o.clientFor(prefix, client)
+	ctx, cancel := o.opContext(ctx)
+	defer cancel()
+	if err := o.validateKey(prefix, postfix); err != nil {
+		return nil, false, err
+	}
+
+	key := o.keyspace(prefix).task(postfix)
+	return decodeLockInfo(runScript(ctx, client, infoScript, []string{key}), key)
+}
+
+// decodeLockInfo decodes the reply of infoScript for the key, returning a nil info and false when the key
+// does not exist.
+func decodeLockInfo(cmd *redis.Cmd, key string) (*LockInfo, bool, error) {
+	reply, err := cmd.Slice()
+	if err != nil {
+		return nil, false, wrapRedisError("run info script", err)
+	}
+	pttl, ok := reply[0].(int64)
+	if !ok {
+		return nil, false, fmt.Errorf("%w: info script reply %v", ErrUnexpectedReply, reply)
+	}
+	if pttl == -2 {
+		return nil, false, nil
+	}
+	now, ok := reply[1].(int64)
+	if !ok || len(reply)%2 != 0 {
+		return nil, false, fmt.Errorf("%w: info script reply %v", ErrUnexpectedReply, reply)
+	}
+
+	info := &LockInfo{Key: key, Holds: 1, TTL: time.Duration(pttl) * time.Millisecond, Metadata: map[string]string{}}
+	if pttl < 0 {
+		info.TTL = -1
+	}
+	for i := 2; i < len(reply); i += 2 {
+		field, _ := reply[i].(string)
+		value, _ := reply[i+1].(string)
+		switch {
+		case field == "value":
+			info.Owner = value
+		case field == "count":
+			if holds, err := strconv.Atoi(value); err == nil {
+				info.Holds = holds
+			}
+		case field == "acquired_at":
+			if ms, err := strconv.ParseInt(value, 10, 64); err == nil {
+				info.AcquiredAt = time.UnixMilli(ms)
+				info.Age = time.Duration(now-ms) * time.Millisecond
+			}
+		case field == "data":
+			info.Data = json.RawMessage(value)
+		case strings.HasPrefix(field, metadataPrefix):
+			info.Metadata[strings.TrimPrefix(field, metadataPrefix)] = value
+		}
+	}
+	return info, true, nil
+}
+
+// GetMetadata decodes the JSON document stored with WithJSONMetadata in the task key into dst, which must be
+// a pointer, like json.Unmarshal. It returns false when the key does not exist, and an error wrapping
+// ErrNotStructured when the lock holds no document, e.g. a key written by AcquireLock holding "1".
+// Parameters:
+// - ctx: The context for the Redis operations.
+// - client: The Redis client instance.
+// - prefix: The prefix for the task key.
+// - postfix: The unique identifier for the task (e.g., task id).
+// - dst: The value the document is decoded into.
+// - opts: The key options, e.g. WithSeparator or WithHashTag.
+func GetMetadata(ctx context.Context, client redis.UniversalClient, prefix, postfix string, dst any, opts ...Option) (bool, error) {
+	info, exists, err := GetLockInfo(ctx, client, prefix, postfix, opts...)
+	if !exists {
+		return false, err
+	}
+	if info.Data == nil {
+		return true, fmt.Errorf("%w: %q holds %q", ErrNotStructured, KeyFor(prefix, postfix, opts...), info.Owner)
+	}
+	if err := json.Unmarshal(info.Data, dst); err != nil {
+		return true, fmt.Errorf("failed to decode the metadata of %q: %w", KeyFor(prefix, postfix, opts...), err)
+	}
+	return true, nil
+}
+
+// IsLocked reports whether the lock of the task is currently held, with a single EXISTS and
+// without acquiring it or touching any other state, e.g. to check whether a task is running.
+// Parameters:
+// - ctx: The context for the Redis operations.
+// - client: The Redis client instance.
+// - prefix: The prefix for the task key.
+// - postfix: The unique identifier for the task (e.g., task id).
+// - opts: The key options, e.g. WithSeparator or WithHashTag.
+func IsLocked(ctx context.Context, client redis.UniversalClient, prefix, postfix string, opts ...Option) (bool, error) {
+	o := newPrefixOptions(prefix, opts)
+	client = o.clientFor(prefix, client)
+	ctx, cancel := o.opContext(ctx)
+	defer cancel()
+	if err := o.validateKey(prefix, postfix); err != nil {
+		return false, err
+	}
+
+	n, err := client.Exists(ctx, o.keyspace(prefix).task(postfix)).Result()
+	if err != nil {
+		return false, wrapRedisError("check lock", err)
+	}
+	return n == 1, nil
+}
+
+// LockAge returns how long a lock has been held, measured with the Redis server clock, and whether
+// the key exists. Combined with the TTL it helps detect locks held abnormally long (e.g. stuck tasks).
+// The age is 0 when the key does not exist or was written by a version not storing the acquisition time.
+// Parameters:
+// - ctx: The context for the Redis operations.
+// - client: The Redis client instance.
+// - prefix: The prefix for the task key.
+// - postfix: The unique identifier for the task (e.g., task id).
+// - opts: The key options, e.g. WithSeparator or WithHashTag.
+func LockAge(ctx context.Context, client redis.UniversalClient, prefix, postfix string, opts ...Option) (time.Duration, bool, error) {
+	info, exists, err := GetLockInfo(ctx, client, prefix, postfix, opts...)
+	if !exists {
+		return 0, false, err
+	}
+	return info.Age, true, nil
+}
+
+// metadataArgs returns the metadata as name/value script arguments, sorted by name.
+func (o *Options) metadataArgs() []any {
+	names := make([]string, 0, len(o.Metadata))
+	for name := range o.Metadata {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	args := make([]any, 0, 2*len(names))
+	for _, name := range names {
+		args = append(args, name, o.Metadata[name])
+	}
+	return args
+}
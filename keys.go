@@ -0,0 +1,420 @@
+package tasklocker
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultSeparator separates the prefix from the postfix in task keys.
+const DefaultSeparator = ":"
+
+// Postfixes of the internal keys of a prefix. They are reserved and rejected as task postfixes, see validateKey.
+const (
+	activeSuffix   = "__active"  // the set tracking the active tasks
+	sequenceSuffix = "__seq"     // the counter generating fencing tokens
+	queueSuffix    = "__queue"   // the fair queue of waiting tasks
+	waitersSuffix  = "__waiters" // the deadlines of the tasks in the fair queue
+	readersSuffix  = "__readers" // the readers of the read/write locks, followed by the separator and the postfix
+	doneSuffix     = "__done"    // the dedup markers of recently released tasks, followed by the separator and the postfix
+	tenantSuffix   = "__tenant"  // the units held by a tenant, followed by the separator and the tenant
+	burstSuffix    = "__burst"   // the burst units spent within the burst window
+)
+
+// reservedSuffixes are the postfixes of the internal keys, checked by validateKey.
+var reservedSuffixes = []string{activeSuffix, sequenceSuffix, queueSuffix, waitersSuffix, readersSuffix, doneSuffix, tenantSuffix, burstSuffix}
+
+// keyspace builds the task keys and internal keys of a prefix.
+// The keys counting the concurrency (the active set and the fair queue) and the freed channel
+// belong to the count scope, which is the prefix itself unless several prefixes share a pool.
+type keyspace struct {
+	namespace string // prepended to every key and channel, empty by default
+	prefix    string
+	scope     string // the count scope, the prefix by default
+	separator string
+
+	keyFunc     func(prefix, postfix string) string // replaces the prefix:postfix layout, see WithKeyFunc
+	patternFunc func(prefix string) string          // replaces the SCAN pattern, see WithKeyFunc
+
+	maxKeyLen int             // the task key length above which the postfix is hashed, see WithMaxKeyLength
+	keyHash   KeyHashEncoding // the encoding of the hash
+	bucketEnd time.Time       // the end of the time bucket of the keys, zero without one, see WithTimeBucket
+}
+
+// task returns the key for the postfix (e.g., google_places_brands_processor:1).
+func (k keyspace) task(postfix string) string {
+	return k.rawTask(k.shorten(postfix))
+}
+
+// shorten returns the postfix, or its hash when its task key would be longer than k.maxKeyLen.
+// Postfixes no longer than a hash are kept, so shortening a shortened postfix returns it unchanged.
+func (k keyspace) shorten(postfix string) string {
+	if k.maxKeyLen <= 0 || len(postfix) <= k.hashLen() || len(k.rawTask(postfix)) <= k.maxKeyLen {
+		return postfix
+	}
+	sum := sha256.Sum256([]byte(postfix))
+	if k.keyHash == Base64KeyHash {
+		return base64.RawURLEncoding.EncodeToString(sum[:])
+	}
+	return hex.EncodeToString(sum[:])
+}
+
+// hashLen returns the length of the hash shorten replaces long postfixes with.
+func (k keyspace) hashLen() int {
+	if k.keyHash == Base64KeyHash {
+		return base64.RawURLEncoding.EncodedLen(sha256.Size)
+	}
+	return hex.EncodedLen(sha256.Size)
+}
+
+// rawTask returns the key for the postfix like task, without shortening it.
+func (k keyspace) rawTask(postfix string) string {
+	if k.keyFunc != nil {
+		return k.namespace + k.keyFunc(k.prefix, postfix)
+	}
+	return k.namespace + k.prefix + k.separator + postfix
+}
+
+// scoped returns the internal key of the count scope for the suffix.
+func (k keyspace) scoped(suffix string) string {
+	if k.keyFunc != nil {
+		return k.namespace + k.keyFunc(k.scope, suffix)
+	}
+	return k.namespace + k.scope + k.separator + suffix
+}
+
+// member returns the member of the postfix in the active set and the fair queue: the postfix itself,
+// or the prefix and the postfix when the count scope is shared with other prefixes.
+func (k keyspace) member(postfix string) string {
+	postfix = k.shorten(postfix)
+	if k.scope == k.prefix {
+		return postfix
+	}
+	return k.prefix + k.separator + postfix
+}
+
+// memberTask returns the task key of a member of the active set, including the extra members of a weighted task.
+// With a shared count scope, the member holds the prefix of its task, which may be another prefix of the group;
+// with a key function, the key of such a member can't be built and false is returned.
+func (k keyspace) memberTask(member string) (string, bool) {
+	member, _, _ = strings.Cut(member, "\x00")
+	if k.scope == k.prefix {
+		return k.task(member), true
+	}
+	if k.keyFunc == nil {
+		return k.namespace + member, true
+	}
+	postfix, ok := strings.CutPrefix(member, k.prefix+k.separator)
+	return k.task(postfix), ok
+}
+
+// active returns the key of the set tracking the active tasks (e.g., google_places_brands_processor:__active).
+func (k keyspace) active() string {
+	return k.scoped(activeSuffix)
+}
+
+// sequence returns the key of the fencing token counter (e.g., google_places_brands_processor:__seq).
+func (k keyspace) sequence() string {
+	return k.task(sequenceSuffix)
+}
+
+// queue returns the key of the fair queue (e.g., google_places_brands_processor:__queue).
+func (k keyspace) queue() string {
+	return k.scoped(queueSuffix)
+}
+
+// waiters returns the key of the fair queue deadlines (e.g., google_places_brands_processor:__waiters).
+func (k keyspace) waiters() string {
+	return k.scoped(waitersSuffix)
+}
+
+// burst returns the key of the set tracking the burst units spent (e.g., google_places_brands_processor:__burst).
+func (k keyspace) burst() string {
+	return k.scoped(burstSuffix)
+}
+
+// freedChannelPrefix prefixes the pub/sub channel notified when a slot of a prefix frees up.
+const freedChannelPrefix = "tasklocker:freed:"
+
+// freed returns the pub/sub channel notified when a slot frees up (e.g., tasklocker:freed:google_places_brands_processor).
+// Channels are shared by all databases of a server, so the namespace is prepended to them too.
+func (k keyspace) freed() string {
+	return k.namespace + freedChannelPrefix + k.scope
+}
+
+// pattern returns the SCAN match pattern for the keys of the prefix (e.g., google_places_brands_processor:*).
+// The glob characters of the namespace, prefix and separator are escaped, so a prefix like "job*"
+// only matches its own keys. A pattern function's result is used as is, after the escaped namespace.
+func (k keyspace) pattern() string {
+	if k.patternFunc != nil {
+		return escapePattern(k.namespace) + k.patternFunc(k.prefix)
+	}
+	return escapePattern(k.task("")) + "*"
+}
+
+// matches reports whether the key belongs to the prefix, i.e. matches its SCAN pattern.
+func (k keyspace) matches(key string) bool {
+	if k.patternFunc != nil {
+		return matchPattern(k.pattern(), key)
+	}
+	return strings.HasPrefix(key, k.task(""))
+}
+
+// postfix returns the postfix of a task key of the prefix. With a key function, the postfix can only be
+// recovered when the key starts with the key of an empty postfix; the whole key is returned otherwise.
+func (k keyspace) postfix(key string) string {
+	return strings.TrimPrefix(key, k.task(""))
+}
+
+// tenant returns the key of the set tracking the units held by the tenant in the count scope
+// (e.g., google_places_brands_processor:__tenant:acme).
+func (k keyspace) tenant(tenant string) string {
+	return k.scoped(tenantSuffix + k.separator + tenant)
+}
+
+// readers returns the key of the set tracking the readers of the postfix's read/write lock
+// (e.g., google_places_brands_processor:__readers:1).
+func (k keyspace) readers(postfix string) string {
+	return k.rawTask(readersSuffix + k.separator + k.shorten(postfix))
+}
+
+// done returns the dedup marker key set when the postfix's lock is released (e.g., google_places_brands_processor:__done:1).
+func (k keyspace) done(postfix string) string {
+	return k.rawTask(doneSuffix + k.separator + k.shorten(postfix))
+}
+
+// isInternal reports whether the key is one of the internal keys of the prefix. With a key function,
+// whose keys may vary (e.g. with a date shard), a key is internal when it ends with a reserved postfix.
+func (k keyspace) isInternal(key string) bool {
+	if k.keyFunc != nil {
+		return hasReservedPostfix(key, k.separator)
+	}
+	return key == k.active() || key == k.sequence() || key == k.queue() || key == k.waiters() || key == k.burst() ||
+		strings.HasPrefix(key, k.readers("")) || strings.HasPrefix(key, k.done("")) || strings.HasPrefix(key, k.tenant(""))
+}
+
+// hasReservedPostfix reports whether the key ends with a reserved postfix, or contains one of the reserved
+// postfixes followed by the separator, as the internal keys of any prefix do.
+func hasReservedPostfix(key, separator string) bool {
+	for _, suffix := range []string{activeSuffix, sequenceSuffix, queueSuffix, waitersSuffix, burstSuffix} {
+		if strings.HasSuffix(key, suffix) {
+			return true
+		}
+	}
+	return strings.Contains(key, readersSuffix+separator) || strings.Contains(key, doneSuffix+separator) ||
+		strings.Contains(key, tenantSuffix+separator)
+}
+
+// keyspace returns the keyspace of the prefix, applying the namespace, count scope, hash tag and separator options.
+func (o *Options) keyspace(prefix string) keyspace {
+	scope := prefix
+	if o.CountScope != "" {
+		scope = o.CountScope
+	}
+	var bucketEnd time.Time
+	if o.TimeBucket >= time.Second { // shorter buckets are rejected by validateAcquisition
+		now := o.Clock().UnixMilli()
+		start := now - now%o.TimeBucket.Milliseconds()
+		bucketEnd = time.UnixMilli(start + o.TimeBucket.Milliseconds())
+		bucket := o.Separator + strconv.FormatInt(start/1000, 10)
+		prefix, scope = prefix+bucket, scope+bucket
+	}
+	if o.HashTag {
+		prefix = HashTag(prefix)
+		scope = HashTag(scope)
+	}
+	return keyspace{namespace: o.Namespace, prefix: prefix, scope: scope, separator: o.Separator, keyFunc: o.KeyFunc, patternFunc: o.PatternFunc, maxKeyLen: o.MaxKeyLength, keyHash: o.KeyHash, bucketEnd: bucketEnd}
+}
+
+// validateKey checks that the prefix and postfix are not empty, that the postfix is not the one of an
+// internal key (e.g. __active, or __readers followed by the separator), whose task key would overwrite it,
+// and that a custom separator does not appear in them, since that would make keys of different prefixes
+// collide (e.g. "a|b" + "c" and "a" + "b|c").
+// The default separator is not checked, to keep existing prefixes containing colons working.
+func (o *Options) validateKey(prefix, postfix string) error {
+	if err := o.validatePrefix(prefix); err != nil {
+		return err
+	}
+	if postfix == "" {
+		return ErrEmptyPostfix
+	}
+	for _, reserved := range reservedSuffixes {
+		if postfix == reserved || strings.HasPrefix(postfix, reserved+o.Separator) {
+			return fmt.Errorf("%w: postfix %q is reserved for the internal key %q", ErrInvalidOption, postfix, reserved)
+		}
+	}
+	if o.Separator != DefaultSeparator && strings.Contains(postfix, o.Separator) {
+		return fmt.Errorf("%w: postfix %q contains the separator %q", ErrInvalidSeparator, postfix, o.Separator)
+	}
+	return nil
+}
+
+// validatePrefix checks the prefix like validateKey, for the functions working on a whole prefix.
+func (o *Options) validatePrefix(prefix string) error {
+	if prefix == "" {
+		return ErrEmptyPrefix
+	}
+	if o.unregistered {
+		return fmt.Errorf("%w: %q", ErrUnregisteredPrefix, prefix)
+	}
+	if o.Separator == DefaultSeparator {
+		return nil
+	}
+	if o.Separator == "" {
+		return fmt.Errorf("%w: separator must not be empty", ErrInvalidSeparator)
+	}
+	if strings.Contains(prefix, o.Separator) {
+		return fmt.Errorf("%w: prefix %q contains the separator %q", ErrInvalidSeparator, prefix, o.Separator)
+	}
+	if strings.Contains(o.CountScope, o.Separator) {
+		return fmt.Errorf("%w: count scope %q contains the separator %q", ErrInvalidSeparator, o.CountScope, o.Separator)
+	}
+	return nil
+}
+
+// validateKeys checks the keys the options build for the prefix, from sample postfixes, for the mistakes that
+// only show at runtime, e.g. with a custom separator, namespace or key function: an empty task key, postfixes
+// or prefixes sharing a key, task keys colliding with the internal keys, and a SCAN pattern that misses the
+// task keys (so AcquireLockScan and CountActive do not count them), starts with a glob character (walking the
+// keys of every prefix) or matches the keys of another prefix. Every problem found is reported, joined.
+func (o *Options) validateKeys(prefix string) error {
+	if o.validatePrefix(prefix) != nil {
+		return nil // reported by validateConfig
+	}
+	keys := o.keyspace(prefix)
+	key, other := keys.task("sample"), keys.task("other")
+	pattern := keys.pattern()
+	var errs []error
+	if key == "" || key == o.Namespace {
+		errs = append(errs, fmt.Errorf("%w: the task key of the postfix %q is empty", ErrInvalidOption, "sample"))
+	}
+	if key == other {
+		errs = append(errs, fmt.Errorf("%w: the postfixes %q and %q share the task key %q", ErrInvalidOption, "sample", "other", key))
+	}
+	for _, internal := range []string{keys.active(), keys.sequence(), keys.queue(), keys.waiters(), keys.burst()} {
+		if key == internal || other == internal {
+			errs = append(errs, fmt.Errorf("%w: task keys collide with the internal key %q", ErrInvalidOption, internal))
+			break
+		}
+	}
+	if !keys.matches(key) {
+		errs = append(errs, fmt.Errorf("%w: the scan pattern %q does not match the task key %q", ErrInvalidOption, pattern, key))
+	}
+	if glob := strings.TrimPrefix(pattern, escapePattern(o.Namespace)); strings.IndexAny(glob, "*?[") == 0 {
+		errs = append(errs, fmt.Errorf("%w: the scan pattern %q starts with a glob character, it walks the keys of every prefix", ErrInvalidOption, pattern))
+	}
+	neighbour := o.keyspace(prefix + "x")
+	if neighbour.task("sample") == key {
+		errs = append(errs, fmt.Errorf("%w: the prefixes %q and %q share the task key %q", ErrInvalidOption, prefix, prefix+"x", key))
+	} else if matchPattern(pattern, neighbour.task("sample")) {
+		errs = append(errs, fmt.Errorf("%w: the scan pattern %q also matches the keys of other prefixes, e.g. %q", ErrInvalidOption, pattern, neighbour.task("sample")))
+	}
+	return errors.Join(errs...)
+}
+
+// escapePattern escapes the glob characters (*, ?, [, ] and the backslash) of s, so it matches itself
+// literally in a SCAN MATCH or PSUBSCRIBE pattern. Keys themselves are always used literally and never escaped.
+func escapePattern(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// matchPattern reports whether s matches the glob pattern like Redis does for SCAN MATCH
+// (*, ?, [...] with ranges and ^ negation, and backslash escapes).
+func matchPattern(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if matchPattern(pattern, s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			end := strings.IndexByte(pattern[1:], ']')
+			if end < 0 {
+				return false
+			}
+			class := pattern[1 : end+1]
+			negate := strings.HasPrefix(class, "^")
+			if negate {
+				class = class[1:]
+			}
+			matched := false
+			for i := 0; i < len(class); i++ {
+				if i+2 < len(class) && class[i+1] == '-' {
+					lo, hi := min(class[i], class[i+2]), max(class[i], class[i+2])
+					matched = matched || (s[0] >= lo && s[0] <= hi)
+					i += 2
+					continue
+				}
+				matched = matched || class[i] == s[0]
+			}
+			if matched == negate {
+				return false
+			}
+			pattern = pattern[end+1:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return len(s) == 0
+}
+
+// HashTag wraps the prefix in a Redis Cluster hash tag (e.g. {google_places_brands_processor}),
+// so the task keys and internal keys of the prefix all hash to the same slot.
+// Pass the result as the prefix to every function (or use WithHashTag) to make the package cluster-safe:
+// the acquire and release scripts touch several keys of the prefix, and the concurrency
+// limit only holds when they live on the same node.
+// Note that this concentrates all keys of a prefix on a single cluster node.
+func HashTag(prefix string) string {
+	return "{" + prefix + "}"
+}
+
+// KeyFor returns the task key the package uses for the postfix, with the namespace, separator, hash tag or
+// key function given by opts, e.g. for dashboards or cleanup scripts that must stay in lockstep with it.
+// Pass the same key options as on acquire. The prefix and postfix are not validated.
+func KeyFor(prefix, postfix string, opts ...Option) string {
+	return newPrefixOptions(prefix, opts).keyspace(prefix).task(postfix)
+}
+
+// ScanPatternFor returns the SCAN match pattern of the task keys of the prefix, as used by AcquireLockScan and
+// ListActive. It also matches the internal keys of the prefix, whose postfix starts with "__" (e.g. prefix:__active),
+// unless they live in another count scope, so skip them. Pass the same key options as on acquire.
+func ScanPatternFor(prefix string, opts ...Option) string {
+	return newPrefixOptions(prefix, opts).keyspace(prefix).pattern()
+}
@@ -0,0 +1,90 @@
+package tasklocker_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/youssefsiam38/tasklocker"
+)
+
+func TestScanPatternBrackets(t *testing.T) {
+	mr, client := newRedis(t)
+	ctx := context.Background()
+	for _, key := range []string{"a[b]:1", "a[b]:2", "ab:1", "b:1", "a:1"} {
+		mr.Set(key, "1")
+	}
+
+	// Unescaped, a[b]:* would match ab:1 and miss the keys of the prefix
+	if n, err := tasklocker.CountActive(ctx, client, "a[b]"); err != nil || n != 2 {
+		t.Fatalf("CountActive(a[b]) = %d, %v, want 2", n, err)
+	}
+	acquired, exists, err := tasklocker.AcquireLockScan(ctx, client, "a[b]", "3", 2, time.Minute, 10)
+	if err != nil || acquired || exists {
+		t.Fatalf("AcquireLockScan(a[b], limit 2) = %v, %v, %v, want limit reached", acquired, exists, err)
+	}
+	acquired, _, err = tasklocker.AcquireLockScan(ctx, client, "a[b]", "3", 3, time.Minute, 10)
+	if err != nil || !acquired {
+		t.Fatalf("AcquireLockScan(a[b], limit 3) = %v, %v, want acquired", acquired, err)
+	}
+	// The task key itself stays literal
+	if !mr.Exists("a[b]:3") {
+		t.Fatal("a[b]:3 not set")
+	}
+}
+
+func TestScanPatternGlobs(t *testing.T) {
+	mr, client := newRedis(t)
+	ctx := context.Background()
+	for _, key := range []string{"job*:1", "job*:2", "jobX:1", "jobXY:1", "job?:1", "jobs:1"} {
+		mr.Set(key, "1")
+	}
+
+	for prefix, want := range map[string]int{"job*": 2, "job?": 1} {
+		for _, count := range []int64{1, 1000} {
+			n, err := tasklocker.CountActive(ctx, client, prefix, tasklocker.WithScanCount(count))
+			if err != nil || n != want {
+				t.Fatalf("CountActive(%s, WithScanCount(%d)) = %d, %v, want %d", prefix, count, n, err, want)
+			}
+		}
+	}
+	if pattern := tasklocker.ScanPatternFor("job*"); pattern != `job\*:*` {
+		t.Fatalf("ScanPatternFor(job*) = %q, want %q", pattern, `job\*:*`)
+	}
+	acquired, _, err := tasklocker.AcquireLockScan(ctx, client, "job?", "2", 2, time.Minute, 1)
+	if err != nil || !acquired {
+		t.Fatalf("AcquireLockScan(job?, limit 2) = %v, %v, want acquired", acquired, err)
+	}
+}
+
+func TestReservedPostfix(t *testing.T) {
+	mr, client := newRedis(t)
+	ctx := context.Background()
+	if acquired, _, err := tasklocker.AcquireLock(ctx, client, "jobs", "a", 1, time.Minute); err != nil || !acquired {
+		t.Fatalf("AcquireLock(a) = %v, %v, want acquired", acquired, err)
+	}
+
+	// Releasing __active would delete the active set, and let the next acquisition past the limit
+	if err := tasklocker.ReleaseLock(ctx, client, "jobs", "__active"); !errors.Is(err, tasklocker.ErrInvalidOption) {
+		t.Fatalf("ReleaseLock(__active) = %v, want ErrInvalidOption", err)
+	}
+	if !mr.Exists("jobs:__active") {
+		t.Fatal("ReleaseLock(__active) deleted the active set")
+	}
+	if acquired, _, err := tasklocker.AcquireLock(ctx, client, "jobs", "b", 1, time.Minute); err != nil || acquired {
+		t.Fatalf("AcquireLock(b) = %v, %v, want limit reached", acquired, err)
+	}
+
+	for _, postfix := range []string{"__active", "__seq", "__readers", "__readers:a", "__tenant:t"} {
+		if _, _, err := tasklocker.AcquireLock(ctx, client, "other", postfix, 1, time.Minute); !errors.Is(err, tasklocker.ErrInvalidOption) {
+			t.Fatalf("AcquireLock(%s) = %v, want ErrInvalidOption", postfix, err)
+		}
+	}
+	// Only the exact postfixes, or followed by the separator, are reserved
+	for _, postfix := range []string{"__activex", "x__seq", "__readersx:a"} {
+		if acquired, _, err := tasklocker.AcquireLock(ctx, client, "other", postfix, 3, time.Minute); err != nil || !acquired {
+			t.Fatalf("AcquireLock(%s) = %v, %v, want acquired", postfix, acquired, err)
+		}
+	}
+}
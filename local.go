@@ -0,0 +1,131 @@
+package tasklocker
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// localLocks holds the locks taken in-process while Redis was unavailable, see WithLocalFallback.
+var localLocks = localTable{locks: make(map[string]localLock)}
+
+// localTable is a process-local stand-in for the task keys and active sets of Redis.
+type localTable struct {
+	mu    sync.Mutex
+	locks map[string]localLock // by task key
+}
+
+// localLock is a lock taken in-process.
+type localLock struct {
+	owner  string
+	scope  string    // the active set key the lock counts towards
+	weight int       // the units of the limit the lock takes
+	expiry time.Time // zero for no expiry
+}
+
+// acquire takes the task key when it is free and the local locks of its scope leave room for l.weight
+// units of limit. It returns whether it acquired, the expiry of the existing lock when the key is taken,
+// and the units in use in the scope.
+func (t *localTable) acquire(key string, l localLock, limit int, now time.Time) (bool, *time.Time, int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for k, held := range t.locks {
+		if !held.expiry.IsZero() && !now.Before(held.expiry) {
+			delete(t.locks, k)
+		}
+	}
+	if held, ok := t.locks[key]; ok {
+		return false, &held.expiry, 0
+	}
+	active := 0
+	for _, held := range t.locks {
+		if held.scope == l.scope {
+			active += held.weight
+		}
+	}
+	if limit != Unlimited && active+l.weight > limit {
+		return false, nil, active
+	}
+	t.locks[key] = l
+	return true, nil, active + l.weight
+}
+
+// release deletes the local lock of the key when it holds owner, or whatever it holds when owner is empty,
+// and reports whether it did.
+func (t *localTable) release(key, owner string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	held, ok := t.locks[key]
+	if !ok || (owner != "" && held.owner != owner) {
+		return false
+	}
+	delete(t.locks, key)
+	return true
+}
+
+// refresh sets the expiry of the local lock of the key while it holds owner, or whatever it holds when owner
+// is empty, and reports whether it did.
+func (t *localTable) refresh(key, owner string, expiry, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	held, ok := t.locks[key]
+	if !ok || (owner != "" && held.owner != owner) || (!held.expiry.IsZero() && !now.Before(held.expiry)) {
+		return false
+	}
+	held.expiry = expiry
+	t.locks[key] = held
+	return true
+}
+
+// count returns the units of the unexpired local locks of the scope.
+func (t *localTable) count(scope string, now time.Time) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	active := 0
+	for _, held := range t.locks {
+		if held.scope == scope && (held.expiry.IsZero() || now.Before(held.expiry)) {
+			active += held.weight
+		}
+	}
+	return active
+}
+
+// acquireLocal takes the lock of the postfix in-process for WithLocalFallback, after the acquire script
+// failed with redisErr because Redis is unavailable. The concurrency limit only counts the local locks of
+// this process. Fencing tokens, pending locks and versions need Redis, so redisErr is returned for them.
+func acquireLocal(ctx context.Context, client redis.UniversalClient, keys keyspace, postfix string, o *Options, redisErr error) (acquireReply, error) {
+	if o.FencingToken || o.Pending > 0 || o.VersionKey != "" {
+		return acquireReply{}, redisErr
+	}
+	taskKey := keys.task(postfix)
+	now := o.Clock()
+	var expiry time.Time
+	switch {
+	case !o.Deadline.IsZero():
+		expiry = o.Deadline
+	case o.Timeout != NoExpiry:
+		expiry = now.Add(o.Timeout)
+	}
+
+	acquired, existing, active := localLocks.acquire(taskKey, localLock{owner: o.Owner, scope: keys.active(), weight: o.Weight, expiry: expiry}, o.limit(), now)
+	switch {
+	case acquired:
+		o.Logger.Warn("tasklocker: redis unavailable, lock acquired in-process only", "key", taskKey, "error", redisErr)
+		o.Metrics.IncAcquired(keys.prefix)
+		o.recordContention(ctx, keys.prefix, false)
+		return acquireReply{lock: &Lock{ctx: ctx, client: client, keys: keys, postfix: postfix, key: taskKey, owner: o.Owner, local: true, attempts: 1, active: active, mode: o.releaseMode(), acquiredAt: now, clock: o.Clock, onHoldTime: o.OnHoldTime, opTimeout: o.OpTimeout, opDefault: o.DefaultOpTimeout, lifetime: o.MaxLifetime}}, nil
+	case existing != nil:
+		ttl := time.Duration(-1)
+		if !existing.IsZero() {
+			ttl = existing.Sub(now)
+		}
+		o.Metrics.IncDuplicate(keys.prefix)
+		return acquireReply{exists: true, ttl: ttl}, nil
+	default:
+		o.Metrics.IncRejected(keys.prefix)
+		o.recordContention(ctx, keys.prefix, true)
+		return acquireReply{active: active}, nil
+	}
+}
@@ -0,0 +1,288 @@
+package tasklocker
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Lock is a handle to an acquired lock. It captures everything needed to release the lock,
+// so the prefix and postfix don't have to be passed again (and can't differ) at release time.
+type Lock struct {
+	ctx        context.Context
+	client     redis.UniversalClient
+	keys       keyspace
+	postfix    string
+	key        string
+	owner      string
+	token      int64
+	evicted    int                 // the expired tasks evicted by the acquisition
+	attempts   int                 // the attempts the acquisition took, the successful one included
+	local      bool                // taken in-process while Redis was unavailable, see WithLocalFallback
+	active     int                 // the active units right after the acquisition, including the lock's
+	mode       releaseMode         // how Unlock releases the lock
+	acquiredAt time.Time           // when the lock was acquired, for onHoldTime
+	clock      func() time.Time    // the time source of the acquisition
+	onHoldTime func(time.Duration) // called after a successful Unlock with the time the lock was held
+	onUnlock   func()              // called after a successful Unlock, e.g. by the Locker tracking the lock
+	opTimeout  time.Duration       // bounds the operations of the handle, see WithOpTimeout
+	opDefault  time.Duration       // bounds the operations of the handle when ctx has no deadline, see WithDefaultOpTimeout
+	lifetime   time.Duration       // caps the age Refresh keeps the lock alive to, see WithMaxLifetime
+	funcs      *lockFuncs          // replaces Unlock and Refresh, see NewLock
+
+	mu       sync.Mutex
+	unlocked bool          // set by the first successful Unlock
+	lost     chan struct{} // closed once a refresh found the lock lost, created by Lost
+	isLost   bool          // set once a refresh found the lock lost
+}
+
+// lockFuncs replaces the Redis operations of a Lock created by NewLock.
+type lockFuncs struct {
+	unlock  func() error
+	refresh func(timeout time.Duration) (bool, error)
+}
+
+// NewLock returns a Lock handle for the key and owner whose Unlock and Refresh call unlock and refresh instead
+// of Redis, for test doubles returning locks, such as tasklockertest.FakeLocker. The handle behaves like an
+// acquired one otherwise: Unlock calls unlock until it succeeds once, Refresh returning false closes Lost, and
+// AutoRenew calls refresh with ctx as the context of the lock. Promote reports it as not pending.
+func NewLock(ctx context.Context, key, owner string, unlock func() error, refresh func(timeout time.Duration) (bool, error)) *Lock {
+	return &Lock{ctx: ctx, key: key, owner: owner, attempts: 1, acquiredAt: time.Now(), clock: time.Now, funcs: &lockFuncs{unlock: unlock, refresh: refresh}}
+}
+
+// TryLock tries to acquire a lock like AcquireLock, but returns a Lock handle owned by a random UUID.
+// It returns the lock (nil when not acquired), a boolean indicating whether the lock is acquired,
+// a boolean indicating whether the key exists, and an error if something goes wrong.
+// Unlock is safe to call on a nil lock, so callers can defer it right away:
+//
+//	lock, ok, _, err := tasklocker.TryLock(ctx, client, prefix, postfix, 3, time.Minute)
+//	defer lock.Unlock()
+//
+// Parameters:
+// - ctx: The context for the Redis operations, also used by Unlock.
+// - client: The Redis client instance.
+// - prefix: The prefix for the task key.
+// - postfix: The unique identifier for the task (e.g., task id).
+// - allowedConcurrentTasks: The maximum number of concurrent tasks allowed.
+// - timeout: The duration after which the lock should be automatically released.
+func TryLock(ctx context.Context, client redis.UniversalClient, prefix, postfix string, allowedConcurrentTasks int, timeout time.Duration) (*Lock, bool, bool, error) {
+	return Acquire(ctx, client, prefix, postfix, WithLimit(allowedConcurrentTasks), WithTimeout(timeout))
+}
+
+// AcquireOrWait acquires a lock like TryLock, but while the concurrency limit is reached it keeps retrying
+// until the lock is acquired, and returns its handle. It returns an error wrapping ErrLockExists when the task
+// key already exists, since that is a duplicate task rather than a capacity issue, and ctx.Err() when ctx is
+// done first. The lock is nil whenever the error is not, and Unlock is safe to call on it, so callers can defer
+// it right away. Retries use the zero Backoff (every 100ms) unless opts contain WithRetry.
+// Parameters:
+// - ctx: The context for the Redis operations and the wait, also used by Unlock.
+// - client: The Redis client instance.
+// - prefix: The prefix for the task key.
+// - postfix: The unique identifier for the task (e.g., task id).
+// - allowedConcurrentTasks: The maximum number of concurrent tasks allowed.
+// - timeout: The duration after which the lock should be automatically released.
+// - opts: Further options, e.g. WithRetry, WithOwner or WithFencingToken.
+func AcquireOrWait(ctx context.Context, client redis.UniversalClient, prefix, postfix string, allowedConcurrentTasks int, timeout time.Duration, opts ...Option) (*Lock, error) {
+	opts = append([]Option{WithLimit(allowedConcurrentTasks), WithTimeout(timeout), WithRetry(Backoff{})}, opts...)
+	lock, _, exists, err := Acquire(ctx, client, prefix, postfix, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, fmt.Errorf("%w: %q", ErrLockExists, newPrefixOptions(prefix, opts).keyspace(prefix).task(postfix))
+	}
+	return lock, nil
+}
+
+// Active returns the number of active tasks of the prefix (or of its count scope) right after the lock was
+// acquired, including this lock, read atomically by the acquire script, e.g. to log "acquired slot 7 of 10".
+// Weighted locks count their weight. A pending lock is not counted until it is promoted.
+func (l *Lock) Active() int {
+	return l.active
+}
+
+// Attempts returns the number of attempts the acquisition took, the successful one included: 1 when the
+// lock was acquired right away, more when WithRetry waited for a slot. High counts across the fleet mean
+// the limit is often reached, i.e. the capacity is under-provisioned.
+func (l *Lock) Attempts() int {
+	return l.attempts
+}
+
+// Local reports whether the lock was taken in-process because Redis was unavailable (see WithLocalFallback),
+// in which case it only excludes the holders of the same process.
+func (l *Lock) Local() bool {
+	return l.local
+}
+
+// Evicted returns the number of tasks whose timeout had passed and that the acquisition evicted from the
+// active set, typically freeing the slot the lock took. It is 0 when the lock took a slot that was free.
+func (l *Lock) Evicted() int {
+	return l.evicted
+}
+
+// Key returns the fully-qualified Redis key of the lock, including the namespace, hash tag and
+// separator (e.g., google_places_brands_processor:1), so callers can log exactly what was set in Redis.
+func (l *Lock) Key() string {
+	return l.key
+}
+
+// Owner returns the value stored in the task key: the owner id, or the fencing token when one was requested.
+func (l *Lock) Owner() string {
+	return l.owner
+}
+
+// Token returns the fencing token of the lock, or 0 when it was acquired without WithFencingToken.
+func (l *Lock) Token() int64 {
+	return l.token
+}
+
+// Refresh resets the TTL of the lock to timeout, but only while it is still owned by this handle.
+// It returns false when the lock was lost, in which case the caller should stop its work, or when it
+// reached the WithMaxLifetime of its acquisition. The Lost channel is closed then.
+func (l *Lock) Refresh(timeout time.Duration) (bool, error) {
+	return l.renew(l.ctx, timeout)
+}
+
+// renew implements Refresh with ctx, marking the lock lost when it is no longer held.
+func (l *Lock) renew(ctx context.Context, timeout time.Duration) (bool, error) {
+	var refreshed bool
+	if l.funcs != nil {
+		var err error
+		if refreshed, err = l.funcs.refresh(timeout); err != nil {
+			return false, err
+		}
+	} else if l.local {
+		refreshed = localLocks.refresh(l.key, l.owner, l.clock().Add(timeout), l.clock())
+	} else {
+		ctx, cancel := withOpTimeout(ctx, l.opTimeout, l.opDefault)
+		defer cancel()
+		var err error
+		if refreshed, err = refresh(ctx, l.client, l.keys, l.postfix, timeout, l.owner, l.lifetime); err != nil {
+			return false, err
+		}
+	}
+	if !refreshed {
+		l.markLost()
+	}
+	return refreshed, nil
+}
+
+// Lost returns a channel closed once the lock is known to be lost: a Refresh, or the renewals started by the
+// AutoRenew method, found that the key expired or is held by someone else, e.g. for a worker to abort from
+// a select loop:
+//
+//	select {
+//	case <-lock.Lost():
+//		return errLockLost
+//	case <-done:
+//	}
+//
+// The loss is only noticed by a refresh, so without one the channel is not closed when the lock expires.
+// Unlock does not close it either.
+func (l *Lock) Lost() <-chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.lost == nil {
+		l.lost = make(chan struct{})
+		if l.isLost {
+			close(l.lost)
+		}
+	}
+	return l.lost
+}
+
+// markLost records that the lock was lost, closing the Lost channel.
+func (l *Lock) markLost() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.isLost {
+		return
+	}
+	l.isLost = true
+	if l.lost != nil {
+		close(l.lost)
+	}
+}
+
+// AutoRenew keeps the lock alive like the package-level AutoRenew, refreshing its TTL to timeout every
+// timeout/3 in a background goroutine with the owner, operation timeouts and WithMaxLifetime of the handle,
+// until the returned stop function is called or the context of the lock is done. When a renewal finds the
+// lock lost, renewal stops, the Lost channel is closed and the WithOnLostLock callback of opts is invoked.
+// Parameters:
+// - timeout: The TTL set on every renewal.
+// - opts: The options, e.g. WithOnLostLock.
+func (l *Lock) AutoRenew(timeout time.Duration, opts ...Option) (func(), error) {
+	return l.autoRenew(l.ctx, timeout, opts...)
+}
+
+// autoRenew implements AutoRenew, renewing the lock until ctx is done.
+func (l *Lock) autoRenew(ctx context.Context, timeout time.Duration, opts ...Option) (func(), error) {
+	if timeout <= 0 {
+		return nil, fmt.Errorf("%w: renewal timeout must be positive, got %s", ErrInvalidTimeout, timeout)
+	}
+	o := newOptions(opts)
+	return autoRenew(ctx, timeout, func(ctx context.Context) (bool, error) {
+		refreshed, err := l.renew(ctx, timeout)
+		if err == nil && !refreshed {
+			err = fmt.Errorf("%w: %q", ErrLockNotHeld, l.key)
+		}
+		return refreshed, err
+	}, o.OnLostLock)
+}
+
+// Unlock releases the lock, but only if it is still owned by this handle, so a lock that expired
+// and was acquired by someone else is left untouched. Calling Unlock on a nil lock does nothing, and
+// so does calling it again after it succeeded.
+// For a lock acquired with WithReentrant, Unlock releases the hold of this handle only.
+func (l *Lock) Unlock() error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.unlocked {
+		return nil
+	}
+	var err error
+	if l.funcs != nil {
+		err = l.funcs.unlock()
+	} else {
+		ctx, cancel := withOpTimeout(l.ctx, l.opTimeout, l.opDefault)
+		defer cancel()
+		_, _, err = release(ctx, l.client, l.keys, l.postfix, l.owner, l.mode)
+	}
+	if err != nil {
+		return err
+	}
+	l.unlocked = true
+	if l.onHoldTime != nil {
+		l.onHoldTime(l.clock().Sub(l.acquiredAt))
+	}
+	if l.onUnlock != nil {
+		l.onUnlock()
+	}
+	return nil
+}
+
+// lockContextKey is the context key of the lock stored by ContextWithLock.
+type lockContextKey struct{}
+
+// ContextWithLock returns a copy of ctx carrying the lock, for middleware acquiring a lock in one layer and
+// releasing it in another, e.g. with a deferred Unlock of the lock LockFromContext returns.
+func ContextWithLock(ctx context.Context, lock *Lock) context.Context {
+	return context.WithValue(ctx, lockContextKey{}, lock)
+}
+
+// LockFromContext returns the lock carried by ctx, stored by ContextWithLock, or (nil, false) when there is
+// none. Unlock is safe to call on the nil lock, so a deferred release needs no check:
+//
+//	lock, _ := tasklocker.LockFromContext(r.Context())
+//	defer lock.Unlock()
+func LockFromContext(ctx context.Context) (*Lock, bool) {
+	lock, ok := ctx.Value(lockContextKey{}).(*Lock)
+	return lock, ok && lock != nil
+}
@@ -0,0 +1,409 @@
+package tasklocker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Locker holds the client, prefix and options shared by every lock of a task type, so they don't
+// have to be passed on every call. The package-level functions remain available for ad-hoc use.
+// A Locker is safe for concurrent use.
+// The locks acquired through a Locker are tracked in-process until they are released, so Drain can
+// wait for them on shutdown and ReleaseAll can release them in bulk. The background work started through
+// a Locker (AutoRenew, WatchExpired and WaitForSlot) is tracked too, so Close can stop it.
+type Locker struct {
+	client redis.UniversalClient
+	prefix string
+	opts   []Option
+	ctx    context.Context    // bounds the background work of the Locker, canceled by Close
+	cancel context.CancelFunc // cancels ctx
+
+	mu      sync.Mutex
+	closed  bool               // set by Drain, Acquire returns ErrLockerClosed
+	pending int                // acquisitions in flight
+	held    map[*Lock]struct{} // locks acquired and not released yet
+	idle    chan struct{}      // closed when the last held lock is released while draining
+	shut    bool               // set by Close, no background work starts anymore
+	stops   map[int]func()     // the stop functions of the background work running, by id
+	nextID  int                // the id of the next background work
+	running sync.WaitGroup     // the background work running, including the blocking WaitForSlot calls
+	lastErr error              // the last error of the operations, see LastError
+	lastAt  time.Time          // when lastErr occurred
+}
+
+// Acquirer acquires the locks of a task type, like Locker.Acquire. Depend on it (or AcquireReleaser) instead
+// of *Locker to swap in an in-memory fake in tests, such as tasklockertest.FakeLocker.
+type Acquirer interface {
+	Acquire(ctx context.Context, postfix string, opts ...Option) (*Lock, bool, bool, error)
+}
+
+// Releaser releases the locks of a task type by postfix, like Locker.Release.
+type Releaser interface {
+	Release(ctx context.Context, postfix string, opts ...Option) (bool, error)
+}
+
+// AcquireReleaser groups Acquirer and Releaser, both implemented by Locker and tasklockertest.FakeLocker.
+type AcquireReleaser interface {
+	Acquirer
+	Releaser
+}
+
+var _ AcquireReleaser = (*Locker)(nil)
+
+// New returns a Locker for the prefix, allowing allowedConcurrentTasks concurrent tasks whose
+// locks expire after timeout. The options (e.g. WithLogger, WithMetrics or WithSeparator) apply to
+// every call of the Locker.
+// Parameters:
+// - client: The Redis client instance.
+// - prefix: The prefix for the task keys.
+// - allowedConcurrentTasks: The maximum number of concurrent tasks allowed.
+// - timeout: The duration after which the locks should be automatically released.
+// - opts: The options applied to every call.
+func New(client redis.UniversalClient, prefix string, allowedConcurrentTasks int, timeout time.Duration, opts ...Option) *Locker {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Locker{
+		client: client,
+		prefix: prefix,
+		opts:   append([]Option{WithLimit(allowedConcurrentTasks), WithTimeout(timeout)}, opts...),
+		ctx:    ctx,
+		cancel: cancel,
+		held:   make(map[*Lock]struct{}),
+		stops:  make(map[int]func()),
+	}
+}
+
+// NewLocker returns a Locker like New, but validates its configuration first, so a mistake fails at startup
+// instead of on every Acquire. It checks the prefix, limit, weight and timeout like Acquire, the values of
+// the options (e.g. negative durations or reservations leaving no slot), and the combinations no acquisition
+// could use: fencing tokens with WithReentrant, WithExtendOwned or WithOwner, and WithWarnThreshold without
+// a callback. Every problem found is returned, joined, each wrapping its sentinel error (e.g. ErrInvalidLimit
+// or ErrInvalidOption). The per-call options of Acquire are still validated on every call.
+// Parameters:
+// - client: The Redis client instance.
+// - prefix: The prefix for the task keys.
+// - allowedConcurrentTasks: The maximum number of concurrent tasks allowed.
+// - timeout: The duration after which the locks should be automatically released.
+// - opts: The options applied to every call.
+func NewLocker(client redis.UniversalClient, prefix string, allowedConcurrentTasks int, timeout time.Duration, opts ...Option) (*Locker, error) {
+	l := New(client, prefix, allowedConcurrentTasks, timeout, opts...)
+	if err := newPrefixOptions(prefix, l.opts).validateConfig(prefix); err != nil {
+		return nil, fmt.Errorf("invalid locker configuration for prefix %q: %w", prefix, err)
+	}
+	return l, nil
+}
+
+// Validate checks the configuration of the Locker like NewLocker, and the keys it builds from sample postfixes,
+// for the mistakes that only show at runtime with custom separators, namespaces or key functions: an empty
+// task key, postfixes or prefixes sharing a key, task keys colliding with the internal keys, and a SCAN
+// pattern that does not match the task keys, starts with a glob character or matches the keys of other
+// prefixes. Every problem found is returned, joined, e.g. for a test of the configuration:
+//
+//	if err := tasklocker.New(client, prefix, limit, timeout, opts...).Validate(); err != nil {
+//		t.Fatal(err)
+//	}
+func (l *Locker) Validate() error {
+	o := newPrefixOptions(l.prefix, l.opts)
+	if err := errors.Join(o.validateConfig(l.prefix), o.validateKeys(l.prefix)); err != nil {
+		return fmt.Errorf("invalid locker configuration for prefix %q: %w", l.prefix, err)
+	}
+	return nil
+}
+
+// Acquire tries to acquire the lock of the postfix like the package-level Acquire, with the Locker's
+// options followed by opts. The acquired lock is tracked until it is released with its Unlock or
+// with Release. Once Drain was called, it returns ErrLockerClosed without touching Redis.
+func (l *Locker) Acquire(ctx context.Context, postfix string, opts ...Option) (*Lock, bool, bool, error) {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil, false, false, ErrLockerClosed
+	}
+	l.pending++
+	l.mu.Unlock()
+
+	lock, acquired, exists, err := Acquire(ctx, l.client, l.prefix, postfix, l.with(opts)...)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pending--
+	l.recordLocked(err)
+	if lock != nil {
+		lock.onUnlock = func() { l.untrack(lock) }
+		l.held[lock] = struct{}{}
+	}
+	l.signalIdle()
+	return lock, acquired, exists, err
+}
+
+// Release releases the lock of the postfix like the package-level Release, with the Locker's
+// options followed by opts. On success, one tracked lock of the postfix stops being tracked.
+func (l *Locker) Release(ctx context.Context, postfix string, opts ...Option) (bool, error) {
+	released, err := Release(ctx, l.client, l.prefix, postfix, l.with(opts)...)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.recordLocked(err)
+	if err != nil {
+		return false, err
+	}
+
+	for lock := range l.held {
+		if lock.postfix == postfix {
+			delete(l.held, lock)
+			break
+		}
+	}
+	l.signalIdle()
+	return released, nil
+}
+
+// Drain prepares the Locker for a graceful shutdown: it marks the Locker closed, so further Acquire
+// calls return ErrLockerClosed, and blocks until every lock acquired through the Locker (including
+// acquisitions in flight) was released, or ctx is done, in which case ctx.Err() is returned.
+// Only releases through the Locker or the returned locks are seen: a lock left to expire with its
+// TTL keeps Drain waiting until ctx is done. Calling Drain more than once is safe.
+func (l *Locker) Drain(ctx context.Context) error {
+	l.mu.Lock()
+	l.closed = true
+	if l.pending == 0 && len(l.held) == 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	if l.idle == nil {
+		l.idle = make(chan struct{})
+	}
+	idle := l.idle
+	l.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ReleaseAll releases every lock acquired through the Locker and not released yet, in a single
+// pipelined round-trip, as a safety net for shutdown and panic-recovery paths where the holders lost
+// track of their locks. Each lock is released like its Unlock, so a lock that expired and was acquired
+// by someone else is left untouched. It returns how many locks were released; the locks whose release
+// failed stay tracked, and the errors are returned joined. TTL-based expiry still applies to the rest.
+func (l *Locker) ReleaseAll(ctx context.Context) (int, error) {
+	l.mu.Lock()
+	locks := make([]*Lock, 0, len(l.held))
+	for lock := range l.held {
+		locks = append(locks, lock)
+	}
+	l.mu.Unlock()
+	if len(locks) == 0 {
+		return 0, nil
+	}
+
+	// Queue one release script per lock and send them together, the locks taken in-process
+	// while Redis was unavailable (see WithLocalFallback) or stored in a backend are released without it
+	o := newPrefixOptions(l.prefix, l.opts)
+	var pipe redis.Pipeliner
+	cmds := make([]*redis.Cmd, len(locks))
+	for i, lock := range locks {
+		if !lock.local && lock.funcs == nil {
+			if pipe == nil {
+				pipe = o.clientFor(l.prefix, l.client).Pipeline()
+			}
+			cmds[i] = releaseCmd(ctx, pipe, lock.keys, lock.postfix, lock.owner, lock.mode)
+		}
+	}
+	if pipe != nil {
+		_, _ = pipe.Exec(ctx) // errors are decoded per command below
+	}
+
+	released := 0
+	var errs []error
+	for i, lock := range locks {
+		var ok bool
+		var err error
+		switch {
+		case lock.local:
+			ok = localLocks.release(lock.key, lock.owner)
+		case lock.funcs != nil:
+			// Stored in a backend, see WithBackend
+			err = lock.funcs.unlock()
+			ok = err == nil
+		default:
+			ok, _, err = decodeRelease(cmds[i], lock.key, lock.mode)
+		}
+		if err != nil {
+			o.Logger.Warn("tasklocker: release failed", "key", lock.key, "error", err)
+			errs = append(errs, err)
+			continue
+		}
+		o.Logger.Debug("tasklocker: lock released", "key", lock.key, "deleted", ok)
+		o.Metrics.IncReleased(lock.keys.prefix)
+		if ok {
+			released++
+		}
+		lock.mu.Lock()
+		lock.unlocked = true // a later Unlock of the handle must not release it again
+		lock.mu.Unlock()
+		l.untrack(lock)
+	}
+	err := errors.Join(errs...)
+	l.mu.Lock()
+	l.recordLocked(err)
+	l.mu.Unlock()
+	return released, err
+}
+
+// LastError returns when the last error the operations of the Locker returned (Acquire, Release and
+// ReleaseAll) occurred, and the error, e.g. for a status page, or the zero time and nil when the last
+// operation succeeded or none failed yet. A lock not acquired because the limit was reached or the key
+// exists is no error; the error is cleared by the next successful operation.
+func (l *Locker) LastError() (time.Time, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lastAt, l.lastErr
+}
+
+// recordLocked records the outcome of an operation for LastError: err, or its success when err is nil.
+// l.mu must be held.
+func (l *Locker) recordLocked(err error) {
+	l.lastErr, l.lastAt = err, time.Time{}
+	if err != nil {
+		l.lastAt = newPrefixOptions(l.prefix, l.opts).Clock()
+	}
+}
+
+// AutoRenew keeps the lock, acquired through the Locker, alive like its AutoRenew method, until the returned
+// stop function is called, the context of the lock is done or the Locker is closed. After Close, it returns
+// ErrLockerClosed.
+// Parameters:
+// - lock: The lock to renew.
+// - timeout: The TTL set on every renewal.
+// - opts: The options, e.g. WithOnLostLock.
+func (l *Locker) AutoRenew(lock *Lock, timeout time.Duration, opts ...Option) (func(), error) {
+	return l.start(lock.ctx, func(ctx context.Context) (func(), error) {
+		return lock.autoRenew(ctx, timeout, opts...)
+	})
+}
+
+// WatchExpired calls fn with the postfix of every task key of the Locker's prefix that expires, like the
+// package-level WatchExpired with the Locker's options followed by opts, until the returned stop function
+// is called, ctx is done or the Locker is closed. After Close, it returns ErrLockerClosed.
+func (l *Locker) WatchExpired(ctx context.Context, fn func(postfix string), opts ...Option) (func(), error) {
+	return l.start(ctx, func(ctx context.Context) (func(), error) {
+		return WatchExpired(ctx, l.client, l.prefix, fn, l.with(opts)...)
+	})
+}
+
+// WaitForSlot blocks until a slot of the Locker's prefix may have freed up, like the package-level
+// WaitForSlot with the Locker's options followed by opts. Close cancels the wait, which then returns
+// context.Canceled. After Close, it returns ErrLockerClosed.
+func (l *Locker) WaitForSlot(ctx context.Context, opts ...Option) error {
+	l.mu.Lock()
+	if l.shut {
+		l.mu.Unlock()
+		return ErrLockerClosed
+	}
+	l.running.Add(1)
+	l.mu.Unlock()
+	defer l.running.Done()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer context.AfterFunc(l.ctx, cancel)()
+	return WaitForSlot(ctx, l.client, l.prefix, l.with(opts)...)
+}
+
+// Close stops the background work started through the Locker: it cancels the renewals, the expiry watches
+// and the WaitForSlot calls, which unsubscribes their pub/sub connections, and waits for their goroutines to
+// exit. Further Acquire, AutoRenew, WatchExpired and WaitForSlot calls return ErrLockerClosed; acquisitions
+// in flight complete. The held locks are not released: call Drain or ReleaseAll first for that. Close is
+// safe to call more than once and concurrently with the other methods. It returns nil, and exists to satisfy
+// io.Closer.
+func (l *Locker) Close() error {
+	l.mu.Lock()
+	l.closed, l.shut = true, true
+	stops := make([]func(), 0, len(l.stops))
+	for _, stop := range l.stops {
+		stops = append(stops, stop)
+	}
+	l.mu.Unlock()
+
+	l.cancel()
+	for _, stop := range stops {
+		stop()
+	}
+	l.running.Wait()
+	return nil
+}
+
+// start starts background work with begin, passing it ctx also canceled by Close, and tracks it until the
+// stop function begin returns is called, by the caller or by Close. It returns ErrLockerClosed after Close.
+func (l *Locker) start(ctx context.Context, begin func(ctx context.Context) (func(), error)) (func(), error) {
+	l.mu.Lock()
+	if l.shut {
+		l.mu.Unlock()
+		return nil, ErrLockerClosed
+	}
+	l.running.Add(1)
+	l.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(ctx)
+	unbind := context.AfterFunc(l.ctx, cancel)
+	stopWork, err := begin(ctx)
+	if err != nil {
+		unbind()
+		cancel()
+		l.running.Done()
+		return nil, err
+	}
+
+	l.mu.Lock()
+	id := l.nextID
+	l.nextID++
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			stopWork()
+			unbind()
+			cancel()
+			l.mu.Lock()
+			delete(l.stops, id)
+			l.mu.Unlock()
+			l.running.Done()
+		})
+	}
+	if l.shut {
+		// Closed while begin ran, after Close collected the stop functions
+		l.mu.Unlock()
+		stop()
+		return nil, ErrLockerClosed
+	}
+	l.stops[id] = stop
+	l.mu.Unlock()
+	return stop, nil
+}
+
+// untrack stops tracking the lock once it was unlocked.
+func (l *Locker) untrack(lock *Lock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.held, lock)
+	l.signalIdle()
+}
+
+// signalIdle wakes up the Drain callers once no lock is held or being acquired. l.mu must be held.
+func (l *Locker) signalIdle() {
+	if l.idle != nil && l.pending == 0 && len(l.held) == 0 {
+		close(l.idle)
+		l.idle = nil
+	}
+}
+
+// with returns the Locker's options followed by opts, without modifying the Locker's slice.
+func (l *Locker) with(opts []Option) []Option {
+	return append(l.opts[:len(l.opts):len(l.opts)], opts...)
+}
@@ -0,0 +1,33 @@
+package tasklocker_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/youssefsiam38/tasklocker"
+)
+
+func TestLockerLastError(t *testing.T) {
+	_, client := newRedis(t)
+	ctx := context.Background()
+	locker := tasklocker.New(client, "jobs", 2, time.Minute)
+	defer locker.Close()
+
+	if at, err := locker.LastError(); err != nil || !at.IsZero() {
+		t.Fatalf("LastError before any operation = %s, %v, want none", at, err)
+	}
+	if _, _, _, err := locker.Acquire(ctx, "1", tasklocker.WithWeight(3)); !errors.Is(err, tasklocker.ErrInvalidWeight) {
+		t.Fatalf("Acquire(weight 3) = %v, want ErrInvalidWeight", err)
+	}
+	if at, err := locker.LastError(); !errors.Is(err, tasklocker.ErrInvalidWeight) || at.IsZero() {
+		t.Fatalf("LastError = %s, %v, want ErrInvalidWeight", at, err)
+	}
+	if _, acquired, _, err := locker.Acquire(ctx, "1"); err != nil || !acquired {
+		t.Fatalf("Acquire(1) = %v, %v, want acquired", acquired, err)
+	}
+	if at, err := locker.LastError(); err != nil || !at.IsZero() {
+		t.Fatalf("LastError after a success = %s, %v, want cleared", at, err)
+	}
+}
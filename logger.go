@@ -0,0 +1,15 @@
+package tasklocker
+
+// Logger receives the structured log lines emitted by the package, as a message followed by
+// alternating key/value pairs (e.g. "key", "jobs:1", "active", 3). *slog.Logger satisfies it.
+// Acquisitions, key-exists, limit-reached and releases are logged at debug level, errors at warn level.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Warn(msg string, args ...any)
+}
+
+// nopLogger is the default Logger, it discards everything.
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...any) {}
+func (nopLogger) Warn(string, ...any)  {}
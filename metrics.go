@@ -0,0 +1,27 @@
+package tasklocker
+
+// Metrics receives per-prefix counters from Acquire and Release, so callers can back them with their own
+// collectors (e.g. Prometheus counter and gauge vectors labeled by prefix) without this package depending on them.
+// The prefix is the key prefix as stored in Redis, including the hash tag when WithHashTag is used.
+// The hooks are called synchronously and should not block.
+type Metrics interface {
+	// IncAcquired is called when a lock is acquired.
+	IncAcquired(prefix string)
+	// IncRejected is called when a lock is not acquired because the limit is reached.
+	IncRejected(prefix string)
+	// IncDuplicate is called when a lock is not acquired because the task key already exists.
+	IncDuplicate(prefix string)
+	// IncReleased is called for every successful release call, whether or not a key was deleted.
+	IncReleased(prefix string)
+	// ObserveActive is called on every acquire attempt with the number of active tasks of the prefix.
+	ObserveActive(prefix string, active int)
+}
+
+// nopMetrics is the default Metrics, it discards everything.
+type nopMetrics struct{}
+
+func (nopMetrics) IncAcquired(string)        {}
+func (nopMetrics) IncRejected(string)        {}
+func (nopMetrics) IncDuplicate(string)       {}
+func (nopMetrics) IncReleased(string)        {}
+func (nopMetrics) ObserveActive(string, int) {}
@@ -0,0 +1,161 @@
+package tasklocker
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// LockSpec describes one of the locks AcquireAll acquires together.
+type LockSpec struct {
+	// Prefix is the prefix for the task key.
+	Prefix string
+	// Postfix is the unique identifier for the task (e.g., task id).
+	Postfix string
+	// Timeout is the duration after which the lock is automatically released, or NoExpiry.
+	// 0 uses the timeout of the options (DefaultTimeout by default), or the one WithTimeoutFunc computes.
+	Timeout time.Duration
+	// Limit is the maximum number of concurrent tasks allowed for the prefix, checked like AcquireLock.
+	// 0 (or Unlimited) only checks that the task key does not exist.
+	Limit int
+}
+
+// MultiLock is a handle to the locks acquired together by AcquireAll.
+type MultiLock struct {
+	ctx    context.Context
+	client redis.UniversalClient
+	locks  []*Lock
+	o      *Options
+}
+
+// Locks returns the handles of the locks, in the order of their specs, e.g. to refresh one of them.
+// Releasing one of them with its Unlock leaves the others held.
+func (m *MultiLock) Locks() []*Lock {
+	return m.locks
+}
+
+// Unlock releases every lock in a single atomic script, dropping all of them at once, symmetrically to
+// AcquireAll: the keys still held by the owner are deleted and their slots freed, and the keys that expired
+// and were acquired by someone else are left untouched. Calling Unlock on a nil MultiLock does nothing.
+func (m *MultiLock) Unlock() error {
+	if m == nil {
+		return nil
+	}
+	scriptKeys := make([]string, 0, 2*len(m.locks))
+	args := []any{m.locks[0].owner}
+	for _, lock := range m.locks {
+		scriptKeys = append(scriptKeys, lock.key, lock.keys.active())
+		args = append(args, lock.keys.member(lock.postfix))
+	}
+	ctx, cancel := withOpTimeout(m.ctx, m.o.OpTimeout, m.o.DefaultOpTimeout)
+	defer cancel()
+	var deleted int
+	err := m.o.retryTransient(ctx, func(ctx context.Context) error {
+		var err error
+		deleted, err = runScript(ctx, m.client, releaseAllScript, scriptKeys, args...).Int()
+		return err
+	})
+	if err != nil {
+		return wrapRedisError("run release all script", err)
+	}
+	m.o.Logger.Debug("tasklocker: locks released", "locks", len(m.locks), "deleted", deleted)
+	return nil
+}
+
+// AcquireAll acquires several locks, of any prefixes, all or none, in a single atomic script, for tasks that
+// must hold several resources at once without the deadlocks of acquiring them one by one. The keys are set
+// in the order of the specs, and when one of them exists or its limit is reached, the ones set before it are
+// removed again. It returns the handle of the locks, all owned by the same owner id (WithOwner, or a random
+// UUID), or nil and the key that blocked the acquisition when they were not acquired.
+// The options apply to every spec, after the options registered for its prefix; the key options (e.g.
+// WithSeparator or WithNamespace), WithOwner and the operation timeouts are used, and the client of the
+// first prefix runs the script. On Redis Cluster, every key must hash to the same slot (see HashTag).
+// Parameters:
+// - ctx: The context for the Redis operations, also used by Unlock.
+// - client: The Redis client instance.
+// - locks: The locks to acquire.
+// - opts: Further options, e.g. WithOwner or WithHashTag.
+func AcquireAll(ctx context.Context, client redis.UniversalClient, locks []LockSpec, opts ...Option) (*MultiLock, string, error) {
+	if len(locks) == 0 {
+		return nil, "", fmt.Errorf("%w: no locks to acquire", ErrInvalidOption)
+	}
+	o := newPrefixOptions(locks[0].Prefix, opts)
+	client = o.clientFor(locks[0].Prefix, client)
+	if o.Owner == "" {
+		owner, err := o.newOwner()
+		if err != nil {
+			return nil, "", err
+		}
+		o.Owner = owner
+	}
+
+	handles := make([]*Lock, 0, len(locks))
+	scriptKeys := make([]string, 0, 2*len(locks))
+	args := []any{o.Owner}
+	seen := make(map[string]struct{}, len(locks))
+	for _, spec := range locks {
+		so := newPrefixOptions(spec.Prefix, opts)
+		so.Limit = spec.Limit
+		if spec.Limit == 0 {
+			so.Limit = Unlimited
+		}
+		if spec.Timeout != 0 {
+			so.Timeout, so.TimeoutFunc = spec.Timeout, nil
+		}
+		if err := so.validate(spec.Prefix, spec.Postfix); err != nil {
+			return nil, "", err
+		}
+		keys := so.keyspace(spec.Prefix)
+		key := keys.task(spec.Postfix)
+		if _, ok := seen[key]; ok {
+			return nil, "", fmt.Errorf("%w: lock %q is given twice", ErrInvalidOption, key)
+		}
+		seen[key] = struct{}{}
+
+		var ttl int64 // 0 for NoExpiry
+		if so.Timeout != NoExpiry {
+			ttl = formatMs(so.Timeout)
+		}
+		scriptKeys = append(scriptKeys, key, keys.active())
+		args = append(args, keys.member(spec.Postfix), so.limit(), ttl)
+		handles = append(handles, &Lock{ctx: ctx, client: client, keys: keys, postfix: spec.Postfix, key: key, owner: o.Owner, attempts: 1, clock: o.Clock, opTimeout: o.OpTimeout, opDefault: o.DefaultOpTimeout})
+	}
+
+	opCtx, cancel := o.opContext(ctx)
+	defer cancel()
+	var reply []int64
+	err := o.retryTransient(opCtx, func(ctx context.Context) error {
+		var err error
+		reply, err = runScript(ctx, client, acquireAllScript, scriptKeys, args...).Int64Slice()
+		return err
+	})
+	if err != nil {
+		err = wrapRedisError("run acquire all script", err)
+		o.Logger.Warn("tasklocker: acquire all failed", "locks", len(locks), "error", err)
+		return nil, "", err
+	}
+
+	switch status, index := reply[0], int(reply[1]); status {
+	case statusAcquired:
+		now := o.Clock()
+		for _, lock := range handles {
+			lock.acquiredAt = now
+			o.Metrics.IncAcquired(lock.keys.prefix)
+		}
+		o.Logger.Debug("tasklocker: locks acquired", "locks", len(locks), "owner", o.Owner)
+		return &MultiLock{ctx: ctx, client: client, locks: handles, o: o}, "", nil
+	case statusExists, statusLimitReached:
+		blocked := handles[index-1]
+		if status == statusExists {
+			o.Metrics.IncDuplicate(blocked.keys.prefix)
+		} else {
+			o.Metrics.IncRejected(blocked.keys.prefix)
+		}
+		o.Logger.Debug("tasklocker: locks not acquired", "locks", len(locks), "blocked_by", blocked.key, "limit_reached", status == statusLimitReached)
+		return nil, blocked.key, nil
+	default:
+		return nil, "", fmt.Errorf("%w: acquire all script status %d", ErrUnexpectedReply, status)
+	}
+}
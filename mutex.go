@@ -0,0 +1,128 @@
+package tasklocker
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// AcquireMutex acquires a plain distributed mutex on key: a single SET NX PX of the owner id, without the
+// concurrency limit, the active set or a SCAN, for mutual exclusion on one key where the count machinery of
+// the prefixes is irrelevant. The key is used as given, after the WithNamespace namespace; it is not a task key
+// of a prefix, so use keys that the prefixes of the package don't build. The owner id is the WithOwner one, or
+// a random UUID. The lock returned is released by its Unlock only while it still holds the owner id, and its
+// Refresh and AutoRenew reset the TTL the same way.
+// It returns the lock (nil when the key is held), a boolean indicating whether the mutex is acquired, and an
+// error if something goes wrong.
+// Parameters:
+// - ctx: The context for the Redis operations, also used by Unlock.
+// - client: The Redis client instance.
+// - key: The key of the mutex.
+// - timeout: The duration after which the mutex is automatically released, or NoExpiry.
+// - opts: Further options, e.g. WithOwner, WithNamespace or WithOpTimeout.
+func AcquireMutex(ctx context.Context, client redis.UniversalClient, key string, timeout time.Duration, opts ...Option) (*Lock, bool, error) {
+	o := newOptions(opts)
+	if key == "" {
+		return nil, false, fmt.Errorf("%w: mutex key must not be empty", ErrInvalidOption)
+	}
+	if timeout <= 0 && timeout != NoExpiry {
+		return nil, false, fmt.Errorf("%w: mutex timeout must be positive or NoExpiry, got %s", ErrInvalidTimeout, timeout)
+	}
+	if o.Owner == "" {
+		owner, err := o.newOwner()
+		if err != nil {
+			return nil, false, err
+		}
+		o.Owner = owner
+	}
+	key = o.Namespace + key
+	expiration := timeout
+	if timeout == NoExpiry {
+		expiration = 0
+	}
+
+	opCtx, cancel := o.opContext(ctx)
+	defer cancel()
+	var acquired bool
+	err := o.retryTransient(opCtx, func(ctx context.Context) error {
+		var err error
+		acquired, err = client.SetNX(ctx, key, o.Owner, expiration).Result()
+		return err
+	})
+	if err != nil {
+		err = wrapRedisError("acquire mutex", err)
+		o.Logger.Warn("tasklocker: mutex acquire failed", "key", key, "error", err)
+		return nil, false, err
+	}
+	o.Logger.Debug("tasklocker: mutex acquire", "key", key, "acquired", acquired)
+	if !acquired {
+		return nil, false, nil
+	}
+
+	lock := &Lock{ctx: ctx, client: client, key: key, owner: o.Owner, attempts: 1, acquiredAt: o.Clock(), clock: o.Clock, onHoldTime: o.OnHoldTime, opTimeout: o.OpTimeout, opDefault: o.DefaultOpTimeout}
+	lock.funcs = &lockFuncs{
+		unlock: func() error {
+			ctx, cancel := withOpTimeout(ctx, o.OpTimeout, o.DefaultOpTimeout)
+			defer cancel()
+			_, err := releaseMutex(ctx, client, key, o.Owner, o)
+			return err
+		},
+		refresh: func(timeout time.Duration) (bool, error) {
+			if timeout <= 0 {
+				// PEXPIRE with a non-positive TTL would delete the key instead of extending it
+				return false, fmt.Errorf("%w: refresh timeout must be positive, got %s", ErrInvalidTimeout, timeout)
+			}
+			ctx, cancel := withOpTimeout(ctx, o.OpTimeout, o.DefaultOpTimeout)
+			defer cancel()
+			var refreshed int
+			err := o.retryTransient(ctx, func(ctx context.Context) error {
+				var err error
+				refreshed, err = runScript(ctx, client, mutexRefreshScript, []string{key}, o.Owner, formatMs(timeout)).Int()
+				return err
+			})
+			if err != nil {
+				return false, wrapRedisError("run mutex refresh script", err)
+			}
+			return refreshed == 1, nil
+		},
+	}
+	return lock, true, nil
+}
+
+// ReleaseMutex releases a mutex acquired by AcquireMutex without its handle, but only while the key still holds
+// owner, so a mutex that expired and was acquired by someone else is left alone.
+// It returns true when the mutex was released, and false when the key was missing or held by another owner.
+// Parameters:
+// - ctx: The context for the Redis operations.
+// - client: The Redis client instance.
+// - key: The key of the mutex, as passed to AcquireMutex.
+// - owner: The owner id of the mutex, see Lock.Owner.
+// - opts: Further options, e.g. WithNamespace or WithOpTimeout.
+func ReleaseMutex(ctx context.Context, client redis.UniversalClient, key, owner string, opts ...Option) (bool, error) {
+	o := newOptions(opts)
+	if key == "" || owner == "" {
+		return false, fmt.Errorf("%w: mutex key and owner must not be empty", ErrInvalidOption)
+	}
+	opCtx, cancel := o.opContext(ctx)
+	defer cancel()
+	return releaseMutex(opCtx, client, o.Namespace+key, owner, o)
+}
+
+// releaseMutex deletes the key of a mutex while it holds owner.
+func releaseMutex(ctx context.Context, client redis.UniversalClient, key, owner string, o *Options) (bool, error) {
+	var deleted int
+	err := o.retryTransient(ctx, func(ctx context.Context) error {
+		var err error
+		deleted, err = runScript(ctx, client, redlockReleaseScript, []string{key}, owner).Int()
+		return err
+	})
+	if err != nil {
+		err = wrapRedisError("run mutex release script", err)
+		o.Logger.Warn("tasklocker: mutex release failed", "key", key, "error", err)
+		return false, err
+	}
+	o.Logger.Debug("tasklocker: mutex released", "key", key, "released", deleted == 1)
+	return deleted == 1, nil
+}
@@ -0,0 +1,1111 @@
+package tasklocker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Defaults used by Acquire when the corresponding options are not given.
+const (
+	DefaultLimit   = 1
+	DefaultTimeout = time.Minute
+)
+
+// NoExpiry, passed as the timeout of an acquisition, makes the lock never expire: its task key is set
+// without a TTL and it keeps its slot until it is released. A holder dying without releasing leaves
+// the lock held forever, until an operator releases it (see ClearPrefix and Locker.ReleaseAll).
+const NoExpiry time.Duration = -1
+
+// Unlimited, passed as the allowed concurrent tasks of an acquisition, removes the concurrency limit: the
+// acquisition only checks that the task key does not exist, like SET NX, for callers that only need the
+// per-key dedup. The active tasks are not counted (AcquireLockScan skips its SCAN), but they are still
+// tracked, so CountActive and GetStats keep reporting them.
+const Unlimited = -1
+
+// Options configures Acquire and Release. Set them with the WithX functions.
+type Options struct {
+	// Limit is the maximum number of concurrent tasks allowed for the prefix. Defaults to DefaultLimit.
+	Limit int
+	// Timeout is the duration after which the lock is automatically released (its TTL). It does not bound
+	// the Redis operations, see OpTimeout. Defaults to DefaultTimeout.
+	Timeout time.Duration
+	// Deadline, when set, makes the lock expire at that time (with PEXPIREAT) instead of after Timeout.
+	Deadline time.Time
+	// MinTimeout, when positive, makes the acquire functions reject a Timeout below it with ErrTimeoutTooShort,
+	// see WithMinTimeout and SetMinTimeout.
+	MinTimeout time.Duration
+	// TimeBucket, when positive, adds the current time bucket of that granularity to the prefix, so the limit
+	// counts the tasks of the bucket only, see WithTimeBucket.
+	TimeBucket time.Duration
+	// TimeoutJitter randomizes the TTL set on acquire by up to ±TimeoutJitter of Timeout (e.g. 0.1 for ±10%),
+	// so locks acquired together do not all expire at the same instant. Defaults to 0 (no jitter).
+	TimeoutJitter float64
+	// Burst is the number of units the acquisitions may take above Limit within BurstWindow, see WithBurst.
+	Burst int
+	// BurstWindow is the time after which a burst unit spent is available again.
+	BurstWindow time.Duration
+	// Weight is the number of slots of Limit the acquisition takes, for heavy tasks. Defaults to 1.
+	Weight int
+	// Pending, when positive, makes Acquire set the task key pending for that grace period: it prevents
+	// duplicates but does not count towards Limit until Promote makes it active. A pending lock that is
+	// neither promoted nor released expires once the grace period passes.
+	Pending time.Duration
+	// Tenant is the tenant the acquisition counts towards, none by default.
+	Tenant string
+	// TenantLimit is the maximum number of slots of Limit the Tenant may hold.
+	TenantLimit int
+	// Priority is the priority level of the acquisition, 0 (the lowest) by default.
+	Priority int
+	// Reserved maps a priority level to the number of slots reserved for acquisitions of at least that level.
+	// An acquisition can use Limit minus the slots reserved for levels above its own.
+	Reserved map[int]int
+	// Owner is the owner id stored in the task key. Acquire generates a random UUID when it is empty,
+	// and Release only deletes the key when it holds Owner, or unconditionally when it is empty.
+	Owner string
+	// TimeoutFunc, when set, computes Timeout from the postfix of every acquisition (see WithTimeoutFunc).
+	TimeoutFunc func(postfix string) time.Duration
+	// OwnerFunc generates the owner id when Owner is empty, instead of a random UUID (see WithOwnerFunc).
+	OwnerFunc func() string
+	// FencingToken makes Acquire store a fencing token generated from prefix:__seq instead of the owner id.
+	FencingToken bool
+	// Metadata is stored alongside the owner id in the task key, for GetLockInfo to return (e.g. hostname, pid).
+	Metadata map[string]string
+	// Data is the JSON document stored in the task key, for GetMetadata to decode, set by WithJSONMetadata.
+	Data []byte
+	// VersionKey, when not empty, makes the acquire script only acquire while that key holds Version,
+	// see WithVersion.
+	VersionKey string
+	Version    string
+	// Reentrant makes Acquire re-acquire a task key already holding Owner, incrementing its hold count,
+	// and Release release a single hold, deleting the key once every hold was released.
+	Reentrant bool
+	// ExtendOwned makes Acquire treat an existing task key holding Owner as acquired, raising its TTL
+	// to at least Timeout (never shortening it) instead of reporting that the key exists.
+	// Reentrant takes precedence when both are set.
+	ExtendOwned bool
+	// RefreshExisting makes Acquire treat any existing task key as acquired, whatever its owner, resetting
+	// its TTL to Timeout, so re-running a task keeps its slot instead of reporting that the key exists.
+	// Reentrant and ExtendOwned take precedence when set.
+	RefreshExisting bool
+	// Fair makes Acquire grant slots in arrival order: callers are queued while the limit is reached,
+	// and a caller only acquires once the callers queued before it did. Use it together with Retry.
+	Fair bool
+	// Notify makes Release publish on the prefix's channel when a slot frees up, waking up WaitForSlot.
+	Notify bool
+	// Unlink makes Release delete the task key with UNLINK, freeing its memory asynchronously,
+	// and ClearPrefix delete keys with UNLINK. DEL is used when the server does not support UNLINK.
+	Unlink bool
+	// Retry makes Acquire wait with this backoff while the limit is reached, instead of returning right away.
+	Retry *Backoff
+	// StrictRelease makes the release functions return an error when nothing was released, instead of false.
+	StrictRelease bool
+	// DedupWindow, when positive, keeps a marker for that long after a lock is released, and makes the
+	// acquire functions report a task whose marker exists as a recent duplicate. Defaults to 0 (disabled).
+	DedupWindow time.Duration
+	// FailOpen makes AcquireLockScan acquire, ignoring the limit, when counting the active tasks fails,
+	// instead of returning the error. The task key is still only set when it does not exist.
+	FailOpen bool
+	// FastRejectWhenFull makes the acquire functions count the active units with a cheap ZCOUNT first, and
+	// report the limit reached without running the acquire script when they leave no room, see WithFastReject.
+	FastRejectWhenFull bool
+	// LocalFallback makes Acquire take a process-local lock when Redis is unavailable, instead of failing.
+	LocalFallback bool
+	// AuditStream, when not empty, is the Redis Stream an entry is appended to on every acquire and release,
+	// see WithAuditStream. AuditFatal makes a failure to append it fail the operation.
+	AuditStream string
+	AuditFatal  bool
+	// DefaultOpTimeout, when positive, bounds every Redis operation whose ctx has no deadline, so a hanging
+	// Redis can't block a caller passing context.Background forever. A deadline set on ctx is respected.
+	DefaultOpTimeout time.Duration
+	// OpTimeout, when positive, bounds every Redis round-trip, even when ctx has a deadline, e.g. a ctx
+	// bounding a whole wait for a slot. The earlier of the two deadlines applies. It is unrelated to Timeout,
+	// the TTL of the lock.
+	OpTimeout time.Duration
+	// RedisRetries is the number of times a Redis operation failing with a transient error is retried,
+	// waiting RedisBackoff before every retry. Defaults to 0 (no retries).
+	RedisRetries int
+	// RedisBackoff is the delay between retries of transient Redis errors.
+	RedisBackoff Backoff
+	// ClientFunc, when set, resolves the client of every operation from its prefix, e.g. to use the Redis ACL
+	// user of the task family. The client passed to the function is used when it is nil or returns nil.
+	ClientFunc func(prefix string) redis.UniversalClient
+	// CountScope is the group whose active tasks count towards Limit, so several prefixes can share a pool
+	// of slots, while uniqueness stays per prefix and postfix. Defaults to "" (the prefix).
+	CountScope string
+	// CountPatterns, when set, replaces the SCAN pattern of the prefix in the SCAN counts of AcquireLockScan
+	// and CountActive, see WithCountPatterns.
+	CountPatterns []string
+	// Namespace is prepended to every key and channel of the package (e.g. "app1:tasklocker:"),
+	// so applications sharing a Redis do not collide. Defaults to "" (no namespace).
+	Namespace string
+	// HashTag wraps the prefix in a Redis Cluster hash tag (see HashTag).
+	HashTag bool
+	// Separator separates the prefix from the postfix in task keys. Defaults to DefaultSeparator.
+	Separator string
+	// KeyFunc, when set, builds the key of a postfix of the prefix instead of the prefix:postfix layout,
+	// for task keys and internal keys alike (e.g. to add a date shard or a region code). The namespace is
+	// still prepended.
+	KeyFunc func(prefix, postfix string) string
+	// PatternFunc, when set, builds the SCAN match pattern covering every task key KeyFunc builds for the prefix.
+	// Without it, the keys starting with KeyFunc(prefix, "") are matched.
+	PatternFunc func(prefix string) string
+	// MaxKeyLength, when positive, is the length above which the postfix of a task key is replaced with its
+	// SHA-256 hash, encoded with KeyHash, see WithMaxKeyLength. Defaults to 0 (keys are never hashed).
+	MaxKeyLength int
+	KeyHash      KeyHashEncoding
+	// MaxScanIterations, when positive, bounds the SCAN calls of CountActive, ListActive and AcquireLockScan,
+	// see WithMaxScanIterations.
+	MaxScanIterations int
+	// Candidates, when set, are the postfixes AcquireAny chooses from, with their selection weights, see
+	// WithCandidates.
+	Candidates map[string]float64
+	// Snapshot makes CountActive and ListActive reconcile their SCAN, see WithConsistentSnapshot.
+	Snapshot bool
+	// SnapshotCrossCheck caps the count of CountActive with Snapshot at the active set of the prefix.
+	SnapshotCrossCheck bool
+	// ScanCount is the COUNT hint of the SCAN and ZSCAN calls of the functions enumerating keys, such as
+	// CountActive, ListActive, ClearPrefix and Reconcile. Defaults to 100; 0 uses the Redis default (10).
+	ScanCount int64
+	// MaxLifetime, when positive, caps how long refreshes keep a lock alive since it was acquired, e.g. to
+	// bound a renewer looping forever: AutoRenew and Refresh never extend it beyond that age.
+	MaxLifetime time.Duration
+	// WriteProbe makes HealthCheck also set, read back and delete a probe key, to confirm writes work.
+	WriteProbe bool
+	// AutoRenew makes RunWithLock renew the lock while its callback runs.
+	AutoRenew bool
+	// OnLostLock is called by AutoRenew when a renewal finds that the lock was lost.
+	OnLostLock func()
+	// OnBlocked is called by Acquire with the active task count and the attempt number when an attempt
+	// finds the limit reached and Retry makes it wait: after the first attempt only, or after every attempt
+	// with OnBlockedEveryRetry.
+	OnBlocked func(active, attempt int)
+	// OnBlockedEveryRetry makes Acquire call OnBlocked after every blocked attempt instead of the first one only.
+	OnBlockedEveryRetry bool
+	// WarnThreshold is the fraction of Limit (e.g. 0.8) at which OnThreshold is called by the acquire functions.
+	WarnThreshold float64
+	// OnThreshold is called with the active task count and the limit when an acquisition brings the active
+	// count to WarnThreshold of the limit, or with OnThresholdEveryCall on every acquisition above it.
+	OnThreshold func(active, limit int)
+	// OnThresholdEveryCall makes the acquire functions call OnThreshold on every acquisition at or above the
+	// threshold instead of only on the one crossing it.
+	OnThresholdEveryCall bool
+	// OnRetry is called by a retrying Acquire before every retry, with the number of the attempt that found
+	// the limit reached and the active task count it saw, e.g. to count the retries in a metric.
+	OnRetry func(attempt, active int)
+	// OnRejected is called by Acquire with the outcome and the active task count before it returns without
+	// the lock, and decides what Acquire does instead (see WithOnRejected).
+	OnRejected func(reason AcquireResult, active int) RejectDecision
+	// OnAcquireLatency is called by Acquire with the time the acquisition took, retries included.
+	OnAcquireLatency func(time.Duration)
+	// OnAcquireExemplar is called like OnAcquireLatency, with the context of the acquire span and the outcome.
+	OnAcquireExemplar func(ctx context.Context, latency time.Duration, result AcquireResult)
+	// OnHoldTime is called by Unlock with the time the lock was held, from acquisition to release.
+	OnHoldTime func(time.Duration)
+	// OnEvicted is called by the acquire functions with the number of expired tasks an attempt evicted.
+	OnEvicted func(evicted int)
+	// Contention, when set, counts the attempts decided by the limit for a rolling contention ratio,
+	// see WithContention.
+	Contention *Contention
+	// Logger receives structured log lines for acquisitions, releases and errors. Defaults to a no-op logger.
+	Logger Logger
+	// Metrics receives counters for acquisitions, rejections, duplicates and releases. Defaults to no-op hooks.
+	Metrics Metrics
+	// Tracer starts spans around the acquire and release scripts. Defaults to a no-op tracer.
+	Tracer Tracer
+
+	// Backend stores the locks instead of Redis when set, see WithBackend.
+	Backend Backend
+
+	// Clock returns the current time wherever the package reads it locally (deadlines, retry budgets,
+	// latency and hold times). Expiry itself is decided by the Redis clock. Defaults to time.Now.
+	Clock func() time.Time
+
+	unregistered bool  // no options are registered for the prefix while RequireRegistered is on
+	dataErr      error // the encoding error of WithJSONMetadata, returned by validateAcquisition
+	resume       bool  // the acquisition resumes a paused task key, see ResumeLock
+}
+
+// Option sets a field of Options.
+type Option func(*Options)
+
+// WithLimit sets the maximum number of concurrent tasks allowed for the prefix, Unlimited for none.
+func WithLimit(allowedConcurrentTasks int) Option {
+	return func(o *Options) {
+		o.Limit = allowedConcurrentTasks
+	}
+}
+
+// WithTimeout sets the duration after which the lock is automatically released, or NoExpiry
+// for a lock released explicitly only.
+func WithTimeout(timeout time.Duration) Option {
+	return func(o *Options) {
+		o.Timeout, o.TimeoutFunc = timeout, nil
+	}
+}
+
+// WithTimeoutFunc computes the timeout of every acquisition from its postfix, e.g. to give a big batch a
+// longer TTL than a small one under the same prefix and Locker. fn must return a positive duration or
+// NoExpiry, or the acquisition fails with an error wrapping ErrInvalidTimeout. The last of WithTimeout and
+// WithTimeoutFunc wins, so the acquire functions taking a timeout parameter ignore a registered TimeoutFunc.
+func WithTimeoutFunc(fn func(postfix string) time.Duration) Option {
+	return func(o *Options) {
+		o.TimeoutFunc = fn
+	}
+}
+
+// WithDeadline makes the lock expire at deadline instead of after the timeout (see AcquireLockUntil).
+// Acquire returns an error wrapping ErrInvalidTimeout when the deadline already passed.
+func WithDeadline(deadline time.Time) Option {
+	return func(o *Options) {
+		o.Deadline = deadline
+	}
+}
+
+// WithMinTimeout makes the acquire functions reject a timeout below floor with ErrTimeoutTooShort, e.g.
+// registered for a prefix whose tasks reliably take 30s, so a timeout of 1s, whose locks would keep expiring
+// and being re-acquired while the tasks run, fails instead of processing tasks twice. NoExpiry is allowed.
+// The package-wide floor of SetMinTimeout applies when it is higher. There is no floor by default.
+func WithMinTimeout(floor time.Duration) Option {
+	return func(o *Options) {
+		o.MinTimeout = floor
+	}
+}
+
+// WithTimeBucket ties the keys of the prefix to the current time bucket of the granularity, e.g. time.Minute,
+// aligned to the Unix epoch: the bucket start (Unix seconds) is added to the prefix (prefix:1700000040:postfix),
+// so the limit counts the tasks of the bucket only, and the locks and the internal keys of the bucket expire
+// at its end, instead of after the timeout. Locks left to expire rather than released turn the concurrency
+// limit into a fixed-window rate limiter, at most the limit per bucket; a release frees its slot in the bucket.
+// The granularity must be at least a second. The bucket is chosen with the clock of the caller (see WithClock) when the keys are computed, so a Release
+// in a later bucket misses the lock: release with the Lock handle, which keeps the keys of its bucket.
+func WithTimeBucket(granularity time.Duration) Option {
+	return func(o *Options) {
+		o.TimeBucket = granularity
+	}
+}
+
+// WithTimeoutJitter randomizes the TTL set on acquire by up to ±fraction of the timeout (e.g. 0.1 for ±10%),
+// spreading the expiry of locks acquired at the same time. The fraction must be in [0, 1), or the
+// acquisition fails with ErrInvalidTimeout.
+func WithTimeoutJitter(fraction float64) Option {
+	return func(o *Options) {
+		o.TimeoutJitter = fraction
+	}
+}
+
+// WithWeight makes the acquisition take weight of the Limit slots instead of one, e.g. WithLimit(10) and
+// WithWeight(4) leave 6 slots to other tasks. Releasing the lock frees all of them. The weight must be
+// between 1 and the limit.
+func WithWeight(weight int) Option {
+	return func(o *Options) {
+		o.Weight = weight
+	}
+}
+
+// WithPending makes Acquire take the task key in a pending state for the grace period: the key exists,
+// so duplicates are rejected, but the task does not count towards the limit, and the limit is not checked.
+// Call Promote once the task really starts, to check the limit, count the task and set its timeout;
+// a task that bails out before that just releases its lock, or lets it expire after grace.
+func WithPending(grace time.Duration) Option {
+	return func(o *Options) {
+		o.Pending = grace
+	}
+}
+
+// WithBurst lets the acquisitions exceed the limit by up to burst units during a spike, without raising the
+// steady limit: a unit taken above the limit spends a burst token, and every token spent comes back window
+// after it was spent, whether its lock is still held or not. So at most limit+burst units are held at once,
+// and at most burst units are acquired above the limit within any window. The tokens spent are tracked in
+// the prefix:__burst sorted set of the count scope, next to the active set.
+func WithBurst(burst int, window time.Duration) Option {
+	return func(o *Options) {
+		o.Burst, o.BurstWindow = burst, window
+	}
+}
+
+// WithTenant makes the acquisition count towards the tenant, which may hold at most limit of the slots of the
+// prefix, so a noisy tenant can't monopolize a pool shared with others (see FairShare). The acquisition is
+// rejected like a reached limit when either the prefix or the tenant is at capacity. The tenant is stored
+// in the tenant field of the task key.
+func WithTenant(tenant string, limit int) Option {
+	return func(o *Options) {
+		o.Tenant = tenant
+		o.TenantLimit = limit
+	}
+}
+
+// FairShare returns the slots each of tenants may hold for them to share allowedConcurrentTasks evenly,
+// ceil(allowedConcurrentTasks/tenants), as a limit for WithTenant. It returns allowedConcurrentTasks
+// when tenants is not positive.
+func FairShare(allowedConcurrentTasks, tenants int) int {
+	if tenants <= 0 {
+		return allowedConcurrentTasks
+	}
+	return (allowedConcurrentTasks + tenants - 1) / tenants
+}
+
+// WithPriority sets the priority level of the acquisition (0, the lowest, by default).
+// Higher levels can use the slots reserved with WithReservedSlots.
+func WithPriority(level int) Option {
+	return func(o *Options) {
+		o.Priority = level
+	}
+}
+
+// WithReservedSlots reserves n of the Limit slots for acquisitions with a priority of at least level,
+// e.g. WithLimit(10) and WithReservedSlots(1, 2) let priority 0 use at most 8 slots and priority 1 all 10.
+// Use the same reservations for every caller of the prefix.
+func WithReservedSlots(level, n int) Option {
+	return func(o *Options) {
+		if o.Reserved == nil {
+			o.Reserved = make(map[int]int)
+		}
+		o.Reserved[level] = n
+	}
+}
+
+// WithOwner sets the owner id stored in the task key on acquire and checked on release.
+func WithOwner(owner string) Option {
+	return func(o *Options) {
+		o.Owner = owner
+	}
+}
+
+// WithOwnerFunc sets the generator of the owner ids used when no WithOwner owner is given, instead of the
+// default random UUID read from crypto/rand, e.g. to get predictable owner ids in tests. The ids it returns
+// must be unique across every holder of the prefix, or holders could release each other's locks, so keep
+// the default in production unless the generator is just as unique.
+func WithOwnerFunc(fn func() string) Option {
+	return func(o *Options) {
+		o.OwnerFunc = fn
+	}
+}
+
+// WithFencingToken makes Acquire store a fencing token instead of the owner id (see AcquireLockWithToken).
+func WithFencingToken() Option {
+	return func(o *Options) {
+		o.FencingToken = true
+	}
+}
+
+// WithMetadata stores the given fields in the task key when the lock is acquired (see GetLockInfo).
+// Calling it more than once merges the fields.
+func WithMetadata(metadata map[string]string) Option {
+	return func(o *Options) {
+		if o.Metadata == nil {
+			o.Metadata = make(map[string]string, len(metadata))
+		}
+		for name, value := range metadata {
+			o.Metadata[name] = value
+		}
+	}
+}
+
+// WithJSONMetadata stores v, encoded with encoding/json, in the data field of the task key when the lock is
+// acquired, e.g. a struct with the task type, host and trace id, for GetMetadata to decode back. The task key
+// keeps its owner id, so ownership checks are unaffected. A v that can't be encoded makes the acquisition
+// fail with ErrInvalidOption.
+func WithJSONMetadata(v any) Option {
+	return func(o *Options) {
+		o.Data, o.dataErr = json.Marshal(v)
+		if o.dataErr != nil {
+			o.Data, o.dataErr = nil, fmt.Errorf("%w: encode JSON metadata: %w", ErrInvalidOption, o.dataErr)
+		}
+	}
+}
+
+// WithReentrant makes Acquire re-acquire a lock already held by the WithOwner owner instead of reporting
+// that the key exists, and Release release one hold at a time (see Options.Reentrant).
+func WithReentrant() Option {
+	return func(o *Options) {
+		o.Reentrant = true
+	}
+}
+
+// WithExtendOwned makes Acquire keep alive a lock already held by the WithOwner owner: its TTL is
+// raised to max(remaining, timeout) and the acquisition succeeds, instead of reporting that the key exists.
+// Keys held by another owner are still reported as existing. Use a unique owner id with it.
+func WithExtendOwned() Option {
+	return func(o *Options) {
+		o.ExtendOwned = true
+	}
+}
+
+// WithFairQueue makes Acquire grant slots in arrival order instead of to whichever waiter retries first
+// (see Options.Fair). Use it with WithRetry, and keep the retry delay well below 30 seconds:
+// a waiter that does not retry within 30 seconds loses its place in the queue.
+func WithFairQueue() Option {
+	return func(o *Options) {
+		o.Fair = true
+	}
+}
+
+// WithNotify makes Release (and Unlock of locks acquired with it) publish on the prefix's
+// tasklocker:freed:<prefix> channel when a slot frees up, so WaitForSlot callers wake up.
+func WithNotify() Option {
+	return func(o *Options) {
+		o.Notify = true
+	}
+}
+
+// WithUnlink makes Release (and Unlock of locks acquired with it) and ClearPrefix delete keys with UNLINK
+// instead of DEL, so large task keys (e.g. with metadata) are freed in the background without blocking Redis.
+// UNLINK needs Redis 4; older servers fall back to DEL.
+func WithUnlink() Option {
+	return func(o *Options) {
+		o.Unlink = true
+	}
+}
+
+// WithRetry makes Acquire retry with the given backoff while the limit is reached (see AcquireLockWait).
+func WithRetry(backoff Backoff) Option {
+	return func(o *Options) {
+		o.Retry = &backoff
+	}
+}
+
+// WithStrictRelease makes a release that released nothing an error: ErrLockNotHeld when the key is missing
+// (e.g. the lock expired), and ErrStaleLock when it is held by another owner (with WithOwner). By default
+// both are normal outcomes, reported as false without an error, since a lock expiring before its holder
+// releases it is expected. Pass it on release, or on acquire for Unlock.
+func WithStrictRelease() Option {
+	return func(o *Options) {
+		o.StrictRelease = true
+	}
+}
+
+// WithDedupWindow keeps a "recently processed" marker for window after a lock is released, so the same task
+// arriving again shortly after it completed is recognized as a duplicate: while the marker exists, the acquire
+// functions report the key as existing, and AcquireLockResult reports DuplicateRecent. The marker is a separate
+// key (prefix:__done:postfix) with its own TTL, set by the release functions and by Unlock of locks acquired
+// with the option; releases without it leave no marker. Pass it on acquire and on release.
+func WithDedupWindow(window time.Duration) Option {
+	return func(o *Options) {
+		o.DedupWindow = window
+	}
+}
+
+// WithVersion makes the acquisition conditional on an optimistic concurrency check, fused with the lock in
+// the acquire script: the lock is only acquired while the string key holds the expected version (e.g. the
+// version of the state machine the task advances), and AcquireLockResult reports VersionMismatch otherwise,
+// without retrying, so stale work is skipped. A missing key never holds the version. The task key and the
+// dedup marker are checked first, so a running or recent task is still reported as such. In Redis Cluster,
+// the key must hash to the slot of the prefix, e.g. with a hash tag. The version needs Redis, so it is not
+// checked by WithLocalFallback, which returns the Redis error instead.
+func WithVersion(key, expected string) Option {
+	return func(o *Options) {
+		o.VersionKey, o.Version = key, expected
+	}
+}
+
+// WithLifetimes sets the two phases of the lifetime of a task for idempotent dedup: while it runs, its slot
+// lives for running (like WithTimeout), so a dead worker's task is retried soon; once it is released, its
+// "already processed" marker lives for processed (like WithDedupWindow), usually much longer. A processed of
+// 0 sets no marker. Pass the same lifetimes on acquire and on release, or register them for the prefix.
+func WithLifetimes(running, processed time.Duration) Option {
+	return func(o *Options) {
+		o.Timeout, o.DedupWindow = running, processed
+	}
+}
+
+// WithFailOpen makes AcquireLockScan fail open: when the SCAN counting the active tasks fails, e.g. on a
+// transient Redis error, the lock is still acquired if its key does not exist, ignoring the limit for that
+// call, instead of refusing every task. This trades a momentarily exceeded limit for availability, so only
+// use it where running too many tasks is less harmful than running none. The default is to fail closed.
+// The other acquire functions count within the acquire script, so a failure there always fails the call.
+func WithFailOpen() Option {
+	return func(o *Options) {
+		o.FailOpen = true
+	}
+}
+
+// WithFastReject makes the acquire functions probe the active set with a cheap ZCOUNT before running the
+// acquire script, and report the limit reached right away when the unexpired units leave no room for the
+// weight, for less load on Redis under sustained overload, when most attempts fail. The probe and the script
+// are not atomic, so an attempt may be rejected although a slot was freed right after the probe, and an
+// existing task key is then reported as the limit reached rather than as existing. The probe compares the
+// expiry of the units with the local clock, see WithClock. It is skipped for unlimited, pending, fair,
+// reentrant, extended and refreshed acquisitions, which may acquire while the limit is reached, or must
+// queue. It is off by default.
+func WithFastReject() Option {
+	return func(o *Options) {
+		o.FastRejectWhenFull = true
+	}
+}
+
+// WithLocalFallback makes Acquire fall back to a process-local lock, keyed by the same task key, when the
+// acquire script fails with ErrRedisUnavailable, for best-effort uses such as a non-critical dedup: the lock
+// then only excludes the holders of the same process, and the limit only counts its local locks, so the
+// distributed guarantees are lost for as long as Redis is down. Lock.Local reports such a lock, and Unlock
+// and Refresh handle it in-process; pass the option to Release as well for it to release local locks.
+// Fencing tokens and pending locks still need Redis and keep returning the error. It is off by default.
+func WithLocalFallback() Option {
+	return func(o *Options) {
+		o.LocalFallback = true
+	}
+}
+
+// WithAuditStream appends an entry to the Redis Stream stream on every acquire and release, for an audit
+// trail of who held what: the event (acquire or release), the task key, the owner and the outcome, e.g.
+// acquired, limit_reached or released. The ID XADD generates holds the Redis time of the entry. The entry
+// is written by the acquire or release script itself, so it costs no extra round-trip and is only written
+// when the operation ran. A failure to write it, e.g. the key holding another type, is logged and ignored,
+// unless fatal is set: the operation then returns an error wrapping ErrAuditFailed, releasing a lock it
+// acquired. Trim the stream with XTRIM, or set a TTL on it, as it is never trimmed here. In Redis Cluster, the
+// stream must hash to the slot of the prefix, e.g. with WithHashTag and a stream named {prefix}:audit.
+func WithAuditStream(stream string, fatal bool) Option {
+	return func(o *Options) {
+		o.AuditStream, o.AuditFatal = stream, fatal
+	}
+}
+
+// WithDefaultOpTimeout bounds every Redis operation with timeout when the ctx passed by the caller has no
+// deadline: each attempt of Acquire, Release, Refresh and Promote, the operations of the returned lock, and
+// the whole call of the other functions. The waits between retries are not bounded, and a caller deadline
+// always takes precedence.
+func WithDefaultOpTimeout(timeout time.Duration) Option {
+	return func(o *Options) {
+		o.DefaultOpTimeout = timeout
+	}
+}
+
+// WithOpTimeout bounds every Redis round-trip with timeout, whether or not the ctx passed by the caller has
+// a deadline, the earlier deadline applying: each attempt of Acquire, Release, Refresh and Promote, the
+// operations of the returned lock, and the whole call of the other functions. Unlike the timeout of the
+// lock, which is how long the lock lives, it is how long a single call may wait for Redis to answer.
+// The waits between retries are not bounded, so a retrying acquire can wait longer than timeout overall.
+func WithOpTimeout(timeout time.Duration) Option {
+	return func(o *Options) {
+		o.OpTimeout = timeout
+	}
+}
+
+// WithRefreshExisting makes Acquire re-enter a task whose key already exists, e.g. for idempotent schedulers
+// re-running a task: the TTL of the key is reset to the timeout, the task keeps counting towards the limit,
+// and the acquisition succeeds instead of reporting that the key exists. Unlike WithExtendOwned, the owner
+// of the key is not checked, and the key keeps its value: the returned lock only releases it when its
+// owner id matches that value, and no new fencing token is generated.
+func WithRefreshExisting() Option {
+	return func(o *Options) {
+		o.RefreshExisting = true
+	}
+}
+
+// WithRedisRetry makes Acquire, Release and Refresh retry a Redis operation up to retries times, with the
+// given backoff, when it fails with a transient error: connection and network errors, or a busy server
+// (LOADING, TRYAGAIN, CLUSTERDOWN, MASTERDOWN). Other errors, e.g. ErrRedisOutOfMemory, and logical
+// outcomes, such as a reached limit or an existing key, are never retried.
+// A retried operation may have run before its connection failed, in which case the retry sees its
+// effect: combine it with WithExtendOwned so an acquire retried this way still reports the lock as acquired.
+func WithRedisRetry(retries int, backoff Backoff) Option {
+	return func(o *Options) {
+		o.RedisRetries = retries
+		o.RedisBackoff = backoff
+	}
+}
+
+// WithClientFunc makes the operations on a prefix use the client returned by fn for it instead of the client
+// passed to them, e.g. clients authenticated as different Redis ACL users per task family, so a shared call
+// site still runs with least privilege. The passed-in client is used when fn returns nil. fn is called with
+// the prefix as given by the caller, before WithHashTag or WithNamespace are applied. Router.Client fits.
+// The functions working on several prefixes at once (MultiStats) and AcquireTx, whose pipeline comes from
+// the caller, keep the passed-in client.
+func WithClientFunc(fn func(prefix string) redis.UniversalClient) Option {
+	return func(o *Options) {
+		o.ClientFunc = fn
+	}
+}
+
+// WithCountScope counts the concurrency across a group shared by several prefixes instead of per prefix,
+// e.g. three job types sharing a pool of 10 workers all pass WithLimit(10) and WithCountScope("workers").
+// The task keys, and so the "already running" check, stay per prefix and postfix. The active set, the fair
+// queue and the WaitForSlot channel belong to the group. Use the same scope on acquire and release.
+func WithCountScope(scope string) Option {
+	return func(o *Options) {
+		o.CountScope = scope
+	}
+}
+
+// WithCountPatterns makes AcquireLockScan and CountActive count the keys matching any of the SCAN match
+// patterns instead of the keys of the prefix, e.g. to count prefixA:* and prefixB:* as one pool while the
+// uniqueness stays per prefix and postfix. Every pattern is scanned, the scans of the patterns pipelined, and
+// the keys they match summed, a key matched by several patterns counting once. The patterns are used as
+// given: build them with ScanPatternFor to apply the namespace, separator and hash tag of their prefix.
+// Internal keys such as prefixA:__active are not counted. An empty pattern is rejected with ErrInvalidOption,
+// and a pattern starting with a glob character, matching keys of any prefix, is logged as a warning.
+func WithCountPatterns(patterns ...string) Option {
+	return func(o *Options) {
+		o.CountPatterns = patterns
+	}
+}
+
+// WithNamespace prepends namespace to every key and channel (e.g. "app1:tasklocker:" turns
+// google_places_brands_processor:1 into app1:tasklocker:google_places_brands_processor:1), including the
+// internal keys and the SCAN patterns of CountActive, ListActive and ClearPrefix.
+// Use the same namespace for every call on a prefix, e.g. by passing it to New.
+func WithNamespace(namespace string) Option {
+	return func(o *Options) {
+		o.Namespace = namespace
+	}
+}
+
+// WithHashTag wraps the prefix in a Redis Cluster hash tag (see HashTag).
+func WithHashTag() Option {
+	return func(o *Options) {
+		o.HashTag = true
+	}
+}
+
+// WithSeparator sets the separator between the prefix and the postfix in task keys.
+// A custom separator must not appear in the prefix or postfix, otherwise Acquire and Release return an error.
+// Use the same separator on acquire and release so both build the same key.
+func WithSeparator(separator string) Option {
+	return func(o *Options) {
+		o.Separator = separator
+	}
+}
+
+// WithKeyFunc replaces the prefix:postfix key layout with key, called with the prefix (after WithHashTag)
+// and the postfix, or the reserved postfixes of the internal keys such as __active. pattern returns the SCAN
+// match pattern covering every key of the prefix, glob characters escaped by the caller; when nil, the keys
+// starting with key(prefix, "") are matched. Use the same functions everywhere the prefix is used.
+// The postfixes reported by ListActive and WatchExpired are only recovered from keys starting with
+// key(prefix, ""), the whole key is reported otherwise.
+// key must return the same key for the same arguments for as long as a lock lives, so its release and
+// refreshes find it: derive a date shard from the task rather than from the current time.
+func WithKeyFunc(key func(prefix, postfix string) string, pattern func(prefix string) string) Option {
+	return func(o *Options) {
+		o.KeyFunc = key
+		o.PatternFunc = pattern
+	}
+}
+
+// KeyHashEncoding is the encoding of the SHA-256 hash replacing a long postfix, see WithMaxKeyLength.
+type KeyHashEncoding int
+
+const (
+	// HexKeyHash encodes the hash in lowercase hex, 64 characters.
+	HexKeyHash KeyHashEncoding = iota
+	// Base64KeyHash encodes the hash in unpadded URL-safe base64, 43 characters.
+	Base64KeyHash
+)
+
+// WithMaxKeyLength replaces the postfix of a task key with its SHA-256 hash, encoded with encoding, when the key
+// would be longer than n bytes, e.g. for postfixes that are long URLs: the prefix stays literal, so the SCAN
+// pattern of the prefix still matches the key, and the dedup marker, the read/write lock and the active set
+// member of the postfix use the hash too. The original postfix is stored in the "postfix" field of the task
+// key, for GetLockInfo to return in Metadata. The tradeoff is readability: ListActive, WatchExpired and the
+// matchers report the hash as the postfix of such keys, and the keys must be computed with KeyFor from the
+// original postfix. Postfixes no longer than the hash itself are never hashed, so a hashed postfix maps to
+// itself. Use the same length and encoding everywhere the prefix is used. It is off by default.
+func WithMaxKeyLength(n int, encoding KeyHashEncoding) Option {
+	return func(o *Options) {
+		o.MaxKeyLength, o.KeyHash = n, encoding
+	}
+}
+
+// WithMaxScanIterations bounds the SCAN calls of CountActive, ListActive and AcquireLockScan to n, e.g. to keep
+// a latency-sensitive caller within its budget on a pathological keyspace, where the SCAN cursor returns few
+// keys per call. Every SCAN call counts, on every node of a cluster and for every pattern of WithCountPatterns.
+// Once the budget is spent, CountActive and ListActive return the keys found until then, a lower bound, with
+// an error wrapping ErrScanBudgetExceeded, and AcquireLockScan refuses the acquisition with the error (or
+// acquires as if no task were active with WithFailOpen). There is no bound by default.
+func WithMaxScanIterations(n int) Option {
+	return func(o *Options) {
+		o.MaxScanIterations = n
+	}
+}
+
+// WithConsistentSnapshot makes CountActive and ListActive reconcile the keys their SCAN found into a
+// best-effort consistent value, e.g. for a dashboard polled under heavy churn. SCAN offers no point-in-time
+// snapshot: it returns every key that exists for the whole iteration, maybe more than once, while a key set or
+// deleted during it may or may not be returned. The keys are always deduplicated; with this option, they are
+// then checked with pipelined EXISTS calls, so every key counted or listed still existed once the SCAN was
+// done, and ListActive sorts the postfixes for a stable order. With crossCheck, CountActive is also capped at
+// the unexpired units of the active set of the prefix, which the scripts update atomically, so it never reports
+// more tasks than hold a slot; only use it when every key of the prefix is set by this package, and the cap is
+// skipped with WithCountScope or WithCountPatterns, whose keys the active set does not match. Keys set while
+// the SCAN ran may still be missed.
+func WithConsistentSnapshot(crossCheck bool) Option {
+	return func(o *Options) {
+		o.Snapshot = true
+		o.SnapshotCrossCheck = crossCheck
+	}
+}
+
+// WithScanCount sets the COUNT hint of the SCAN calls enumerating the keys of a prefix, trading
+// fewer round-trips for longer individual calls on large keyspaces.
+func WithScanCount(count int64) Option {
+	return func(o *Options) {
+		o.ScanCount = count
+	}
+}
+
+// WithWriteProbe makes HealthCheck confirm that Redis accepts writes, not just pings, with a
+// SET/GET/DEL round-trip on a short-lived probe key.
+func WithWriteProbe() Option {
+	return func(o *Options) {
+		o.WriteProbe = true
+	}
+}
+
+// WithMaxLifetime caps how long AutoRenew, Refresh and Lock.Refresh keep a lock alive, counted from its
+// acquisition on the Redis clock. A refresh never sets a TTL reaching beyond the cap, so the lock expires
+// there, and once it is reached refreshes report the lock lost (AutoRenew then invokes WithOnLostLock).
+// Pass it on acquire for Lock.Refresh. It does not shorten the timeout of the acquisition itself.
+func WithMaxLifetime(lifetime time.Duration) Option {
+	return func(o *Options) {
+		o.MaxLifetime = lifetime
+	}
+}
+
+// WithAutoRenew makes RunWithLock renew the lock to its timeout every timeout/3 while its callback runs, and
+// cancel the context of the callback when a renewal finds the lock lost.
+func WithAutoRenew() Option {
+	return func(o *Options) {
+		o.AutoRenew = true
+	}
+}
+
+// WithOnLostLock sets the callback AutoRenew invokes when a renewal finds that the lock was lost.
+func WithOnLostLock(fn func()) Option {
+	return func(o *Options) {
+		o.OnLostLock = fn
+	}
+}
+
+// WithOnBlocked sets the callback Acquire invokes when the limit is reached and WithRetry makes it wait,
+// with the active task count and the attempt number, e.g. to surface a "waiting for a free worker" status.
+// It is called once, after the first blocked attempt, or after every blocked attempt with everyRetry.
+func WithOnBlocked(fn func(active, attempt int), everyRetry bool) Option {
+	return func(o *Options) {
+		o.OnBlocked = fn
+		o.OnBlockedEveryRetry = everyRetry
+	}
+}
+
+// WithWarnThreshold sets the callback the acquire functions invoke when the utilization of the prefix reaches
+// fraction of the limit (e.g. 0.8 for 80%), as an early warning to scale workers before tasks get rejected.
+// The callback receives the active task count right after the acquisition and the limit. By default it is only
+// called by the acquisition crossing the threshold, so it fires once per transition whichever process acquires;
+// with everyCall, it is called by every acquisition at or above the threshold. A re-acquisition (WithReentrant,
+// WithExtendOwned or WithRefreshExisting) within its weight below the threshold may be reported as crossing it.
+// The callback runs synchronously and should not block.
+func WithWarnThreshold(fraction float64, fn func(active, limit int), everyCall bool) Option {
+	return func(o *Options) {
+		o.WarnThreshold = fraction
+		o.OnThreshold = fn
+		o.OnThresholdEveryCall = everyCall
+	}
+}
+
+// WithOnRetry sets the callback a retrying Acquire (see WithRetry) invokes before every retry, with the number
+// of the attempt that found the limit reached and the active task count it saw. Unlike WithOnBlocked, meant
+// to react to the wait starting, it is meant for instrumentation, e.g. a counter of retries per prefix; the
+// attempts of a successful acquisition are also reported by Lock.Attempts. The read/write locks and Redlock
+// call it too, with an active count of 0.
+func WithOnRetry(fn func(attempt, active int)) Option {
+	return func(o *Options) {
+		o.OnRetry = fn
+	}
+}
+
+// RejectDecision is what Acquire does with a rejected acquisition, as decided by the WithOnRejected callback.
+type RejectDecision int
+
+// The decisions of the WithOnRejected callback.
+const (
+	// RejectReturn returns the result without the lock, as without the callback.
+	RejectReturn RejectDecision = iota
+	// RejectRetry attempts the acquisition again, after the delay of the WithRetry backoff (the zero Backoff,
+	// 100ms, without it), as long as ctx is not done.
+	RejectRetry
+	// RejectFail returns an error wrapping ErrRejected instead of the result.
+	RejectFail
+)
+
+// WithOnRejected sets the callback Acquire (and every function built on it, e.g. AcquireLock) invokes just
+// before returning without the lock, with the outcome (AtCapacity, AlreadyRunning, DuplicateRecent or
+// VersionMismatch) and the active task count of the last attempt, e.g. to hand the task to a spillover
+// queue. Its decision overrides the outcome: RejectReturn keeps it, RejectRetry attempts again (calling the
+// callback again if that attempt is rejected too) and RejectFail turns it into an error wrapping
+// ErrRejected. With WithRetry, the attempts waiting for a slot are not rejections, and the callback is only
+// called once the acquisition would return, e.g. for an existing key; a wait exhausting its backoff returns
+// ErrAcquireTimeout without calling it. It runs synchronously, on the goroutine of Acquire.
+func WithOnRejected(fn func(reason AcquireResult, active int) RejectDecision) Option {
+	return func(o *Options) {
+		o.OnRejected = fn
+	}
+}
+
+// WithCandidates makes AcquireAny choose the postfix among candidates instead of generating one, e.g. the
+// worker shards of a prefix: a free candidate (whose task key does not exist) is picked at random with a
+// probability proportional to its weight, so a shard weighted twice as much is chosen twice as often, e.g.
+// with weights derived from the load of the shards to favor the least loaded. Candidates weighted 0 are never
+// picked, and a negative or non-finite weight makes AcquireAny fail with ErrInvalidOption.
+func WithCandidates(candidates map[string]float64) Option {
+	return func(o *Options) {
+		o.Candidates = candidates
+	}
+}
+
+// WithOnAcquireLatency sets the callback Acquire invokes with the time the acquisition took, including
+// the retries of WithRetry, e.g. to feed a latency histogram. It is called once per Acquire that does not
+// fail, whatever the outcome (acquired, existing key or limit reached).
+func WithOnAcquireLatency(fn func(time.Duration)) Option {
+	return func(o *Options) {
+		o.OnAcquireLatency = fn
+	}
+}
+
+// WithOnAcquireExemplar sets a callback Acquire invokes like the one of WithOnAcquireLatency, with the
+// outcome of the acquisition and the context returned by the Tracer for the span of its last attempt, e.g.
+// to attach the trace and span ids of an OpenTelemetry span (trace.SpanContextFromContext) as an exemplar
+// of the latency histogram. The span has ended by then, only its identity is meant to be read. Without a
+// Tracer, ctx is the context passed to Acquire.
+func WithOnAcquireExemplar(fn func(ctx context.Context, latency time.Duration, result AcquireResult)) Option {
+	return func(o *Options) {
+		o.OnAcquireExemplar = fn
+	}
+}
+
+// WithOnHoldTime sets the callback Unlock invokes with the time the lock was held, from its acquisition
+// to its release, e.g. to feed a hold-time histogram. Releases through Release, which has no lock handle,
+// are not measured.
+func WithOnHoldTime(fn func(time.Duration)) Option {
+	return func(o *Options) {
+		o.OnHoldTime = fn
+	}
+}
+
+// WithOnEvicted sets the callback invoked when an acquire attempt evicted tasks whose timeout passed
+// without a release, with the number of tasks evicted. Expired holders are evicted by the next attempt
+// on the prefix, whatever its outcome, so frequent evictions are a direct sign that the timeout is too
+// short for the tasks, or that workers die while holding locks. See also Lock.Evicted.
+func WithOnEvicted(fn func(evicted int)) Option {
+	return func(o *Options) {
+		o.OnEvicted = fn
+	}
+}
+
+// WithContention counts the acquire attempts decided by the limit in c, acquired or rejected because the
+// limit was reached, so c.Ratio reports the contention of the prefix over a rolling window. The attempts of
+// the batch and scan functions are counted too. Share c between the calls of a prefix (or register it), and
+// between processes with NewRedisContention.
+func WithContention(c *Contention) Option {
+	return func(o *Options) {
+		o.Contention = c
+	}
+}
+
+// WithLogger sets the logger receiving structured log lines (a *slog.Logger works as is).
+func WithLogger(logger Logger) Option {
+	return func(o *Options) {
+		o.Logger = logger
+	}
+}
+
+// WithMetrics sets the hooks receiving per-prefix counters, e.g. backed by Prometheus collectors.
+func WithMetrics(metrics Metrics) Option {
+	return func(o *Options) {
+		o.Metrics = metrics
+	}
+}
+
+// WithTracer sets the tracer starting spans around the Redis operations (see Tracer).
+func WithTracer(tracer Tracer) Option {
+	return func(o *Options) {
+		o.Tracer = tracer
+	}
+}
+
+// WithClock sets the time source used instead of time.Now, so tests can control deadlines,
+// retry budgets and the durations passed to the callbacks without sleeping.
+func WithClock(now func() time.Time) Option {
+	return func(o *Options) {
+		o.Clock = now
+	}
+}
+
+// validate checks the key like validateKey, and the acquisition like validateAcquisition, after computing
+// the timeout of the postfix with TimeoutFunc when it is set.
+func (o *Options) validate(prefix, postfix string) error {
+	if err := o.validateKey(prefix, postfix); err != nil {
+		return err
+	}
+	if o.TimeoutFunc != nil {
+		timeout := o.TimeoutFunc(postfix)
+		if timeout <= 0 && timeout != NoExpiry {
+			return fmt.Errorf("%w: timeout func must return a positive timeout or NoExpiry for %q, got %s", ErrInvalidTimeout, postfix, timeout)
+		}
+		o.Timeout = timeout
+	}
+	return o.validateAcquisition()
+}
+
+// validateAcquisition checks that the limit and timeout of an acquisition are positive, that its timeout
+// jitter is in [0, 1), that its weight fits in the limit, and that its deadline, if any, did not pass.
+func (o *Options) validateAcquisition() error {
+	if o.Limit <= 0 && o.Limit != Unlimited {
+		return fmt.Errorf("%w: allowed concurrent tasks must be positive or Unlimited, got %d", ErrInvalidLimit, o.Limit)
+	}
+	if o.Weight <= 0 || (o.Weight > o.Limit && o.Limit != Unlimited) {
+		return fmt.Errorf("%w: weight must be between 1 and the limit %d, got %d", ErrInvalidWeight, o.Limit, o.Weight)
+	}
+	for level, n := range o.Reserved {
+		if n < 0 {
+			return fmt.Errorf("%w: reserved slots of level %d must not be negative, got %d", ErrInvalidLimit, level, n)
+		}
+	}
+	if limit := o.limit(); o.Limit > 0 && limit < o.Weight {
+		// The scripts read a negative limit as no limit at all
+		return fmt.Errorf("%w: the slots reserved above priority %d leave %d of %d slots, less than the weight %d", ErrInvalidLimit, o.Priority, limit, o.Limit, o.Weight)
+	}
+	if o.Timeout <= 0 && o.Timeout != NoExpiry {
+		return fmt.Errorf("%w: timeout must be positive or NoExpiry, got %s", ErrInvalidTimeout, o.Timeout)
+	}
+	if o.TimeoutJitter < 0 || o.TimeoutJitter >= 1 {
+		// A jitter of 1 or more can bring the TTL to 0, which the acquire script reads as NoExpiry
+		return fmt.Errorf("%w: timeout jitter must be in [0, 1), got %g", ErrInvalidTimeout, o.TimeoutJitter)
+	}
+	if o.MinTimeout > 0 && o.Timeout != NoExpiry && o.Timeout < o.MinTimeout {
+		return fmt.Errorf("%w: timeout %s is below the minimum %s", ErrTimeoutTooShort, o.Timeout, o.MinTimeout)
+	}
+	if !o.Deadline.IsZero() && !o.Clock().Before(o.Deadline) {
+		return fmt.Errorf("%w: deadline %s already passed", ErrInvalidTimeout, o.Deadline.Format(time.RFC3339))
+	}
+	if o.dataErr != nil {
+		return o.dataErr
+	}
+	if o.TimeBucket < 0 || (o.TimeBucket > 0 && o.TimeBucket < time.Second) {
+		return fmt.Errorf("%w: time bucket must be at least a second, got %s", ErrInvalidTimeout, o.TimeBucket)
+	}
+	if o.Burst < 0 || (o.Burst > 0 && o.BurstWindow <= 0) {
+		return fmt.Errorf("%w: burst must not be negative and its window must be positive, got %d within %s", ErrInvalidLimit, o.Burst, o.BurstWindow)
+	}
+	if o.Tenant != "" && o.TenantLimit < o.Weight {
+		return fmt.Errorf("%w: the limit of tenant %q must be at least the weight %d, got %d", ErrInvalidLimit, o.Tenant, o.Weight, o.TenantLimit)
+	}
+	return nil
+}
+
+// validateConfig checks the options of a Locker once, at construction: the prefix like validatePrefix, the
+// acquisition like validateAcquisition, and the values and combinations of options no acquisition could use.
+// Every problem found is reported, joined.
+func (o *Options) validateConfig(prefix string) error {
+	errs := []error{o.validatePrefix(prefix), o.validateAcquisition()}
+	durations := []struct {
+		name string
+		d    time.Duration
+	}{
+		{"pending grace", o.Pending},
+		{"dedup window", o.DedupWindow},
+		{"max lifetime", o.MaxLifetime},
+		{"op timeout", o.OpTimeout},
+		{"default op timeout", o.DefaultOpTimeout},
+	}
+	for _, duration := range durations {
+		if duration.d < 0 {
+			errs = append(errs, fmt.Errorf("%w: %s must not be negative, got %s", ErrInvalidTimeout, duration.name, duration.d))
+		}
+	}
+	if o.FencingToken && (o.Reentrant || o.ExtendOwned) {
+		// The key holds the token, so the owner id the re-entry compares is never found
+		errs = append(errs, fmt.Errorf("%w: fencing tokens can't be combined with reentrant or extended owned locks", ErrInvalidOption))
+	}
+	if o.FencingToken && o.Owner != "" {
+		errs = append(errs, fmt.Errorf("%w: the key holds the fencing token, the owner %q would be ignored", ErrInvalidOption, o.Owner))
+	}
+	if o.WarnThreshold < 0 || o.WarnThreshold > 1 || (o.WarnThreshold > 0 && o.OnThreshold == nil) {
+		errs = append(errs, fmt.Errorf("%w: the warn threshold must be in [0, 1] with a callback, got %g", ErrInvalidOption, o.WarnThreshold))
+	}
+	if o.RedisRetries < 0 {
+		errs = append(errs, fmt.Errorf("%w: redis retries must not be negative, got %d", ErrInvalidOption, o.RedisRetries))
+	}
+	if o.ScanCount < 0 {
+		errs = append(errs, fmt.Errorf("%w: scan count must not be negative, got %d", ErrInvalidOption, o.ScanCount))
+	}
+	return errors.Join(errs...)
+}
+
+// limit returns the number of slots available to the acquisition: Limit minus the slots
+// reserved for priority levels above o.Priority, at least 0, or Unlimited without a limit.
+func (o *Options) limit() int {
+	if o.Limit == Unlimited {
+		return Unlimited
+	}
+	limit := o.Limit
+	for level, n := range o.Reserved {
+		if level > o.Priority {
+			limit -= n
+		}
+	}
+	return max(limit, 0)
+}
+
+// jitteredTimeout returns the Timeout randomized by TimeoutJitter, at least a millisecond so the lock always
+// expires.
+func (o *Options) jitteredTimeout() time.Duration {
+	return max(jitter(o.Timeout, o.TimeoutJitter), time.Millisecond)
+}
+
+// burst returns the burst units the acquisition may take above its limit, see WithBurst, 0 without a limit.
+func (o *Options) burst() int {
+	if o.Limit == Unlimited || o.BurstWindow <= 0 {
+		return 0
+	}
+	return o.Burst
+}
+
+// clientFor returns the client of the prefix resolved by o.ClientFunc, or client when there is none.
+func (o *Options) clientFor(prefix string, client redis.UniversalClient) redis.UniversalClient {
+	if o.ClientFunc == nil {
+		return client
+	}
+	if resolved := o.ClientFunc(prefix); resolved != nil {
+		return resolved
+	}
+	return client
+}
+
+// opContext returns ctx bounded by o.OpTimeout when it is set, by o.DefaultOpTimeout when it is set and ctx
+// has no deadline, and ctx otherwise. The returned cancel function must be called once the operation is done.
+func (o *Options) opContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withOpTimeout(ctx, o.OpTimeout, o.DefaultOpTimeout)
+}
+
+// withOpTimeout bounds ctx with timeout when it is positive, and otherwise with defaultTimeout
+// when it is positive and ctx has no deadline.
+func withOpTimeout(ctx context.Context, timeout, defaultTimeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	if _, ok := ctx.Deadline(); ok || defaultTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, defaultTimeout)
+}
+
+// newOptions applies opts on top of the defaults.
+func newOptions(opts []Option) *Options {
+	o := &Options{
+		Limit:     DefaultLimit,
+		Timeout:   DefaultTimeout,
+		Weight:    1,
+		Separator: DefaultSeparator,
+		ScanCount: defaultScanCount,
+		Logger:    nopLogger{},
+		Metrics:   nopMetrics{},
+		Tracer:    nopTracer{},
+		Clock:     time.Now,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
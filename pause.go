@@ -0,0 +1,118 @@
+package tasklocker
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// PauseLock frees the slot of a lock without giving up its task: the task key is kept as a paused marker, so
+// the task can be resumed with ResumeLock later, under the same postfix and owner id, e.g. for a long job
+// paused while a higher priority one runs. The states are:
+//
+//	held --PauseLock--> paused (slot free, key kept) --ResumeLock--> held
+//
+// While paused, the acquire functions report the key as existing, whatever their mode, and Refresh reports
+// the lock lost. The marker keeps the owner id, metadata and data of the lock, with the WithMetadata fields
+// of opts on top of them, and is kept for ttl (NoExpiry keeps it until it is resumed); Release deletes it,
+// giving up the task. AcquireLockScan counts the marker, since its SCAN still sees the key.
+// With WithOwner, the lock is only paused while it still holds that owner id; reentrant holds are all paused.
+// It returns true when the lock was paused, false when the key was missing, released, already paused or
+// held by another owner.
+// Parameters:
+// - ctx: The context for the Redis operations.
+// - client: The Redis client instance.
+// - prefix: The prefix for the task key.
+// - postfix: The unique identifier for the task (e.g., task id).
+// - ttl: How long the paused marker is kept, or NoExpiry.
+// - opts: The options, e.g. WithOwner, WithMetadata, WithStrictRelease or WithNotify.
+func PauseLock(ctx context.Context, client redis.UniversalClient, prefix, postfix string, ttl time.Duration, opts ...Option) (bool, error) {
+	o := newPrefixOptions(prefix, opts)
+	client = o.clientFor(prefix, client)
+	if err := o.validateKey(prefix, postfix); err != nil {
+		return false, err
+	}
+	var ms int64 // 0 for NoExpiry
+	switch {
+	case ttl == NoExpiry:
+	case ttl > 0:
+		ms = formatMs(ttl)
+	default:
+		return false, fmt.Errorf("%w: pause ttl must be positive or NoExpiry, got %s", ErrInvalidTimeout, ttl)
+	}
+	keys := o.keyspace(prefix)
+	mode := o.releaseMode()
+	var channel string
+	if mode.notify {
+		channel = keys.freed()
+	}
+
+	args := append([]any{keys.member(postfix), o.Owner, ms, channel}, o.metadataArgs()...)
+	var paused bool
+	err := o.retryTransient(ctx, func(ctx context.Context) error {
+		cmd := runScript(ctx, client, pauseScript, []string{keys.task(postfix), keys.active()}, args...)
+		var err error
+		paused, _, err = decodeRelease(cmd, keys.task(postfix), releaseMode{strict: mode.strict})
+		return err
+	})
+	if err != nil {
+		o.Logger.Warn("tasklocker: pause failed", "key", keys.task(postfix), "error", err)
+		return false, err
+	}
+	o.Logger.Debug("tasklocker: lock paused", "key", keys.task(postfix), "paused", paused)
+	if paused {
+		o.Metrics.IncReleased(keys.prefix)
+	}
+	return paused, nil
+}
+
+// ResumeLock re-acquires a task paused with PauseLock, like Acquire: the limit (and every option checked
+// by the acquire script) applies, and on success the marker becomes the task key again, with the timeout
+// of opts and the fields it kept, and the slot is taken. The lock holds the owner id of the marker, or the
+// WithOwner owner id, in which case only a task paused by that owner resumes.
+// When the limit is reached, it returns (nil, false, nil) and the task stays paused, or with WithRetry it
+// waits for a slot like Acquire, until the backoff gives up (ErrAcquireTimeout) or ctx is done. It returns
+// an error wrapping ErrNotPaused when the key is missing, held or was released, and ErrLockExists when it
+// is paused by another owner.
+// Parameters:
+// - ctx: The context for the Redis operations and the wait, also used by Unlock.
+// - client: The Redis client instance.
+// - prefix: The prefix for the task key.
+// - postfix: The unique identifier for the task (e.g., task id).
+// - opts: The options, e.g. WithLimit, WithTimeout, WithOwner or WithRetry.
+func ResumeLock(ctx context.Context, client redis.UniversalClient, prefix, postfix string, opts ...Option) (*Lock, bool, error) {
+	o := newPrefixOptions(prefix, opts)
+	if o.FencingToken || o.Pending > 0 || o.Reentrant || o.ExtendOwned || o.RefreshExisting {
+		return nil, false, fmt.Errorf("%w: ResumeLock can't be combined with fencing tokens, pending locks or owned modes", ErrInvalidOption)
+	}
+	if o.Owner == "" {
+		// Resume under the owner id kept by the marker, the acquire script checks it again atomically
+		if err := o.validateKey(prefix, postfix); err != nil {
+			return nil, false, err
+		}
+		key := o.keyspace(prefix).task(postfix)
+		opCtx, cancel := o.opContext(ctx)
+		values, err := o.clientFor(prefix, client).HMGet(opCtx, key, "paused", "value").Result()
+		cancel()
+		if err != nil && !strings.HasPrefix(err.Error(), "WRONGTYPE") {
+			return nil, false, wrapRedisError("read paused marker", err)
+		}
+		var owner string
+		if err == nil && values[0] == "1" {
+			owner, _ = values[1].(string)
+		}
+		if owner == "" {
+			return nil, false, fmt.Errorf("%w: %q", ErrNotPaused, key)
+		}
+		o.Owner = owner
+	}
+	o.resume = true
+	reply, err := acquire(ctx, client, prefix, postfix, o)
+	if err == nil && reply.exists {
+		err = fmt.Errorf("%w: %q is paused by another owner", ErrLockExists, o.keyspace(prefix).task(postfix))
+	}
+	return reply.lock, reply.lock != nil, err
+}
@@ -0,0 +1,235 @@
+package tasklocker
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Pool is one of the pools a task acquired by AcquireInPools counts towards, e.g. a CPU pool and a pool of
+// database connections.
+type Pool struct {
+	// Scope is the count scope of the pool, as with WithCountScope: the pool is shared by every task counting
+	// towards it, across prefixes, whether acquired by AcquireInPools or by Acquire with WithCountScope.
+	Scope string
+	// Limit is the maximum number of units in use in the pool, or Unlimited.
+	Limit int
+}
+
+// poolKeyspaces returns the keyspaces of the pools for the prefix, after checking them: every pool needs a scope,
+// given once, and a limit the weight fits in.
+func poolKeyspaces(prefix, postfix string, pools []Pool, o *Options, opts []Option) ([]keyspace, error) {
+	if len(pools) == 0 {
+		return nil, fmt.Errorf("%w: no pools to count towards", ErrInvalidOption)
+	}
+	keys := make([]keyspace, 0, len(pools))
+	seen := make(map[string]struct{}, len(pools))
+	for _, pool := range pools {
+		if pool.Scope == "" {
+			return nil, fmt.Errorf("%w: pool scope must not be empty", ErrInvalidOption)
+		}
+		if _, ok := seen[pool.Scope]; ok {
+			return nil, fmt.Errorf("%w: pool %q is given twice", ErrInvalidOption, pool.Scope)
+		}
+		seen[pool.Scope] = struct{}{}
+		if pool.Limit <= 0 && pool.Limit != Unlimited {
+			return nil, fmt.Errorf("%w: limit of pool %q must be positive or Unlimited, got %d", ErrInvalidLimit, pool.Scope, pool.Limit)
+		}
+		if o.Weight > pool.Limit && pool.Limit != Unlimited {
+			return nil, fmt.Errorf("%w: weight must be between 1 and the limit %d of pool %q, got %d", ErrInvalidWeight, pool.Limit, pool.Scope, o.Weight)
+		}
+		po := newPrefixOptions(prefix, append(opts[:len(opts):len(opts)], WithCountScope(pool.Scope)))
+		if err := po.validateKey(prefix, postfix); err != nil {
+			return nil, err
+		}
+		keys = append(keys, po.keyspace(prefix))
+	}
+	return keys, nil
+}
+
+// AcquireInPools acquires a lock counting towards several pools at once, each with its own limit, for a task
+// consuming the capacity of all of them, e.g. a worker slot and a database connection. A single atomic script
+// checks that the weight of the task fits in every pool before reserving it in all of them, so a task never
+// holds some of its pools while waiting for the others, which could deadlock the tasks holding the rest.
+// It returns the lock, whose Unlock releases it from every pool and whose Refresh moves the expiry of all its
+// reservations, or nil and the key that blocked the acquisition: the task key when it exists, or the active set
+// key of the pool whose limit is reached. Release it without the handle with ReleaseInPools.
+// WithLimit and WithCountScope are replaced by the pools; WithOwner (a random UUID by default), WithTimeout,
+// WithWeight, the key options and the operation timeouts are used. On Redis Cluster, the task key and
+// every pool must hash to the same slot (see HashTag).
+// Parameters:
+// - ctx: The context for the Redis operations, also used by Unlock.
+// - client: The Redis client instance.
+// - prefix: The prefix for the task key.
+// - postfix: The unique identifier for the task (e.g., task id).
+// - pools: The pools the task counts towards.
+// - opts: Further options, e.g. WithOwner, WithTimeout or WithWeight.
+func AcquireInPools(ctx context.Context, client redis.UniversalClient, prefix, postfix string, pools []Pool, opts ...Option) (*Lock, string, error) {
+	o := newPrefixOptions(prefix, opts)
+	client = o.clientFor(prefix, client)
+	o.Limit, o.CountScope = Unlimited, ""
+	if err := o.validate(prefix, postfix); err != nil {
+		return nil, "", err
+	}
+	poolKeys, err := poolKeyspaces(prefix, postfix, pools, o, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	if o.Owner == "" {
+		owner, err := o.newOwner()
+		if err != nil {
+			return nil, "", err
+		}
+		o.Owner = owner
+	}
+
+	keys := o.keyspace(prefix)
+	key := keys.task(postfix)
+	var ttl int64 // 0 for NoExpiry
+	if o.Timeout != NoExpiry {
+		ttl = formatMs(o.Timeout)
+	}
+	scriptKeys := []string{key}
+	args := []any{o.Owner, o.Weight, ttl}
+	for i, pk := range poolKeys {
+		scriptKeys = append(scriptKeys, pk.active())
+		args = append(args, pk.member(postfix), pools[i].Limit)
+	}
+
+	opCtx, cancel := o.opContext(ctx)
+	defer cancel()
+	var reply []int64
+	err = o.retryTransient(opCtx, func(ctx context.Context) error {
+		var err error
+		reply, err = runScript(ctx, client, poolAcquireScript, scriptKeys, args...).Int64Slice()
+		return err
+	})
+	if err != nil {
+		err = wrapRedisError("run pool acquire script", err)
+		o.Logger.Warn("tasklocker: acquire in pools failed", "key", key, "pools", len(pools), "error", err)
+		return nil, "", err
+	}
+
+	switch status, index := reply[0], int(reply[1]); status {
+	case statusAcquired:
+		o.Logger.Debug("tasklocker: lock acquired in pools", "key", key, "pools", len(pools), "owner", o.Owner)
+		o.Metrics.IncAcquired(keys.prefix)
+		lock := &Lock{ctx: ctx, client: client, keys: keys, postfix: postfix, key: key, owner: o.Owner, attempts: 1, acquiredAt: o.Clock(), clock: o.Clock, onHoldTime: o.OnHoldTime, opTimeout: o.OpTimeout, opDefault: o.DefaultOpTimeout}
+		lock.funcs = &lockFuncs{
+			unlock: func() error {
+				ctx, cancel := withOpTimeout(ctx, o.OpTimeout, o.DefaultOpTimeout)
+				defer cancel()
+				_, err := releasePools(ctx, client, keys, postfix, poolKeys, o.Owner, o)
+				return err
+			},
+			refresh: func(timeout time.Duration) (bool, error) {
+				ctx, cancel := withOpTimeout(ctx, o.OpTimeout, o.DefaultOpTimeout)
+				defer cancel()
+				return refreshPools(ctx, client, keys, postfix, poolKeys, o.Owner, timeout, o)
+			},
+		}
+		return lock, "", nil
+	case statusExists:
+		o.Logger.Debug("tasklocker: key exists", "key", key)
+		o.Metrics.IncDuplicate(keys.prefix)
+		return nil, key, nil
+	case statusLimitReached:
+		blocked := poolKeys[index-1].active()
+		o.Logger.Debug("tasklocker: pool limit reached", "key", key, "pool", blocked, "limit", pools[index-1].Limit)
+		o.Metrics.IncRejected(keys.prefix)
+		return nil, blocked, nil
+	default:
+		return nil, "", fmt.Errorf("%w: pool acquire script status %d", ErrUnexpectedReply, status)
+	}
+}
+
+// ReleaseInPools releases a lock acquired by AcquireInPools, freeing its units in every pool, like the Unlock
+// of its handle. Pass the same pools. With WithOwner, the lock is only released while it still holds that
+// owner id; with WithNotify, the WaitForSlot callers of every pool are woken up.
+// It returns true when the lock was released, false when the key was missing or held by another owner, or
+// with WithStrictRelease ErrLockNotHeld and ErrStaleLock.
+// Parameters:
+// - ctx: The context for the Redis operations.
+// - client: The Redis client instance.
+// - prefix: The prefix for the task key.
+// - postfix: The unique identifier for the task (e.g., task id).
+// - pools: The pools the task counts towards.
+// - opts: Further options, e.g. WithOwner, WithNotify or WithStrictRelease.
+func ReleaseInPools(ctx context.Context, client redis.UniversalClient, prefix, postfix string, pools []Pool, opts ...Option) (bool, error) {
+	o := newPrefixOptions(prefix, opts)
+	client = o.clientFor(prefix, client)
+	o.CountScope = ""
+	if err := o.validateKey(prefix, postfix); err != nil {
+		return false, err
+	}
+	poolKeys, err := poolKeyspaces(prefix, postfix, pools, o, opts)
+	if err != nil {
+		return false, err
+	}
+	opCtx, cancel := o.opContext(ctx)
+	defer cancel()
+	return releasePools(opCtx, client, o.keyspace(prefix), postfix, poolKeys, o.Owner, o)
+}
+
+// releasePools runs the pool release script for the postfix, freeing its units in the pools.
+func releasePools(ctx context.Context, client redis.UniversalClient, keys keyspace, postfix string, poolKeys []keyspace, owner string, o *Options) (bool, error) {
+	key := keys.task(postfix)
+	scriptKeys := []string{key}
+	args := []any{owner}
+	for _, pk := range poolKeys {
+		var channel string
+		if o.Notify {
+			channel = pk.freed()
+		}
+		scriptKeys = append(scriptKeys, pk.active())
+		args = append(args, pk.member(postfix), channel)
+	}
+	var released int
+	err := o.retryTransient(ctx, func(ctx context.Context) error {
+		var err error
+		released, err = runScript(ctx, client, poolReleaseScript, scriptKeys, args...).Int()
+		return err
+	})
+	if err != nil {
+		err = wrapRedisError("run pool release script", err)
+		o.Logger.Warn("tasklocker: release from pools failed", "key", key, "error", err)
+		return false, err
+	}
+	o.Logger.Debug("tasklocker: lock released from pools", "key", key, "released", released == 1)
+	switch {
+	case released == 1:
+		o.Metrics.IncReleased(keys.prefix)
+		return true, nil
+	case o.StrictRelease && released == 0:
+		return false, fmt.Errorf("%w: %q", ErrLockNotHeld, key)
+	case o.StrictRelease:
+		return false, fmt.Errorf("%w: %q is held by another owner", ErrStaleLock, key)
+	}
+	return false, nil
+}
+
+// refreshPools runs the pool refresh script for the postfix, moving the expiry of its units in the pools.
+func refreshPools(ctx context.Context, client redis.UniversalClient, keys keyspace, postfix string, poolKeys []keyspace, owner string, timeout time.Duration, o *Options) (bool, error) {
+	if timeout <= 0 {
+		// PEXPIRE with a non-positive TTL would delete the key instead of extending it
+		return false, fmt.Errorf("%w: refresh timeout must be positive, got %s", ErrInvalidTimeout, timeout)
+	}
+	scriptKeys := []string{keys.task(postfix)}
+	args := []any{formatMs(timeout), owner}
+	for _, pk := range poolKeys {
+		scriptKeys = append(scriptKeys, pk.active())
+		args = append(args, pk.member(postfix))
+	}
+	var refreshed int
+	err := o.retryTransient(ctx, func(ctx context.Context) error {
+		var err error
+		refreshed, err = runScript(ctx, client, poolRefreshScript, scriptKeys, args...).Int()
+		return err
+	})
+	if err != nil {
+		return false, wrapRedisError("run pool refresh script", err)
+	}
+	return refreshed == 1, nil
+}
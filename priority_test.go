@@ -0,0 +1,39 @@
+package tasklocker_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/youssefsiam38/tasklocker"
+)
+
+func TestReservedSlots(t *testing.T) {
+	_, client := newRedis(t)
+	ctx := context.Background()
+	opts := []tasklocker.Option{tasklocker.WithLimit(3), tasklocker.WithReservedSlots(1, 1), tasklocker.WithTimeout(time.Minute)}
+
+	for _, postfix := range []string{"1", "2", "3"} {
+		_, acquired, _, err := tasklocker.Acquire(ctx, client, "jobs", postfix, opts...)
+		if err != nil || acquired != (postfix != "3") {
+			t.Fatalf("Acquire(%s) at priority 0 = %v, %v", postfix, acquired, err)
+		}
+	}
+	// The reserved slot is left to priority 1
+	_, acquired, _, err := tasklocker.Acquire(ctx, client, "jobs", "3", append(opts, tasklocker.WithPriority(1))...)
+	if err != nil || !acquired {
+		t.Fatalf("Acquire(3) at priority 1 = %v, %v, want acquired", acquired, err)
+	}
+}
+
+func TestReservedSlotsAboveLimit(t *testing.T) {
+	_, client := newRedis(t)
+	ctx := context.Background()
+
+	// The slots reserved above priority 0 exceed the limit: no capacity, rather than no limit
+	_, acquired, _, err := tasklocker.Acquire(ctx, client, "jobs", "1", tasklocker.WithLimit(2), tasklocker.WithReservedSlots(1, 3))
+	if !errors.Is(err, tasklocker.ErrInvalidLimit) || acquired {
+		t.Fatalf("Acquire = %v, %v, want ErrInvalidLimit", acquired, err)
+	}
+}
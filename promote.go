@@ -0,0 +1,75 @@
+package tasklocker
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Promote makes a lock acquired with WithPending active: its task starts counting towards the limit and
+// its TTL is set to the WithTimeout duration (or the WithDeadline time), in a single atomic script.
+// It returns true when the lock was promoted, and false when the limit is reached, in which case the lock
+// stays pending and Promote can be called again. An error wrapping ErrLockNotHeld is returned when the task
+// key is missing (e.g. its grace period passed), is not pending, or, with WithOwner, holds another owner.
+// Parameters:
+// - ctx: The context for the Redis operations.
+// - client: The Redis client instance.
+// - prefix: The prefix for the task key.
+// - postfix: The unique identifier for the task (e.g., task id).
+// - opts: The options, e.g. WithLimit, WithTimeout and WithOwner.
+func Promote(ctx context.Context, client redis.UniversalClient, prefix, postfix string, opts ...Option) (bool, error) {
+	o := newPrefixOptions(prefix, opts)
+	client = o.clientFor(prefix, client)
+	if err := o.validate(prefix, postfix); err != nil {
+		return false, err
+	}
+	return promote(ctx, client, o.keyspace(prefix), postfix, o.Owner, o)
+}
+
+// Promote makes the pending lock active like the package-level Promote, with the limit and timeout of opts,
+// using the owner of the handle.
+func (l *Lock) Promote(opts ...Option) (bool, error) {
+	if l.funcs != nil {
+		return false, nil // see NewLock
+	}
+	o := newOptions(append([]Option{WithOpTimeout(l.opTimeout), WithDefaultOpTimeout(l.opDefault)}, opts...))
+	if err := o.validate(l.keys.prefix, l.postfix); err != nil {
+		return false, err
+	}
+	return promote(l.ctx, l.client, l.keys, l.postfix, l.owner, o)
+}
+
+// promote runs promoteScript for the postfix, checking the value against owner (if not empty).
+func promote(ctx context.Context, client redis.UniversalClient, keys keyspace, postfix, owner string, o *Options) (bool, error) {
+	var ttl, expireAt int64 // 0 for NoExpiry
+	if o.Timeout != NoExpiry {
+		ttl = formatMs(o.jitteredTimeout())
+	}
+	if !o.Deadline.IsZero() {
+		expireAt = o.Deadline.UnixMilli()
+	}
+
+	var reply []int64
+	err := o.retryTransient(ctx, func(ctx context.Context) error {
+		var err error
+		reply, err = runScript(ctx, client, promoteScript, []string{keys.task(postfix), keys.active()}, keys.member(postfix), owner, o.limit(), ttl, expireAt).Int64Slice()
+		return err
+	})
+	if err != nil {
+		return false, wrapRedisError("run promote script", err)
+	}
+	status, active := reply[0], reply[1]
+	switch status {
+	case statusAcquired:
+		o.Logger.Debug("tasklocker: lock promoted", "key", keys.task(postfix), "active", active, "limit", o.Limit)
+		o.Metrics.ObserveActive(keys.prefix, int(active))
+		return true, nil
+	case statusLimitReached:
+		o.Logger.Debug("tasklocker: limit reached", "key", keys.task(postfix), "active", active, "limit", o.limit())
+		o.Metrics.ObserveActive(keys.prefix, int(active))
+		return false, nil
+	default:
+		return false, fmt.Errorf("%w: %q is not a pending lock", ErrLockNotHeld, keys.task(postfix))
+	}
+}
@@ -0,0 +1,216 @@
+package tasklocker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redlockDriftFactor is the fraction of the TTL subtracted from the validity of a Redlock lock to account
+// for the clock drift between the nodes, on top of redlockDriftMin.
+const (
+	redlockDriftFactor = 0.01
+	redlockDriftMin    = 2 * time.Millisecond
+)
+
+// Redlock acquires locks with the Redlock algorithm across independent Redis nodes (not replicas of each
+// other), so a lock survives the loss of a minority of them: a lock is held once its key is set on a quorum
+// of nodes within its TTL. It only provides mutual exclusion per key: the concurrency limit, weights,
+// metadata and the other acquisition features of the package do not apply.
+// Build it with NewRedlock. It is safe for concurrent use.
+type Redlock struct {
+	clients []redis.UniversalClient
+	quorum  int
+	o       *Options
+}
+
+// RedlockLock is a lock held by Redlock.Acquire, released with Redlock.Release.
+type RedlockLock struct {
+	key      string
+	owner    string
+	validity time.Duration
+}
+
+// Key returns the task key of the lock, set on the nodes of the quorum.
+func (l *RedlockLock) Key() string {
+	return l.key
+}
+
+// Owner returns the random owner id stored in the key, which Release checks before deleting it.
+func (l *RedlockLock) Owner() string {
+	return l.owner
+}
+
+// Validity returns how long the lock was known to be held when Acquire returned: the TTL minus the time the
+// acquisition took and an allowance for the clock drift. The work must be done within it, since the key
+// may be acquired by someone else on a quorum of nodes afterwards.
+func (l *RedlockLock) Validity() time.Duration {
+	return l.validity
+}
+
+// NewRedlock returns a Redlock acquiring on the given nodes, e.g. *redis.Client instances of independent
+// servers. A quorum of 0 means a majority of the nodes; otherwise it must be a majority, and at most the
+// number of nodes, or ErrInvalidQuorum is returned.
+// Parameters:
+// - clients: The Redis clients of the nodes.
+// - quorum: The number of nodes the key must be set on, 0 for a majority.
+// - opts: The options, e.g. WithTimeout (the TTL of the locks), WithRetry or WithOpTimeout.
+func NewRedlock(clients []redis.UniversalClient, quorum int, opts ...Option) (*Redlock, error) {
+	if len(clients) == 0 {
+		return nil, fmt.Errorf("%w: no redis nodes", ErrInvalidQuorum)
+	}
+	if quorum == 0 {
+		quorum = len(clients)/2 + 1
+	}
+	if quorum <= len(clients)/2 || quorum > len(clients) {
+		// A quorum not above half of the nodes would let two callers hold the same key
+		return nil, fmt.Errorf("%w: quorum must be between %d and %d, got %d", ErrInvalidQuorum, len(clients)/2+1, len(clients), quorum)
+	}
+	o := newOptions(opts)
+	if o.Timeout <= 0 {
+		return nil, fmt.Errorf("%w: redlock timeout must be positive, got %s", ErrInvalidTimeout, o.Timeout)
+	}
+	return &Redlock{clients: clients, quorum: quorum, o: o}, nil
+}
+
+// Acquire tries to set the task key of the postfix on every node, and holds the lock when it was set on a
+// quorum of them with some validity left (see RedlockLock.Validity). Otherwise it removes the key from
+// every node it set it on, and returns false, after retrying with the backoff of WithRetry if set, or an
+// ErrAcquireTimeout error once its budget is exhausted.
+// Every node is given OpTimeout, DefaultOpTimeout, or a tenth of the TTL when unset, to answer, so a node that is
+// down does not eat the validity. An error is returned when too few nodes answered to reach the quorum.
+// Parameters:
+// - ctx: The context for the Redis operations and the waits between retries.
+// - prefix: The prefix for the task key.
+// - postfix: The unique identifier for the task (e.g., task id).
+func (r *Redlock) Acquire(ctx context.Context, prefix, postfix string) (*RedlockLock, bool, error) {
+	if err := r.o.validateKey(prefix, postfix); err != nil {
+		return nil, false, err
+	}
+	owner := r.o.Owner
+	if owner == "" {
+		var err error
+		if owner, err = r.o.newOwner(); err != nil {
+			return nil, false, err
+		}
+	}
+	lock := &RedlockLock{key: r.o.keyspace(prefix).task(postfix), owner: owner}
+
+	start := r.o.Clock()
+	for retry := 1; ; retry++ {
+		acquired, err := r.tryAcquire(ctx, lock)
+		if err != nil {
+			return nil, false, err
+		}
+		if acquired {
+			return lock, true, nil
+		}
+		if r.o.Retry == nil {
+			return nil, false, nil
+		}
+
+		// The quorum was not reached, wait before trying again unless the retry budget is exhausted
+		delay := r.o.Retry.delay(retry)
+		if r.o.Retry.exhausted(retry, r.o.Clock().Sub(start)+delay) {
+			return nil, false, fmt.Errorf("%w: redlock quorum not reached after %d attempts in %s", ErrAcquireTimeout, retry, r.o.Clock().Sub(start).Round(time.Millisecond))
+		}
+		if r.o.OnRetry != nil {
+			r.o.OnRetry(retry, 0)
+		}
+		if err := sleep(ctx, delay); err != nil {
+			return nil, false, err
+		}
+	}
+}
+
+// Release deletes the key of the lock from every node where it still holds the owner id of the lock,
+// so a key acquired by someone else after the lock expired is left alone. The errors of the nodes that
+// could not be reached are joined; the lock is released on the others.
+func (r *Redlock) Release(ctx context.Context, lock *RedlockLock) error {
+	errs := r.broadcast(ctx, func(ctx context.Context, client redis.UniversalClient) error {
+		return runScript(ctx, client, redlockReleaseScript, []string{lock.key}, lock.owner).Err()
+	})
+	if err := errors.Join(errs...); err != nil {
+		return wrapRedisError("release redlock", err)
+	}
+	return nil
+}
+
+// tryAcquire makes a single attempt at setting the key of the lock on a quorum of nodes,
+// and unwinds it when the quorum or the validity is missing.
+func (r *Redlock) tryAcquire(ctx context.Context, lock *RedlockLock) (bool, error) {
+	start := time.Now()
+	var (
+		mu  sync.Mutex
+		set int
+	)
+	errs := r.broadcast(ctx, func(ctx context.Context, client redis.UniversalClient) error {
+		ok, err := client.SetNX(ctx, lock.key, lock.owner, r.o.Timeout).Result()
+		if ok {
+			mu.Lock()
+			set++
+			mu.Unlock()
+		}
+		return err
+	})
+
+	drift := time.Duration(float64(r.o.Timeout)*redlockDriftFactor) + redlockDriftMin
+	lock.validity = r.o.Timeout - time.Since(start) - drift
+	if set >= r.quorum && lock.validity > 0 {
+		r.o.Logger.Debug("tasklocker: redlock acquired", "key", lock.key, "nodes", set, "validity", lock.validity)
+		return true, nil
+	}
+
+	// Remove the key from the nodes it was set on, so the next attempt, or another caller, can reach the quorum.
+	// The unwind is not canceled with ctx, which is typically done when the quorum was missed by a timeout
+	releaseCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), releaseTimeout)
+	defer cancel()
+	if err := r.Release(releaseCtx, lock); err != nil {
+		r.o.Logger.Warn("tasklocker: failed to unwind redlock", "key", lock.key, "error", err)
+	}
+
+	failed := make([]error, 0, len(errs))
+	for _, err := range errs {
+		if err != nil {
+			failed = append(failed, err)
+		}
+	}
+	if len(r.clients)-len(failed) < r.quorum {
+		return false, wrapRedisError("acquire redlock", errors.Join(failed...))
+	}
+	return false, nil
+}
+
+// broadcast runs op on every node concurrently, each with its own operation timeout,
+// and returns the error of every node, nil for the ones that succeeded.
+func (r *Redlock) broadcast(ctx context.Context, op func(ctx context.Context, client redis.UniversalClient) error) []error {
+	timeout := r.o.OpTimeout
+	if timeout <= 0 {
+		timeout = r.o.DefaultOpTimeout
+	}
+	if timeout <= 0 {
+		timeout = r.o.Timeout / 10
+	}
+	errs := make([]error, len(r.clients))
+	var wg sync.WaitGroup
+	for i, client := range r.clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			nodeCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			err := op(nodeCtx, client)
+			if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+				// The node timed out, not the caller
+				err = fmt.Errorf("%w: node did not answer within %s", ErrRedisUnavailable, timeout)
+			}
+			errs[i] = err
+		}()
+	}
+	wg.Wait()
+	return errs
+}
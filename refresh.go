@@ -0,0 +1,72 @@
+package tasklocker
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Refresh resets the TTL of a lock to the WithTimeout duration (DefaultTimeout by default), so a task
+// running longer than its original timeout keeps its slot. With WithOwner, the TTL is only reset
+// while the key still holds that owner id.
+// It returns true when the TTL was reset and false when the lock was lost (the key expired or is owned by someone else).
+// Parameters:
+// - ctx: The context for the Redis operations.
+// - client: The Redis client instance.
+// - prefix: The prefix for the task key.
+// - postfix: The unique identifier for the task (e.g., task id).
+// - opts: The options, e.g. WithTimeout or WithOwner.
+func Refresh(ctx context.Context, client redis.UniversalClient, prefix, postfix string, opts ...Option) (bool, error) {
+	o := newPrefixOptions(prefix, opts)
+	client = o.clientFor(prefix, client)
+	if err := o.validateKey(prefix, postfix); err != nil {
+		return false, err
+	}
+	if o.Backend != nil {
+		if o.Timeout <= 0 {
+			return false, fmt.Errorf("%w: timeout must be positive, got %s", ErrInvalidTimeout, o.Timeout)
+		}
+		lock := o.backendLock(o.keyspace(prefix), postfix, o.Owner)
+		lock.Expiry = o.Clock().Add(o.Timeout)
+		ctx, cancel := o.opContext(ctx)
+		defer cancel()
+		return o.Backend.Refresh(ctx, lock)
+	}
+	var refreshed bool
+	err := o.retryTransient(ctx, func(ctx context.Context) error {
+		var err error
+		refreshed, err = refresh(ctx, client, o.keyspace(prefix), postfix, o.Timeout, o.Owner, o.MaxLifetime)
+		return err
+	})
+	return refreshed, err
+}
+
+// RefreshLock resets the TTL of the lock to newTimeout if the key still exists.
+// Call it periodically as a heartbeat for tasks that may run longer than their timeout.
+// It returns true when the TTL was reset and false when the lock was already lost.
+// Parameters:
+// - ctx: The context for the Redis operations.
+// - client: The Redis client instance.
+// - prefix: The prefix for the task key.
+// - postfix: The unique identifier for the task (e.g., task id).
+// - newTimeout: The new duration after which the lock should be automatically released.
+// - opts: Further options, e.g. WithMaxLifetime to stop refreshing a lock held for too long.
+func RefreshLock(ctx context.Context, client redis.UniversalClient, prefix, postfix string, newTimeout time.Duration, opts ...Option) (bool, error) {
+	return Refresh(ctx, client, prefix, postfix, append([]Option{WithTimeout(newTimeout)}, opts...)...)
+}
+
+// refresh runs refreshScript, resetting the TTL of the task key when it exists and holds owner (if not empty),
+// without letting it live beyond maxLifetime (if positive) since it was acquired.
+func refresh(ctx context.Context, client redis.UniversalClient, keys keyspace, postfix string, timeout time.Duration, owner string, maxLifetime time.Duration) (bool, error) {
+	if timeout <= 0 {
+		// PEXPIRE with a non-positive TTL would delete the key instead of extending it
+		return false, fmt.Errorf("%w: timeout must be positive, got %s", ErrInvalidTimeout, timeout)
+	}
+	refreshed, err := runScript(ctx, client, refreshScript, []string{keys.task(postfix), keys.active()}, formatMs(timeout), owner, keys.member(postfix), formatMs(maxLifetime)).Int()
+	if err != nil {
+		return false, wrapRedisError("run refresh script", err)
+	}
+	return refreshed == 1, nil
+}
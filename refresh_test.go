@@ -0,0 +1,109 @@
+package tasklocker_test
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/youssefsiam38/tasklocker"
+)
+
+func TestSubSecondTimeout(t *testing.T) {
+	mr, client := newRedis(t)
+	ctx := context.Background()
+	now := time.Now()
+	mr.SetTime(now)
+
+	if acquired, _, err := tasklocker.AcquireLock(ctx, client, "jobs", "1", 1, 250*time.Millisecond); err != nil || !acquired {
+		t.Fatalf("AcquireLock = %v, %v, want acquired", acquired, err)
+	}
+	if ttl := mr.TTL("jobs:1"); ttl != 250*time.Millisecond {
+		t.Fatalf("TTL = %s, want 250ms", ttl)
+	}
+	advance(mr, &now, 300*time.Millisecond)
+	if mr.Exists("jobs:1") {
+		t.Fatal("the 250ms key still exists after 300ms")
+	}
+	if acquired, exists, err := tasklocker.AcquireLock(ctx, client, "jobs", "2", 1, 250*time.Millisecond); err != nil || !acquired || exists {
+		t.Fatalf("AcquireLock after expiry = %v, %v, %v, want acquired", acquired, exists, err)
+	}
+}
+
+func TestRefreshSubMillisecond(t *testing.T) {
+	mr, client := newRedis(t)
+	ctx := context.Background()
+
+	lock, acquired, _, err := tasklocker.Acquire(ctx, client, "jobs", "1", tasklocker.WithTimeout(time.Minute))
+	if err != nil || !acquired {
+		t.Fatalf("Acquire = %v, %v, want acquired", acquired, err)
+	}
+	// Truncated to PEXPIRE 0, the refresh would delete the key
+	if refreshed, err := lock.Refresh(500 * time.Microsecond); err != nil || !refreshed {
+		t.Fatalf("Refresh(500µs) = %v, %v, want refreshed", refreshed, err)
+	}
+	if !mr.Exists("jobs:1") {
+		t.Fatal("Refresh(500µs) deleted the key")
+	}
+	if ttl := mr.TTL("jobs:1"); ttl != time.Millisecond {
+		t.Fatalf("TTL = %s, want 1ms", ttl)
+	}
+}
+
+func TestRenewAtCapacity(t *testing.T) {
+	mr, client := newRedis(t)
+	ctx := context.Background()
+	opts := []tasklocker.Option{tasklocker.WithLimit(2), tasklocker.WithTimeout(time.Minute), tasklocker.WithOwner("worker")}
+	for _, postfix := range []string{"1", "2"} {
+		if _, acquired, _, err := tasklocker.Acquire(ctx, client, "jobs", postfix, opts...); err != nil || !acquired {
+			t.Fatalf("Acquire(%s) = %v, %v, want acquired", postfix, acquired, err)
+		}
+	}
+
+	// The prefix is exactly at its limit: renewing either lock must not count it against itself
+	for name, opt := range map[string]tasklocker.Option{
+		"WithRefreshExisting": tasklocker.WithRefreshExisting(),
+		"WithExtendOwned":     tasklocker.WithExtendOwned(),
+	} {
+		_, acquired, exists, err := tasklocker.Acquire(ctx, client, "jobs", "1", append(opts, opt)...)
+		if err != nil || !acquired {
+			t.Fatalf("Acquire(1, %s) = %v, %v, %v, want acquired", name, acquired, exists, err)
+		}
+	}
+	if refreshed, err := tasklocker.RefreshLock(ctx, client, "jobs", "1", time.Minute); err != nil || !refreshed {
+		t.Fatalf("RefreshLock(1) = %v, %v, want refreshed", refreshed, err)
+	}
+	// The key deleted by hand leaves its member in the active set, which is dropped on re-acquiring
+	mr.Del("jobs:1")
+	if _, acquired, _, err := tasklocker.Acquire(ctx, client, "jobs", "1", opts...); err != nil || !acquired {
+		t.Fatalf("Acquire(1) after its key was deleted = %v, %v, want acquired", acquired, err)
+	}
+	if n, err := client.ZCard(ctx, "jobs:__active").Result(); err != nil || n != 2 {
+		t.Fatalf("ZCARD jobs:__active = %d, %v, want 2", n, err)
+	}
+}
+
+func TestTimeoutJitterOutOfRange(t *testing.T) {
+	mr, client := newRedis(t)
+	ctx := context.Background()
+	for _, fraction := range []float64{1, 3, -0.1} {
+		_, acquired, _, err := tasklocker.Acquire(ctx, client, "jobs", "1", tasklocker.WithTimeout(time.Minute), tasklocker.WithTimeoutJitter(fraction))
+		if !errors.Is(err, tasklocker.ErrInvalidTimeout) || acquired {
+			t.Fatalf("Acquire(WithTimeoutJitter(%g)) = %v, %v, want ErrInvalidTimeout", fraction, acquired, err)
+		}
+	}
+	if mr.Exists("jobs:1") {
+		t.Fatal("a rejected acquisition wrote the task key")
+	}
+	// Within range, the TTL stays within ±fraction of the timeout
+	for i := 0; i < 20; i++ {
+		postfix := strconv.Itoa(i)
+		if _, acquired, _, err := tasklocker.Acquire(ctx, client, "jobs", postfix, tasklocker.WithLimit(20), tasklocker.WithTimeout(time.Minute), tasklocker.WithTimeoutJitter(0.5)); err != nil || !acquired {
+			t.Fatalf("Acquire(%s) = %v, %v, want acquired", postfix, acquired, err)
+		}
+		if ttl := mr.TTL("jobs:" + postfix); ttl < 30*time.Second || ttl > 90*time.Second {
+			t.Fatalf("TTL = %s, want within 30s and 90s", ttl)
+		}
+	}
+}
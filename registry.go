@@ -0,0 +1,70 @@
+package tasklocker
+
+import (
+	"sync"
+	"time"
+)
+
+// registry holds the options registered per prefix with Register, and the package-wide guardrails.
+var registry = struct {
+	mu         sync.RWMutex
+	prefixes   map[string][]Option
+	required   bool
+	minTimeout time.Duration // the package-wide floor of the timeouts, see SetMinTimeout
+}{prefixes: make(map[string][]Option)}
+
+// Register sets the default options of the prefix, e.g. its limit, timeout and separator, so they are
+// configured once at startup instead of being threaded through every call. Every function taking the prefix
+// applies them first, before its own arguments and options, which take precedence: Acquire(ctx, client,
+// prefix, postfix) uses the registered limit, while the allowedConcurrentTasks argument of AcquireLock
+// overrides it. Registering a prefix again replaces its options. It is safe for concurrent use, but is
+// meant to be called before the prefix is used.
+// Parameters:
+// - prefix: The prefix for the task keys, as passed to the other functions (before WithHashTag applies).
+// - opts: The default options of the prefix.
+func Register(prefix string, opts ...Option) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	registry.prefixes[prefix] = append([]Option(nil), opts...)
+}
+
+// Unregister removes the options registered for the prefix with Register.
+func Unregister(prefix string) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	delete(registry.prefixes, prefix)
+}
+
+// RequireRegistered makes the functions taking a prefix fail with ErrUnregisteredPrefix when no options are
+// registered for it, so a misspelled prefix or a forgotten Register surfaces instead of running with the
+// global defaults. It is off by default, for the callers not using Register.
+func RequireRegistered(required bool) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	registry.required = required
+}
+
+// SetMinTimeout sets a package-wide floor for the lock timeouts: the acquire functions then reject a timeout
+// below it with ErrTimeoutTooShort, whatever the prefix, as a guardrail against a timeout much shorter than
+// the tasks, whose locks would keep expiring while they run. WithMinTimeout can raise the floor of a call or
+// a prefix, but not lower it. NoExpiry is always allowed. 0, the default, sets no floor.
+func SetMinTimeout(floor time.Duration) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	registry.minTimeout = floor
+}
+
+// newPrefixOptions applies the options registered for the prefix, then opts, on top of the defaults.
+// The package-wide floor of the timeouts applies over them.
+func newPrefixOptions(prefix string, opts []Option) *Options {
+	registry.mu.RLock()
+	registered, ok := registry.prefixes[prefix]
+	required := registry.required
+	minTimeout := registry.minTimeout
+	registry.mu.RUnlock()
+
+	o := newOptions(append(registered[:len(registered):len(registered)], opts...))
+	o.unregistered = required && !ok
+	o.MinTimeout = max(o.MinTimeout, minTimeout)
+	return o
+}
@@ -0,0 +1,94 @@
+package tasklocker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// AutoRenew keeps a held lock alive by refreshing its TTL to timeout every timeout/3 in a background
+// goroutine, until the returned stop function is called or ctx is done.
+// The first refresh happens before AutoRenew returns, and an error is returned if the lock is not held.
+// When a later refresh finds that the lock was lost, renewal stops and the WithOnLostLock callback
+// is invoked so the caller can abort its work. Redis errors are retried at the next interval.
+// With WithMaxLifetime, the lock is not renewed beyond that age: the last renewal lets it expire at the
+// cap, and the next one finds the lock lost.
+// With WithOwner, the lock is only renewed while the key still holds that owner id.
+// The stop function waits for the goroutine to exit and is safe to call more than once.
+// To also get a channel closed on loss, renew a Lock handle with its AutoRenew method and select on Lost.
+// Parameters:
+// - ctx: The context for the Redis operations; renewal stops when it is done.
+// - client: The Redis client instance.
+// - prefix: The prefix for the task key.
+// - postfix: The unique identifier for the task (e.g., task id).
+// - timeout: The TTL set on every renewal.
+// - opts: The options, e.g. WithOwner, WithOnLostLock or WithMaxLifetime.
+func AutoRenew(ctx context.Context, client redis.UniversalClient, prefix, postfix string, timeout time.Duration, opts ...Option) (func(), error) {
+	o := newPrefixOptions(prefix, opts)
+	client = o.clientFor(prefix, client)
+	if err := o.validateKey(prefix, postfix); err != nil {
+		return nil, err
+	}
+	if timeout <= 0 {
+		return nil, fmt.Errorf("%w: renewal timeout must be positive, got %s", ErrInvalidTimeout, timeout)
+	}
+	keys := o.keyspace(prefix)
+
+	return autoRenew(ctx, timeout, func(ctx context.Context) (bool, error) {
+		refreshed, err := refresh(ctx, client, keys, postfix, timeout, o.Owner, o.MaxLifetime)
+		if err == nil && !refreshed {
+			err = fmt.Errorf("%w: %q", ErrLockNotHeld, keys.task(postfix))
+		}
+		return refreshed, err
+	}, o.OnLostLock)
+}
+
+// autoRenew implements AutoRenew: it calls renew once, returning its error, then every timeout/3 in a
+// background goroutine until the returned stop function is called or ctx is done. It stops and calls
+// onLost (if not nil) once renew fails with ErrLockNotHeld; other errors are retried at the next interval.
+func autoRenew(ctx context.Context, timeout time.Duration, renew func(context.Context) (bool, error), onLost func()) (func(), error) {
+	if _, err := renew(ctx); err != nil {
+		return nil, err
+	}
+
+	interval := timeout / 3
+	if interval <= 0 {
+		interval = timeout
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			refreshed, err := renew(ctx)
+			if !refreshed && errors.Is(err, ErrLockNotHeld) {
+				if onLost != nil {
+					onLost()
+				}
+				return
+			}
+			// Transient errors are retried at the next tick, the TTL still covers two more attempts
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			cancel()
+			<-done
+		})
+	}, nil
+}
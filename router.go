@@ -0,0 +1,49 @@
+package tasklocker
+
+import (
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Router routes each prefix to the client of the Redis logical database its task family lives in.
+// The package uses whatever database a client was created with, and go-redis connections are bound to
+// a single database, so isolating task families in different databases takes one client per database:
+//
+//	base := &redis.Options{Addr: "localhost:6379"}
+//	reports := *base
+//	reports.DB = 2
+//	router := tasklocker.NewRouter(redis.NewClient(base), map[string]redis.UniversalClient{
+//		"reports": redis.NewClient(&reports),
+//	})
+//	locker := router.Locker("reports", 5, time.Minute)
+//
+// A Router does not own the clients and never closes them. It is safe for concurrent use,
+// as long as the map passed to NewRouter is not modified afterwards.
+type Router struct {
+	fallback redis.UniversalClient
+	clients  map[string]redis.UniversalClient
+}
+
+// NewRouter returns a Router sending the prefixes of clients to their client, and every other
+// prefix to fallback.
+// Parameters:
+// - fallback: The Redis client instance used for the prefixes without a client of their own.
+// - clients: The Redis client instance of each prefix.
+func NewRouter(fallback redis.UniversalClient, clients map[string]redis.UniversalClient) *Router {
+	return &Router{fallback: fallback, clients: clients}
+}
+
+// Client returns the client of the prefix, or the fallback client when the prefix has none.
+// Pass it to the package-level functions, e.g. AcquireLock(ctx, router.Client(prefix), prefix, ...).
+func (r *Router) Client(prefix string) redis.UniversalClient {
+	if client, ok := r.clients[prefix]; ok {
+		return client
+	}
+	return r.fallback
+}
+
+// Locker returns a Locker for the prefix like New, bound to the client of the prefix.
+func (r *Router) Locker(prefix string, allowedConcurrentTasks int, timeout time.Duration, opts ...Option) *Locker {
+	return New(r.Client(prefix), prefix, allowedConcurrentTasks, timeout, opts...)
+}
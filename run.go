@@ -0,0 +1,148 @@
+package tasklocker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RunBounded runs fn for every postfix while holding its lock, so at most allowedConcurrentTasks of
+// them run at the same time across every process sharing the prefix, like an errgroup bounded by
+// the distributed limit. Every postfix is acquired with AcquireOrWait, waiting while the limit is
+// reached, then fn runs and the lock is released, even when fn fails or panics.
+// The first error (of an acquisition, fn or a release) cancels the ctx passed to the other calls of fn,
+// stops the postfixes not started yet, and is returned once every started call returned. Postfixes whose
+// key already exists are skipped, since another process is running them.
+// At most allowedConcurrentTasks goroutines run at once, so a long list of postfixes does not
+// multiply the goroutines polling Redis. The timeout must cover the run of fn, the locks are not renewed.
+// Parameters:
+// - ctx: The context for the Redis operations, the waits and the calls of fn.
+// - client: The Redis client instance.
+// - prefix: The prefix for the task keys.
+// - allowedConcurrentTasks: The maximum number of concurrent tasks allowed.
+// - timeout: The duration after which a lock should be automatically released.
+// - postfixes: The unique identifiers of the tasks to run (e.g., task ids).
+// - fn: The task, called with the postfix it runs for.
+// - opts: Further options, e.g. WithRetry to set the wait backoff.
+func RunBounded(ctx context.Context, client redis.UniversalClient, prefix string, allowedConcurrentTasks int, timeout time.Duration, postfixes []string, fn func(ctx context.Context, postfix string) error, opts ...Option) error {
+	if allowedConcurrentTasks <= 0 {
+		return fmt.Errorf("%w: allowed concurrent tasks must be positive, got %d", ErrInvalidLimit, allowedConcurrentTasks)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	slots := make(chan struct{}, allowedConcurrentTasks)
+	for _, postfix := range postfixes {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			if err := runLocked(ctx, client, prefix, postfix, allowedConcurrentTasks, timeout, fn, opts); err != nil {
+				fail(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr == nil {
+		// The parent ctx was done before every postfix could start
+		return ctx.Err()
+	}
+	return firstErr
+}
+
+// runLocked acquires the lock of the postfix for RunBounded, runs fn and releases the lock.
+// The lock is released with a context that is not canceled, since ctx is typically canceled
+// by the failure of another task, and the slot would otherwise leak until the timeout.
+func runLocked(ctx context.Context, client redis.UniversalClient, prefix, postfix string, allowedConcurrentTasks int, timeout time.Duration, fn func(ctx context.Context, postfix string) error, opts []Option) (err error) {
+	lock, err := AcquireOrWait(ctx, client, prefix, postfix, allowedConcurrentTasks, timeout, opts...)
+	if errors.Is(err, ErrLockExists) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer func() {
+		releaseCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), releaseTimeout)
+		defer cancel()
+		lock.ctx = releaseCtx
+		if unlockErr := lock.Unlock(); unlockErr != nil && err == nil {
+			err = unlockErr
+		}
+	}()
+	return fn(ctx, postfix)
+}
+
+// RunWithLock acquires the lock of the postfix and, when it was acquired, runs fn while holding it, then
+// releases it, even when fn fails or panics (the panic goes on once the lock is released), so the lock can't
+// be forgotten. The lock holds a random owner id and is released like Lock.Unlock, so a lock that expired
+// during a slow fn and was acquired by someone else is left untouched. With WithAutoRenew, the lock is renewed
+// like Lock.AutoRenew while fn runs, and the ctx passed to fn is canceled, with ErrLockNotHeld as its cause,
+// when a renewal finds the lock lost.
+// It returns whether fn ran, and the error of the acquisition, of fn, or of the release.
+// Parameters:
+// - ctx: The context for the Redis operations and the call of fn.
+// - client: The Redis client instance.
+// - prefix: The prefix for the task key.
+// - postfix: The unique identifier for the task (e.g., task id).
+// - allowedConcurrentTasks: The maximum number of concurrent tasks allowed.
+// - timeout: The duration after which the lock should be automatically released, and renewed to with WithAutoRenew.
+// - fn: The task, run while holding the lock.
+// - opts: Further options, e.g. WithAutoRenew, WithRetry or WithOnLostLock.
+func RunWithLock(ctx context.Context, client redis.UniversalClient, prefix, postfix string, allowedConcurrentTasks int, timeout time.Duration, fn func(ctx context.Context) error, opts ...Option) (ran bool, err error) {
+	opts = append([]Option{WithLimit(allowedConcurrentTasks), WithTimeout(timeout)}, opts...)
+	lock, acquired, _, err := Acquire(ctx, client, prefix, postfix, opts...)
+	if err != nil || !acquired {
+		return false, err
+	}
+	defer func() {
+		// Release with a context that is not canceled, fn typically returns because ctx is done
+		releaseCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), releaseTimeout)
+		defer cancel()
+		lock.ctx = releaseCtx
+		if unlockErr := lock.Unlock(); unlockErr != nil && err == nil {
+			err = unlockErr
+		}
+	}()
+
+	fnCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	if o := newPrefixOptions(prefix, opts); o.AutoRenew {
+		stop, err := lock.AutoRenew(timeout, WithOnLostLock(func() {
+			cancel(fmt.Errorf("%w: %q", ErrLockNotHeld, lock.Key()))
+			if o.OnLostLock != nil {
+				o.OnLostLock()
+			}
+		}))
+		if err != nil {
+			return false, err
+		}
+		defer stop() // before the release
+	}
+	return true, fn(fnCtx)
+}
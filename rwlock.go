@@ -0,0 +1,124 @@
+package tasklocker
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RWMutex is a distributed read/write lock on a task (a prefix and postfix): any number of readers
+// can hold it together, while a writer needs it exclusively. A writer is only admitted when no reader
+// holds the lock, and new readers are rejected while it holds it.
+// An RWMutex is a handle of a single holder, identified by its owner id: every process (or goroutine)
+// taking the lock creates its own with NewRWMutex. Holds expire after the WithTimeout duration
+// (DefaultTimeout by default), so the lock recovers from holders that died without unlocking.
+// The write lock uses the task key of the postfix, so IsLocked and GetLockInfo report the writer,
+// and the readers are tracked in a sorted set under prefix:__readers:postfix.
+// A writer waiting for readers to leave does not block new readers, so a steady stream of readers
+// can starve writers.
+type RWMutex struct {
+	client  redis.UniversalClient
+	keys    keyspace
+	postfix string
+	o       *Options
+}
+
+// NewRWMutex returns the handle of a holder of the read/write lock of the postfix.
+// The holder is identified by the WithOwner owner id, or by a random UUID (or the WithOwnerFunc id) when none is given.
+// With WithRetry, RLock and Lock wait with the backoff while the lock is taken instead of returning false.
+// Parameters:
+// - client: The Redis client instance.
+// - prefix: The prefix for the task key.
+// - postfix: The unique identifier for the task (e.g., task id).
+// - opts: The options, e.g. WithTimeout, WithOwner or WithRetry.
+func NewRWMutex(client redis.UniversalClient, prefix, postfix string, opts ...Option) (*RWMutex, error) {
+	o := newPrefixOptions(prefix, opts)
+	client = o.clientFor(prefix, client)
+	if err := o.validateKey(prefix, postfix); err != nil {
+		return nil, err
+	}
+	if o.Timeout <= 0 {
+		return nil, fmt.Errorf("%w: timeout must be positive, got %s", ErrInvalidTimeout, o.Timeout)
+	}
+	if o.Owner == "" {
+		owner, err := o.newOwner()
+		if err != nil {
+			return nil, err
+		}
+		o.Owner = owner
+	}
+	return &RWMutex{client: client, keys: o.keyspace(prefix), postfix: postfix, o: o}, nil
+}
+
+// Owner returns the owner id of the holder.
+func (m *RWMutex) Owner() string {
+	return m.o.Owner
+}
+
+// RLock takes a read lock, which other readers can hold at the same time.
+// It returns false when a writer holds the lock (after retrying, with WithRetry).
+// Taking the read lock again renews the hold of this holder.
+func (m *RWMutex) RLock(ctx context.Context) (bool, error) {
+	return m.lock(ctx, rlockScript, "run read lock script")
+}
+
+// RUnlock releases the read lock of this holder. It returns false when the holder did not hold it,
+// e.g. because its hold expired.
+func (m *RWMutex) RUnlock(ctx context.Context) (bool, error) {
+	ctx, cancel := m.o.opContext(ctx)
+	defer cancel()
+	n, err := m.client.ZRem(ctx, m.keys.readers(m.postfix), m.o.Owner).Result()
+	if err != nil {
+		return false, wrapRedisError("release read lock", err)
+	}
+	return n == 1, nil
+}
+
+// Lock takes the write lock, which requires that no reader nor other writer holds the lock.
+// It returns false when the lock is taken (after retrying, with WithRetry).
+func (m *RWMutex) Lock(ctx context.Context) (bool, error) {
+	return m.lock(ctx, wlockScript, "run write lock script")
+}
+
+// Unlock releases the write lock, but only while this holder still owns it. It returns false
+// when the holder did not hold it, e.g. because its hold expired.
+func (m *RWMutex) Unlock(ctx context.Context) (bool, error) {
+	ctx, cancel := m.o.opContext(ctx)
+	defer cancel()
+	n, err := runScript(ctx, m.client, wunlockScript, []string{m.keys.task(m.postfix)}, m.o.Owner).Int()
+	if err != nil {
+		return false, wrapRedisError("run write unlock script", err)
+	}
+	return n == 1, nil
+}
+
+// lock runs the read or write lock script, retrying with m.o.Retry while the lock is taken.
+func (m *RWMutex) lock(ctx context.Context, script *redis.Script, op string) (bool, error) {
+	keys := []string{m.keys.task(m.postfix), m.keys.readers(m.postfix)}
+	start := m.o.Clock()
+	for retry := 1; ; retry++ {
+		opCtx, cancel := m.o.opContext(ctx)
+		n, err := runScript(opCtx, m.client, script, keys, m.o.Owner, formatMs(m.o.Timeout)).Int()
+		cancel()
+		if err != nil {
+			return false, wrapRedisError(op, err)
+		}
+		if n == 1 || m.o.Retry == nil {
+			return n == 1, nil
+		}
+
+		// The lock is taken, wait before trying again unless the retry budget is exhausted
+		delay := m.o.Retry.delay(retry)
+		if m.o.Retry.exhausted(retry, m.o.Clock().Sub(start)+delay) {
+			return false, fmt.Errorf("%w: lock still taken after %d attempts in %s", ErrAcquireTimeout, retry, m.o.Clock().Sub(start).Round(time.Millisecond))
+		}
+		if m.o.OnRetry != nil {
+			m.o.OnRetry(retry, 0)
+		}
+		if err := sleep(ctx, delay); err != nil {
+			return false, err
+		}
+	}
+}
@@ -0,0 +1,535 @@
+package tasklocker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// defaultScanCount is the COUNT hint used by the SCAN based functions unless WithScanCount is given,
+// and the number of keys deleted per round-trip.
+const defaultScanCount = 100
+
+// CountActive returns the number of task keys currently present for the prefix, counted with an
+// iterative SCAN (never KEYS) over prefix:*, so it can be called from a /metrics handler
+// without blocking Redis. Internal keys such as prefix:__active are not counted. SCAN takes no point-in-time
+// snapshot, so under churn the count mixes keys seen at different times; WithConsistentSnapshot reconciles it.
+// With WithMaxScanIterations, a SCAN stopped by the budget returns the keys counted so far, a lower bound,
+// with an error wrapping ErrScanBudgetExceeded.
+// Parameters:
+// - ctx: The context for the Redis operations.
+// - client: The Redis client instance.
+// - prefix: The prefix for the task keys.
+// - opts: The key options, e.g. WithSeparator or WithHashTag, and WithScanCount.
+func CountActive(ctx context.Context, client redis.UniversalClient, prefix string, opts ...Option) (int, error) {
+	o := newPrefixOptions(prefix, opts)
+	client = o.clientFor(prefix, client)
+	ctx, cancel := o.opContext(ctx)
+	defer cancel()
+	if err := o.validatePrefix(prefix); err != nil {
+		return 0, err
+	}
+	keys := o.keyspace(prefix)
+	if o.Backend != nil {
+		return o.Backend.Count(ctx, keys.active())
+	}
+	patterns, err := o.countPatterns(keys)
+	if err != nil {
+		return 0, err
+	}
+	if !o.Snapshot {
+		return countKeys(ctx, client, keys, patterns, o.ScanCount, newScanBudget(o.MaxScanIterations))
+	}
+	return o.snapshotCount(ctx, client, keys, patterns)
+}
+
+// ListActive returns the postfixes (e.g. task ids) of every task key currently present for the prefix,
+// so operators can see which tasks are running. Keys are enumerated with an iterative SCAN,
+// the prefix and separator are stripped, and each postfix appears once. The order is unspecified, unless
+// WithConsistentSnapshot is given, which also drops the keys deleted while the SCAN ran and sorts the postfixes.
+// Internal keys such as prefix:__active are not listed. A SCAN stopped by WithMaxScanIterations returns the
+// postfixes listed so far with an error wrapping ErrScanBudgetExceeded.
+// Parameters:
+// - ctx: The context for the Redis operations.
+// - client: The Redis client instance.
+// - prefix: The prefix for the task keys.
+// - opts: The key options, e.g. WithSeparator or WithHashTag, and WithScanCount.
+func ListActive(ctx context.Context, client redis.UniversalClient, prefix string, opts ...Option) ([]string, error) {
+	o := newPrefixOptions(prefix, opts)
+	client = o.clientFor(prefix, client)
+	ctx, cancel := o.opContext(ctx)
+	defer cancel()
+	if err := o.validatePrefix(prefix); err != nil {
+		return nil, err
+	}
+	keys := o.keyspace(prefix)
+	found, err := collectKeys(ctx, client, keys, nil, o.ScanCount, newScanBudget(o.MaxScanIterations))
+	partial := errors.Is(err, ErrScanBudgetExceeded)
+	if err != nil && !partial {
+		return nil, err
+	}
+	if o.Snapshot && !partial {
+		if found, err = existingKeys(ctx, client, found); err != nil {
+			return nil, err
+		}
+	}
+	postfixes := make([]string, 0, len(found))
+	for _, key := range found {
+		postfixes = append(postfixes, keys.postfix(key))
+	}
+	if o.Snapshot {
+		slices.Sort(postfixes)
+	}
+	return postfixes, err
+}
+
+// ClearPrefix force-releases every lock of the prefix by deleting all its task keys, and returns
+// how many task keys were deleted. Keys are found with SCAN and deleted with pipelined DELs in
+// batches, so no single huge DEL blocks Redis (with WithUnlink, UNLINKs free the memory in the background).
+// The active set and the fair queue are deleted too; the fencing token counter is kept so tokens stay monotonic.
+// With WithCountScope, the active set and the fair queue are shared with other prefixes and kept: only the
+// slots of the prefix's task keys are freed.
+// This is a blunt administrative operation meant for recovering from crashes: it ignores owner ids
+// and fencing tokens, so running tasks silently lose their locks.
+// Parameters:
+// - ctx: The context for the Redis operations.
+// - client: The Redis client instance.
+// - prefix: The prefix for the task keys.
+// - opts: The key options, e.g. WithSeparator, WithHashTag or WithUnlink.
+func ClearPrefix(ctx context.Context, client redis.UniversalClient, prefix string, opts ...Option) (int, error) {
+	o := newPrefixOptions(prefix, opts)
+	client = o.clientFor(prefix, client)
+	ctx, cancel := o.opContext(ctx)
+	defer cancel()
+	if err := o.validatePrefix(prefix); err != nil {
+		return 0, err
+	}
+	keys := o.keyspace(prefix)
+	var taskKeys []string
+	err := scanKeys(ctx, client, keys.pattern(), o.ScanCount, func(key string) {
+		if !keys.isInternal(key) {
+			taskKeys = append(taskKeys, key)
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if keys.scope != keys.prefix {
+		// The active set and the fair queue are shared with other prefixes, only free the slots of this one
+		return releaseKeys(ctx, client, keys, taskKeys, o.releaseMode())
+	}
+
+	deleted, err := deleteKeys(ctx, client, taskKeys, o.Unlink)
+	if err != nil {
+		return deleted, err
+	}
+	if _, err := deleteKeys(ctx, client, []string{keys.active(), keys.queue(), keys.waiters(), keys.burst()}, o.Unlink); err != nil {
+		return deleted, err
+	}
+	return deleted, nil
+}
+
+// ReleaseWhere force-releases the locks of the prefix for which predicate returns true, e.g. the locks older
+// than 10 minutes or those whose metadata names a dead host, and returns how many were released. It is the
+// surgical counterpart of ClearPrefix: keys are found with SCAN, their info (as returned by GetLockInfo) is
+// read and the matching locks are released, with pipelined scripts in batches of defaultScanCount keys.
+// A lock is only released while it still holds the owner the predicate saw, so a lock released and acquired
+// again by someone else in the meantime is left alone. Every reentrant hold of a released lock is dropped.
+// Parameters:
+// - ctx: The context for the Redis operations.
+// - client: The Redis client instance.
+// - prefix: The prefix for the task keys.
+// - predicate: Reports whether the lock should be released.
+// - opts: The key options, e.g. WithSeparator, WithHashTag or WithNotify.
+func ReleaseWhere(ctx context.Context, client redis.UniversalClient, prefix string, predicate func(LockInfo) bool, opts ...Option) (int, error) {
+	o := newPrefixOptions(prefix, opts)
+	client = o.clientFor(prefix, client)
+	ctx, cancel := o.opContext(ctx)
+	defer cancel()
+	if err := o.validatePrefix(prefix); err != nil {
+		return 0, err
+	}
+	keys := o.keyspace(prefix)
+	seen := make(map[string]struct{})
+	var taskKeys []string
+	err := scanKeys(ctx, client, keys.pattern(), o.ScanCount, func(key string) {
+		if _, ok := seen[key]; ok || keys.isInternal(key) {
+			return
+		}
+		seen[key] = struct{}{}
+		taskKeys = append(taskKeys, key)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	mode := o.releaseMode()
+	mode.reentrant = false // release the lock, not a single hold
+	released := 0
+	for start := 0; start < len(taskKeys); start += defaultScanCount {
+		batch := taskKeys[start:min(start+defaultScanCount, len(taskKeys))]
+		pipe := client.Pipeline()
+		infoCmds := make([]*redis.Cmd, len(batch))
+		for i, key := range batch {
+			infoCmds[i] = runScript(ctx, pipe, infoScript, []string{key})
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return released, wrapRedisError("read lock info", err)
+		}
+
+		pipe = client.Pipeline()
+		var releaseCmds []*redis.Cmd
+		var matched []string
+		for i, key := range batch {
+			info, exists, err := decodeLockInfo(infoCmds[i], key)
+			if err != nil {
+				return released, err
+			}
+			if exists && predicate(*info) {
+				releaseCmds = append(releaseCmds, releaseCmd(ctx, pipe, keys, keys.postfix(key), info.Owner, mode))
+				matched = append(matched, key)
+			}
+		}
+		if len(releaseCmds) == 0 {
+			continue
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return released, wrapRedisError("release locks", err)
+		}
+		for i, cmd := range releaseCmds {
+			if ok, _, _ := decodeRelease(cmd, matched[i], mode); ok {
+				released++
+			}
+		}
+	}
+	return released, nil
+}
+
+// Reconcile removes the members of the prefix's active set whose task key no longer exists, and returns
+// how many were removed. Members normally leave the active set when their lock is released, or stop counting
+// once their timeout passes, but a task key deleted outside the package (e.g. with DEL, FLUSHDB or a maxmemory
+// eviction) keeps its slot taken until then. Run Reconcile periodically to free such slots right away.
+// The members are read with ZSCAN and checked in batches by a script that only removes a member whose task
+// key is missing, so it is safe to run concurrently with live acquisitions and releases.
+// With WithCountScope, the members of every prefix of the group are reconciled.
+// Parameters:
+// - ctx: The context for the Redis operations.
+// - client: The Redis client instance.
+// - prefix: The prefix for the task keys.
+// - opts: The key options, e.g. WithSeparator, WithHashTag or WithCountScope.
+func Reconcile(ctx context.Context, client redis.UniversalClient, prefix string, opts ...Option) (int, error) {
+	o := newPrefixOptions(prefix, opts)
+	client = o.clientFor(prefix, client)
+	ctx, cancel := o.opContext(ctx)
+	defer cancel()
+	if err := o.validatePrefix(prefix); err != nil {
+		return 0, err
+	}
+	keys := o.keyspace(prefix)
+	kind, err := client.Type(ctx, keys.active()).Result()
+	if err != nil {
+		return 0, wrapRedisError("read active set type", err)
+	}
+	if kind != "zset" {
+		return 0, nil // no active task, or a legacy set that the next acquisition replaces
+	}
+
+	removed := 0
+	var cursor uint64
+	for {
+		page, next, err := client.ZScan(ctx, keys.active(), cursor, "", o.ScanCount).Result()
+		if err != nil {
+			return removed, wrapRedisError("scan active set", err)
+		}
+		// ZSCAN returns members and scores alternately
+		scriptKeys := []string{keys.active()}
+		members := make([]any, 0, len(page)/2)
+		for i := 0; i < len(page); i += 2 {
+			taskKey, ok := keys.memberTask(page[i])
+			if !ok {
+				continue // another prefix of the group, whose keys the key function builds differently
+			}
+			scriptKeys = append(scriptKeys, taskKey)
+			members = append(members, page[i])
+		}
+		if len(members) > 0 {
+			n, err := runScript(ctx, client, reconcileScript, scriptKeys, members...).Int()
+			if err != nil {
+				return removed, wrapRedisError("run reconcile script", err)
+			}
+			removed += n
+		}
+		if next == 0 {
+			return removed, nil
+		}
+		cursor = next
+	}
+}
+
+// deleteKeys deletes the keys with pipelined single-key DELs (or UNLINKs with unlink), defaultScanCount keys
+// per round-trip, and returns how many keys were deleted. Single-key commands keep it working across cluster slots.
+// When the server does not know UNLINK, the remaining keys are deleted with DEL.
+func deleteKeys(ctx context.Context, client redis.UniversalClient, keys []string, unlink bool) (int, error) {
+	deleted := 0
+	for start := 0; start < len(keys); start += defaultScanCount {
+		end := min(start+defaultScanCount, len(keys))
+		cmds, err := client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, key := range keys[start:end] {
+				if unlink {
+					pipe.Unlink(ctx, key)
+				} else {
+					pipe.Del(ctx, key)
+				}
+			}
+			return nil
+		})
+		if unlink && isUnknownCommand(err) {
+			// Redis < 4, delete this batch and the next ones with DEL
+			n, err := deleteKeys(ctx, client, keys[start:], false)
+			return deleted + n, err
+		}
+		if err != nil {
+			return deleted, wrapRedisError("delete keys", err)
+		}
+		for _, cmd := range cmds {
+			deleted += int(cmd.(*redis.IntCmd).Val())
+		}
+	}
+	return deleted, nil
+}
+
+// releaseKeys releases the task keys of the prefix with pipelined release scripts, defaultScanCount keys
+// per round-trip, removing their members from the active set, and returns how many keys were deleted.
+func releaseKeys(ctx context.Context, client redis.UniversalClient, keys keyspace, taskKeys []string, mode releaseMode) (int, error) {
+	deleted := 0
+	for start := 0; start < len(taskKeys); start += defaultScanCount {
+		end := min(start+defaultScanCount, len(taskKeys))
+		pipe := client.Pipeline()
+		cmds := make([]*redis.Cmd, 0, end-start)
+		for _, key := range taskKeys[start:end] {
+			cmds = append(cmds, releaseCmd(ctx, pipe, keys, keys.postfix(key), "", mode))
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return deleted, wrapRedisError("release keys", err)
+		}
+		for i, cmd := range cmds {
+			if ok, _, _ := decodeRelease(cmd, taskKeys[start+i], mode); ok {
+				deleted++
+			}
+		}
+	}
+	return deleted, nil
+}
+
+// countKeys counts the task keys of the prefix with collectKeys. When the budget is exceeded, it returns the
+// keys counted until then with the error.
+func countKeys(ctx context.Context, client redis.UniversalClient, keys keyspace, patterns []string, scanCount int64, budget *scanBudget) (int, error) {
+	found, err := collectKeys(ctx, client, keys, patterns, scanCount, budget)
+	return len(found), err
+}
+
+// collectKeys returns the task keys of the prefix found with scanKeys, or the keys matching the patterns
+// when given, in the order SCAN returned them. SCAN may return the same key more than once, so keys are
+// deduplicated, and the internal keys of the prefix are skipped, as are those of other prefixes matched by
+// the patterns. When the budget is exceeded, it returns the keys found until then with the error.
+func collectKeys(ctx context.Context, client redis.UniversalClient, keys keyspace, patterns []string, scanCount int64, budget *scanBudget) ([]string, error) {
+	custom := len(patterns) > 0
+	if !custom {
+		patterns = []string{keys.pattern()}
+	}
+	seen := make(map[string]struct{})
+	var found []string
+	err := scanPatterns(ctx, client, patterns, scanCount, budget, func(key string) {
+		if keys.isInternal(key) || (custom && hasReservedPostfix(key, keys.separator)) {
+			return
+		}
+		if _, ok := seen[key]; !ok {
+			seen[key] = struct{}{}
+			found = append(found, key)
+		}
+	})
+	return found, err
+}
+
+// snapshotCount counts the task keys of the prefix like countKeys, reconciled for WithConsistentSnapshot: the
+// keys deleted while the SCAN ran are dropped and, with o.SnapshotCrossCheck, the count is capped at the
+// unexpired units of the active set, read after the SCAN, when that set is the prefix's own.
+func (o *Options) snapshotCount(ctx context.Context, client redis.UniversalClient, keys keyspace, patterns []string) (int, error) {
+	found, err := collectKeys(ctx, client, keys, patterns, o.ScanCount, newScanBudget(o.MaxScanIterations))
+	if err != nil {
+		return len(found), err // a lower bound when the budget was exceeded, not worth reconciling
+	}
+	if found, err = existingKeys(ctx, client, found); err != nil {
+		return 0, err
+	}
+	count := len(found)
+	if !o.SnapshotCrossCheck || len(patterns) > 0 || keys.scope != keys.prefix {
+		return count, nil
+	}
+	units, err := client.ZCount(ctx, keys.active(), "("+strconv.FormatInt(o.Clock().UnixMilli(), 10), "+inf").Result()
+	if err != nil {
+		return 0, wrapRedisError("count active units", err)
+	}
+	if int(units) < count {
+		o.Logger.Debug("tasklocker: scanned keys exceed the active set", "prefix", keys.prefix, "keys", count, "active", units)
+		count = int(units)
+	}
+	return count, nil
+}
+
+// existingKeys returns the keys that still exist, in their order, checked with pipelined EXISTS calls,
+// defaultScanCount keys per round-trip.
+func existingKeys(ctx context.Context, client redis.UniversalClient, keys []string) ([]string, error) {
+	existing := keys[:0:0]
+	for start := 0; start < len(keys); start += defaultScanCount {
+		end := min(start+defaultScanCount, len(keys))
+		cmds, err := client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, key := range keys[start:end] {
+				pipe.Exists(ctx, key)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, wrapRedisError("check keys", err)
+		}
+		for i, cmd := range cmds {
+			if cmd.(*redis.IntCmd).Val() == 1 {
+				existing = append(existing, keys[start+i])
+			}
+		}
+	}
+	return existing, nil
+}
+
+// countPatterns returns o.CountPatterns for countKeys, checked and the broad ones logged (nil without them).
+func (o *Options) countPatterns(keys keyspace) ([]string, error) {
+	for _, pattern := range o.CountPatterns {
+		if pattern == "" {
+			return nil, fmt.Errorf("%w: count patterns must not be empty", ErrInvalidOption)
+		}
+		if strings.ContainsAny(pattern[:1], "*?[") {
+			o.Logger.Warn("tasklocker: broad count pattern, it matches the keys of any prefix", "prefix", keys.prefix, "pattern", pattern)
+		}
+	}
+	return o.CountPatterns, nil
+}
+
+// scanBudget bounds the SCAN calls of an enumeration, see WithMaxScanIterations. A nil budget is unlimited.
+// It is shared by the nodes of a cluster, which are scanned concurrently.
+type scanBudget struct {
+	max  int
+	left atomic.Int64
+}
+
+// newScanBudget returns a budget of max SCAN calls, nil (unlimited) when max is not positive.
+func newScanBudget(max int) *scanBudget {
+	if max <= 0 {
+		return nil
+	}
+	b := &scanBudget{max: max}
+	b.left.Store(int64(max))
+	return b
+}
+
+// take spends n SCAN calls, and returns an error wrapping ErrScanBudgetExceeded when they exceed the budget.
+func (b *scanBudget) take(n int) error {
+	if b == nil || b.left.Add(-int64(n)) >= 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: stopped after %d SCAN iterations", ErrScanBudgetExceeded, b.max)
+}
+
+// scanPatterns calls fn for every key matching any of the patterns like scanKeys, pipelining the SCAN
+// calls of the patterns: every round-trip advances the cursor of each pattern not done yet. A key
+// matching several patterns is passed once per pattern. Once the SCAN calls exceed the budget, it stops
+// with an error wrapping ErrScanBudgetExceeded, fn having been called for the keys found until then.
+func scanPatterns(ctx context.Context, client redis.UniversalClient, patterns []string, scanCount int64, budget *scanBudget, fn func(key string)) error {
+	scan := func(ctx context.Context, client redis.Cmdable, fn func(key string)) error {
+		if len(patterns) == 1 {
+			return scanNode(ctx, client, patterns[0], scanCount, budget, fn)
+		}
+		return scanNodePatterns(ctx, client, patterns, scanCount, budget, fn)
+	}
+	cluster, ok := client.(*redis.ClusterClient)
+	if !ok {
+		return scan(ctx, client, fn)
+	}
+
+	var mu sync.Mutex
+	return cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+		return scan(ctx, node, func(key string) {
+			mu.Lock()
+			defer mu.Unlock()
+			fn(key)
+		})
+	})
+}
+
+// scanNodePatterns calls fn for every key matching any of the patterns on a single node.
+func scanNodePatterns(ctx context.Context, client redis.Cmdable, patterns []string, scanCount int64, budget *scanBudget, fn func(key string)) error {
+	cursors := make(map[string]uint64, len(patterns))
+	for _, pattern := range patterns {
+		cursors[pattern] = 0
+	}
+	for len(cursors) > 0 {
+		if err := budget.take(len(cursors)); err != nil {
+			return err
+		}
+		pipe := client.Pipeline()
+		cmds := make(map[string]*redis.ScanCmd, len(cursors))
+		for pattern, cursor := range cursors {
+			cmds[pattern] = pipe.Scan(ctx, cursor, pattern, scanCount)
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return wrapRedisError("scan keys with patterns", err)
+		}
+		for pattern, cmd := range cmds {
+			keys, next := cmd.Val()
+			for _, key := range keys {
+				fn(key)
+			}
+			if next == 0 {
+				delete(cursors, pattern)
+			} else {
+				cursors[pattern] = next
+			}
+		}
+	}
+	return nil
+}
+
+// scanKeys calls fn for every key matching the pattern by iterating SCAN until the cursor returns to 0.
+// On a cluster client every master is scanned, since SCAN only covers the node it runs on.
+// fn is never called concurrently.
+func scanKeys(ctx context.Context, client redis.UniversalClient, pattern string, scanCount int64, fn func(key string)) error {
+	return scanPatterns(ctx, client, []string{pattern}, scanCount, nil, fn)
+}
+
+// scanNode calls fn for every key matching the pattern on a single node.
+func scanNode(ctx context.Context, client redis.Cmdable, pattern string, scanCount int64, budget *scanBudget, fn func(key string)) error {
+	var cursor uint64
+	for {
+		if err := budget.take(1); err != nil {
+			return err
+		}
+		keys, next, err := client.Scan(ctx, cursor, pattern, scanCount).Result()
+		if err != nil {
+			return wrapRedisError("scan keys with prefix", err)
+		}
+		for _, key := range keys {
+			fn(key)
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
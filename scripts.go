@@ -0,0 +1,1071 @@
+package tasklocker
+
+import (
+	"context"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Status codes returned by acquireScript.
+const (
+	statusAcquired     = 1
+	statusExists       = 2
+	statusLimitReached = 3
+	statusRecent       = 4
+	statusTenantLimit  = 5
+	statusVersion      = 6
+	statusNotPaused    = 7
+)
+
+// legacyActiveScript deletes the active key when it is still a plain set, as created by versions tracking
+// the active tasks without expiry scores, so the sorted set commands below do not fail with WRONGTYPE.
+// Tasks tracked in the legacy set are not counted again until they expire.
+// KEYS[2]: the active sorted set key
+const legacyActiveScript = `
+if redis.call('TYPE', KEYS[2]).ok == 'set' then
+	redis.call('DEL', KEYS[2])
+end
+`
+
+// nowScript sets now to the current Redis server time in milliseconds (and nowUs in microseconds),
+// so every client scores the sorted sets against the same clock.
+const nowScript = `
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local nowUs = tonumber(time[1]) * 1000000 + tonumber(time[2])
+`
+
+// lockValueScript defines lockValue, returning the value stored in a task key (false when it is missing).
+// Task keys are hashes holding a value field and a count field with the number of reentrant holds;
+// keys written by earlier versions are plain strings holding the value, and are still read.
+const lockValueScript = `
+local function lockValue(key)
+	if redis.call('TYPE', key).ok == 'string' then
+		return redis.call('GET', key)
+	end
+	return redis.call('HGET', key, 'value')
+end
+`
+
+// unitsScript defines the functions handling the members of a task in the active sorted set.
+// A task of weight N takes N members: its member, then member\0<i> for i = 2..N, so ZCARD
+// counts the units in use. The weight is stored in the weight field of the task key, 1 when missing.
+const unitsScript = `
+local function unitMembers(member, weight)
+	local members = {member}
+	for i = 2, weight do
+		members[i] = member .. '\0' .. i
+	end
+	return members
+end
+
+local function units(key, member)
+	local weight = 1
+	if redis.call('TYPE', key).ok == 'hash' then
+		weight = tonumber(redis.call('HGET', key, 'weight')) or 1
+	end
+	return unitMembers(member, weight)
+end
+
+local function pending(key)
+	return redis.call('TYPE', key).ok == 'hash' and redis.call('HGET', key, 'pending') == '1'
+end
+
+local function released(key)
+	return redis.call('TYPE', key).ok == 'hash' and redis.call('HGET', key, 'released') == '1'
+end
+
+local function paused(key)
+	return redis.call('TYPE', key).ok == 'hash' and redis.call('HGET', key, 'paused') == '1'
+end
+
+local function addUnits(zset, score, members)
+	for _, member in ipairs(members) do
+		redis.call('ZADD', zset, score, member)
+	end
+end
+`
+
+// deleteScript defines deleteKey, deleting a key with UNLINK when unlink is true (freeing its
+// memory in a background thread) and with DEL otherwise, or when the server predates UNLINK (Redis 4).
+const deleteScript = `
+local function deleteKey(key, unlink)
+	if unlink then
+		local deleted = redis.pcall('UNLINK', key)
+		if type(deleted) == 'number' then
+			return deleted
+		end
+	end
+	return redis.call('DEL', key)
+end
+`
+
+// acquireScript atomically checks whether the task key exists, counts the
+// active tasks for the prefix and sets the task key if the limit allows it.
+// The active tasks are tracked in a sorted set of postfixes scored by the expiry time of their
+// task key in milliseconds. Members whose expiry passed are evicted with ZREMRANGEBYSCORE
+// before counting with ZCARD, so the slot of a holder that died without releasing frees itself
+// as soon as its timeout passes.
+// A task of weight N takes N units of the limit (see unitsScript), and is only acquired when the
+// active units plus N do not exceed it.
+// The task key is a hash holding the given value, a hold count of 1, the acquisition time in Unix
+// milliseconds, the weight and the metadata fields, unless a fencing token is
+// requested, in which case the sequence key is incremented on success and the new token is stored instead.
+// When reentrancy is requested and the existing task key holds the given value, its hold count is
+// incremented and its TTL reset instead of reporting that it exists. When extension is requested
+// instead, an existing task key holding the given value counts as acquired and its TTL is raised
+// to at least the requested expiration, but never shortened. When refreshing is requested, any existing
+// task key counts as acquired, whatever its value, and its TTL and units are reset to the requested expiration.
+// None of these renewals check the limit, since the units of the task are already counted, so renewing a lock
+// never fails at capacity. When the task key is missing, units of its member left in the active sorted set
+// (e.g. after the key was deleted by hand) are removed before counting, for the same reason.
+// When a dedup marker key is given and exists, the task was released recently and the script reports it
+// as a recent duplicate, with the remaining TTL of the marker, instead of acquiring. So does a task key
+// released with a cooldown (see releaseCooldownScript), with its remaining TTL, whatever the mode.
+// A paused task key (see pauseScript) is reported as existing, unless resuming is requested and it holds the
+// given value, in which case it is acquired like a missing key, keeping the fields of the marker. Resuming
+// a task key that is not paused reports that instead.
+// When a version is expected, the script reports a version mismatch instead of acquiring unless the version
+// key holds it (a missing version key never does), fusing an optimistic concurrency check with the lock.
+// With a burst, the tasks may also take up to ARGV[18] units above the limit: each unit taken above it spends
+// a token, recorded in KEYS[8] and available again ARGV[19] milliseconds later, so the acquisition is only
+// allowed above the limit while tokens are left for its units above it.
+// With a tenant, the units of the task are also added to the tenant's sorted set, and the task is only
+// acquired when the units of the tenant still in the active set plus N do not exceed the tenant's limit;
+// the members of the tenant's set missing from the active set were released or expired and are removed.
+// A pending task key (flagged with a pending field) is set without checking the limit and without units,
+// so it prevents duplicates without counting until promoteScript makes it active.
+// In fair mode, the caller is queued in a sorted set scored by arrival time and only acquires once
+// fewer callers are ahead of it in the queue than there are free slots, so slots are granted in
+// arrival order. Every attempt renews the caller's deadline in a second sorted set, and callers whose
+// deadline passed (they stopped retrying) are evicted from the queue first.
+// Scripts run atomically, so no other caller can create the task key between the PTTL check and
+// the HSET/PEXPIRE: only one caller wins, exactly as with SET NX PX, and an existing key's TTL is never overwritten.
+// The script returns {status, token, pttl, active, evicted}, where token is 0 unless requested, pttl is
+// the remaining TTL in milliseconds of the existing task key (-1 without expiry) or 0, active
+// is the number of active units, including the new ones when the lock is acquired, and evicted is
+// the number of tasks whose expiry passed that were evicted from the active sorted set (counted once
+// whatever their weight).
+// KEYS[1]: the task key (e.g. google_places_brands_processor:1)
+// KEYS[2]: the active sorted set key (e.g. google_places_brands_processor:__active)
+// KEYS[3]: the sequence key for fencing tokens (e.g. google_places_brands_processor:__seq)
+// KEYS[4]: the fair queue key (e.g. google_places_brands_processor:__queue)
+// KEYS[5]: the fair queue deadlines key (e.g. google_places_brands_processor:__waiters)
+// KEYS[6]: the active sorted set of the tenant, used when ARGV[12] is positive (e.g. google_places_brands_processor:__tenant:acme)
+// KEYS[7]: the key holding the version compared with ARGV[16] when ARGV[15] is "1", the task key otherwise
+// KEYS[8]: the sorted set of the burst tokens spent, scored by when they were spent (e.g. google_places_brands_processor:__burst)
+// KEYS[9]: optionally, the dedup marker key set on release (e.g. google_places_brands_processor:__done:1)
+// ARGV[1]: the member of the task in the active sorted set and the fair queue (its postfix, or
+// prefix:postfix when the count scope is shared)
+// ARGV[2]: the maximum number of concurrent tasks allowed to this caller, after priority reservations, or -1
+// for no limit, in which case the active units are neither counted nor queued for
+// ARGV[3]: the expiration of the task key in milliseconds, unless ARGV[9] is given, or 0 for a task key
+// without expiry, whose units are scored +inf so they never expire either
+// ARGV[4]: the active task count computed by the caller, or -1 to use the active sorted set
+// ARGV[5]: the value stored in the task key (e.g. an owner id)
+// ARGV[6]: "1" to generate a fencing token, "0" otherwise
+// ARGV[7]: what to do with an existing task key holding the value: "1" to re-acquire it (reentrancy),
+// "2" to extend its TTL to at least ARGV[3], "0" to report that it exists; "3" re-acquires any existing
+// task key by resetting its TTL to ARGV[3], whatever its value; "4" resumes the paused task key holding it
+// ARGV[8]: the time in milliseconds a queued caller keeps its place without retrying, or 0 to disable fair mode
+// ARGV[9]: the Unix time in milliseconds at which the task key expires (set with PEXPIREAT), or 0 to use ARGV[3]
+// ARGV[10]: the weight of the task, the number of units of the limit it takes
+// ARGV[11]: "1" to set the task key pending, without checking the limit or adding units, "0" otherwise
+// ARGV[12]: the maximum number of units the tenant may hold, or 0 without a tenant
+// ARGV[13]: the tenant, stored in the tenant field of the task key
+// ARGV[14]: the JSON document stored in the data field of the task key, or an empty string to store none
+// ARGV[15]: "1" to only acquire while KEYS[7] holds the version ARGV[16], "0" otherwise
+// ARGV[16]: the expected version
+// ARGV[17]: the Unix time in milliseconds at which the keys of the count scope the script writes (the active
+// sorted set, the sequence, the fair queue and the tenant set) expire, or 0 for never, see WithTimeBucket
+// ARGV[18]: the burst tokens, the units the tasks may take above ARGV[2] within the burst window, or 0
+// ARGV[19]: the burst window in milliseconds, after which a token spent is available again
+// ARGV[20...]: metadata name/value pairs stored in the task key as meta:<name> fields
+var acquireScript = newScript(acquireHelpers + acquireBody)
+
+// auditedAcquireScript is acquireScript appending an entry to the audit stream, see auditScript.
+var auditedAcquireScript = newScript(acquireHelpers + audited("acquire", `{'acquired', 'exists', 'limit_reached', 'recent', 'tenant_limit', 'version_mismatch', 'not_paused'}`, acquireBody))
+
+// acquireHelpers are the helpers acquireScript is composed of.
+const acquireHelpers = legacyActiveScript + nowScript + lockValueScript + unitsScript
+
+// acquireBody is the body of acquireScript, after its helpers.
+const acquireBody = `
+local evicted = 0
+for _, member in ipairs(redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', now)) do
+	if not string.find(member, '\0', 1, true) then
+		evicted = evicted + 1
+	end
+end
+redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', now)
+local expireAt = tonumber(ARGV[9])
+local ttl = tonumber(ARGV[3])
+local expiry = now + ttl
+if expireAt > 0 then
+	expiry = expireAt
+elseif ttl <= 0 then
+	expiry = math.huge
+end
+local scopeExpireAt = tonumber(ARGV[17])
+local function expireScope()
+	if scopeExpireAt > 0 then
+		for _, key in ipairs({KEYS[2], KEYS[3], KEYS[4], KEYS[5], KEYS[6], KEYS[8]}) do
+			redis.call('PEXPIREAT', key, scopeExpireAt)
+		end
+	end
+end
+local function expire()
+	if expireAt > 0 then
+		redis.call('PEXPIREAT', KEYS[1], expireAt)
+	elseif ttl > 0 then
+		redis.call('PEXPIRE', KEYS[1], ttl)
+	else
+		redis.call('PERSIST', KEYS[1])
+	end
+end
+
+local pttl = redis.call('PTTL', KEYS[1])
+if pttl ~= -2 and released(KEYS[1]) then
+	-- Released with a cooldown, nothing renews it and the task was processed recently
+	redis.call('ZREM', KEYS[4], ARGV[1])
+	redis.call('ZREM', KEYS[5], ARGV[1])
+	return {4, 0, pttl, redis.call('ZCARD', KEYS[2]), evicted}
+end
+local resumed = false
+if pttl ~= -2 and paused(KEYS[1]) then
+	if ARGV[7] ~= '4' or lockValue(KEYS[1]) ~= ARGV[5] then
+		-- Paused, the task keeps its key until its holder resumes it
+		redis.call('ZREM', KEYS[4], ARGV[1])
+		redis.call('ZREM', KEYS[5], ARGV[1])
+		return {2, 0, pttl, redis.call('ZCARD', KEYS[2]), evicted}
+	end
+	-- The marker holds no units, acquire the task like a missing key
+	pttl, resumed = -2, true
+elseif ARGV[7] == '4' then
+	return {7, 0, pttl, redis.call('ZCARD', KEYS[2]), evicted}
+end
+if pttl ~= -2 then
+	if ARGV[7] == '3' then
+		expire()
+		if not pending(KEYS[1]) then
+			addUnits(KEYS[2], expiry, units(KEYS[1], ARGV[1]))
+		end
+		return {1, 0, 0, redis.call('ZCARD', KEYS[2]), evicted}
+	end
+	if ARGV[7] ~= '0' and lockValue(KEYS[1]) == ARGV[5] then
+		if ARGV[7] == '1' and redis.call('TYPE', KEYS[1]).ok == 'hash' then
+			redis.call('HINCRBY', KEYS[1], 'count', 1)
+			expire()
+			if not pending(KEYS[1]) then
+				addUnits(KEYS[2], expiry, units(KEYS[1], ARGV[1]))
+			end
+			return {1, 0, 0, redis.call('ZCARD', KEYS[2]), evicted}
+		end
+		if ARGV[7] == '2' then
+			if pttl >= 0 and now + pttl < expiry then
+				expire()
+				if not pending(KEYS[1]) then
+					addUnits(KEYS[2], expiry, units(KEYS[1], ARGV[1]))
+				end
+			end
+			return {1, 0, 0, redis.call('ZCARD', KEYS[2]), evicted}
+		end
+	end
+	redis.call('ZREM', KEYS[4], ARGV[1])
+	redis.call('ZREM', KEYS[5], ARGV[1])
+	return {2, 0, pttl, redis.call('ZCARD', KEYS[2]), evicted}
+end
+if KEYS[9] then
+	local recent = redis.call('PTTL', KEYS[9])
+	if recent ~= -2 then
+		redis.call('ZREM', KEYS[4], ARGV[1])
+		redis.call('ZREM', KEYS[5], ARGV[1])
+		return {4, 0, recent, redis.call('ZCARD', KEYS[2]), evicted}
+	end
+end
+if ARGV[15] == '1' and redis.call('GET', KEYS[7]) ~= ARGV[16] then
+	redis.call('ZREM', KEYS[4], ARGV[1])
+	redis.call('ZREM', KEYS[5], ARGV[1])
+	return {6, 0, 0, redis.call('ZCARD', KEYS[2]), evicted}
+end
+
+-- The task key is missing, so units of the member still in the active set are orphans (e.g. the key was
+-- deleted without the release script): drop them, so the caller is not counted against itself
+local orphan, unit = ARGV[1], 1
+while redis.call('ZREM', KEYS[2], orphan) == 1 do
+	unit = unit + 1
+	orphan = ARGV[1] .. '\0' .. unit
+end
+
+local allowed = tonumber(ARGV[2])
+local steady = allowed
+local weight = tonumber(ARGV[10])
+local active = tonumber(ARGV[4])
+if active < 0 then
+	active = redis.call('ZCARD', KEYS[2])
+end
+-- A pending task only takes its key, the limit is checked when it is promoted
+local isPending = ARGV[11] == '1'
+local limited = allowed >= 0 and not isPending
+-- The burst tokens spent before the window are available again. Every unit above the steady limit needs one
+-- of the tokens left, and the units in use above it already spent theirs
+local burst = tonumber(ARGV[18])
+if burst > 0 and limited then
+	redis.call('ZREMRANGEBYSCORE', KEYS[8], '-inf', now - tonumber(ARGV[19]))
+	local left = math.max(burst - redis.call('ZCARD', KEYS[8]), 0)
+	allowed = math.min(steady + burst, math.max(active, steady) + left)
+end
+if ARGV[8] ~= '0' and limited then
+	for _, waiter in ipairs(redis.call('ZRANGEBYSCORE', KEYS[5], '-inf', now)) do
+		redis.call('ZREM', KEYS[4], waiter)
+	end
+	redis.call('ZREMRANGEBYSCORE', KEYS[5], '-inf', now)
+	redis.call('ZADD', KEYS[4], 'NX', nowUs, ARGV[1])
+	redis.call('ZADD', KEYS[5], now + tonumber(ARGV[8]), ARGV[1])
+	if active + redis.call('ZRANK', KEYS[4], ARGV[1]) + weight > allowed then
+		expireScope()
+		return {3, 0, 0, active, evicted}
+	end
+	redis.call('ZREM', KEYS[4], ARGV[1])
+	redis.call('ZREM', KEYS[5], ARGV[1])
+end
+if limited and active + weight > allowed then
+	return {3, 0, 0, active, evicted}
+end
+-- The tenant set holds the units of the tenant, the ones no longer in the active set were released or expired
+local tenantLimit = tonumber(ARGV[12])
+if tenantLimit > 0 and not isPending then
+	for _, member in ipairs(redis.call('ZRANGE', KEYS[6], 0, -1)) do
+		if not redis.call('ZSCORE', KEYS[2], member) then
+			redis.call('ZREM', KEYS[6], member)
+		end
+	end
+	if redis.call('ZCARD', KEYS[6]) + weight > tenantLimit then
+		return {5, 0, 0, active, evicted}
+	end
+end
+
+local token = 0
+local value = ARGV[5]
+if ARGV[6] == '1' then
+	token = redis.call('INCR', KEYS[3])
+	value = token
+end
+
+if resumed then
+	redis.call('HDEL', KEYS[1], 'paused', 'paused_at')
+end
+redis.call('HSET', KEYS[1], 'value', value, 'count', 1, 'acquired_at', now, 'weight', weight)
+if tenantLimit > 0 then
+	redis.call('HSET', KEYS[1], 'tenant', ARGV[13])
+end
+if ARGV[14] ~= '' then
+	redis.call('HSET', KEYS[1], 'data', ARGV[14])
+end
+for i = 20, #ARGV, 2 do
+	redis.call('HSET', KEYS[1], 'meta:' .. ARGV[i], ARGV[i + 1])
+end
+expire()
+if isPending then
+	redis.call('HSET', KEYS[1], 'pending', 1)
+	expireScope()
+	return {1, token, 0, active, evicted}
+end
+addUnits(KEYS[2], expiry, unitMembers(ARGV[1], weight))
+if burst > 0 and limited and active + weight > steady then
+	-- Spend a token for every unit above the steady limit, kept until the window passes
+	for i = 1, math.min(active + weight - steady, weight) do
+		redis.call('ZADD', KEYS[8], now, nowUs .. '\0' .. ARGV[1] .. '\0' .. i)
+	end
+	redis.call('PEXPIRE', KEYS[8], ARGV[19])
+end
+if tenantLimit > 0 then
+	addUnits(KEYS[6], now, unitMembers(ARGV[1], weight))
+end
+expireScope()
+return {1, token, 0, active + weight, evicted}
+`
+
+// dryRunScript takes the same decision as acquireScript without writing anything: it checks whether
+// the task key exists and counts the active units whose expiry did not pass, leaving the expired ones
+// in the active sorted set. Fair queueing is not simulated.
+// It returns the status acquireScript would return (statusAcquired when the lock would be acquired).
+// KEYS[1]: the task key
+// KEYS[2]: the active sorted set key
+// ARGV[1]: the maximum number of concurrent tasks allowed to this caller, after priority reservations, or -1 for no limit
+// ARGV[2]: the weight of the task
+var dryRunScript = newScript(nowScript + `
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return 2
+end
+
+local active = 0
+if redis.call('TYPE', KEYS[2]).ok == 'zset' then
+	active = redis.call('ZCOUNT', KEYS[2], '(' .. now, '+inf')
+end
+if tonumber(ARGV[1]) >= 0 and active + tonumber(ARGV[2]) > tonumber(ARGV[1]) then
+	return 3
+end
+return 1
+`)
+
+// activeUnitsScript defines activeUnits, counting the units of a sorted set whose expiry did not pass.
+// It calls TIME, so the release scripts call it after their writes, which keeps them working
+// on servers older than Redis 5.
+const activeUnitsScript = `
+local function activeUnits(zset)
+	local time = redis.call('TIME')
+	local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+	return redis.call('ZCOUNT', zset, '(' .. now, '+inf')
+end
+`
+
+// releaseScript deletes the task key and removes its units from the active sorted set.
+// When a channel is given and the key was deleted, the postfix is published on it to wake up waiters.
+// When a dedup window is given and the key was deleted, the dedup marker key is set for that long.
+// It returns {deleted, active}: the number of deleted keys, and the number of active units left.
+// KEYS[1]: the task key
+// KEYS[2]: the active sorted set key
+// KEYS[3]: the dedup marker key, when ARGV[4] is positive
+// ARGV[1]: the member of the task removed from the active sorted set
+// ARGV[2]: the channel notified when a slot frees up, or an empty string to skip it
+// ARGV[3]: "1" to delete the task key with UNLINK, "0" with DEL
+// ARGV[4]: the dedup window in milliseconds, or 0 to set no marker
+var releaseScript = newScript(releaseHelpers + releaseBody)
+
+// auditedReleaseScript is releaseScript appending an entry to the audit stream, see auditScript.
+var auditedReleaseScript = newScript(releaseHelpers + audited("release", `{[0] = 'missing', [1] = 'released'}`, releaseBody))
+
+// releaseHelpers are the helpers releaseScript is composed of.
+const releaseHelpers = legacyActiveScript + unitsScript + deleteScript + activeUnitsScript
+
+// releaseBody is the body of releaseScript, after its helpers.
+const releaseBody = `
+local members = units(KEYS[1], ARGV[1])
+local deleted = deleteKey(KEYS[1], ARGV[3] == '1')
+redis.call('ZREM', KEYS[2], unpack(members))
+if deleted == 1 and tonumber(ARGV[4]) > 0 then
+	redis.call('SET', KEYS[3], 1, 'PX', ARGV[4])
+end
+if deleted == 1 and ARGV[2] ~= '' then
+	redis.call('PUBLISH', ARGV[2], ARGV[1])
+end
+return {deleted, activeUnits(KEYS[2])}
+`
+
+// releaseCooldownScript releases a lock like releaseOwnedScript, but instead of deleting the task key it
+// rewrites it to the released state for a cooldown: a hash holding only a released field and the release time
+// in Unix milliseconds, expiring after the cooldown. Its units are removed from the active sorted set, so its
+// slot is free, but acquireScript reports the key as a recent duplicate until it expires, and neither the
+// owned scripts (which find no value) nor refreshScript renew it. Reentrant holds are all released.
+// It returns {released, active}: 1 when the lock was released, 0 when the key is missing or already released
+// and -1 when it holds another value, and the number of active units left.
+// KEYS[1]: the task key
+// KEYS[2]: the active sorted set key
+// ARGV[1]: the member of the task removed from the active sorted set
+// ARGV[2]: the value stored when the lock was acquired, or an empty string to release it whatever its value
+// ARGV[3]: the cooldown in milliseconds
+// ARGV[4]: the channel notified when a slot frees up, or an empty string to skip it
+var releaseCooldownScript = newScript(legacyActiveScript + nowScript + lockValueScript + unitsScript + activeUnitsScript + `
+if redis.call('EXISTS', KEYS[1]) == 0 or released(KEYS[1]) then
+	return {0, activeUnits(KEYS[2])}
+end
+if ARGV[2] ~= '' and lockValue(KEYS[1]) ~= ARGV[2] then
+	return {-1, activeUnits(KEYS[2])}
+end
+redis.call('ZREM', KEYS[2], unpack(units(KEYS[1], ARGV[1])))
+redis.call('DEL', KEYS[1])
+redis.call('HSET', KEYS[1], 'released', 1, 'released_at', now)
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+if ARGV[4] ~= '' then
+	redis.call('PUBLISH', ARGV[4], ARGV[1])
+end
+return {1, activeUnits(KEYS[2])}
+`)
+
+// pauseScript frees the slot of a lock but keeps its task key as a paused marker, for acquireScript to resume:
+// the key is rewritten to a hash holding its value, metadata and data, a paused field and the pause time in
+// Unix milliseconds, with the given metadata fields, and its units are removed from the active sorted set.
+// Reentrant holds are all paused. While paused, acquireScript reports the key as existing and refreshScript
+// does not renew it.
+// It returns {paused, active}: 1 when the lock was paused, 0 when the key is missing, released or already
+// paused and -1 when it holds another value, and the number of active units left.
+// KEYS[1]: the task key
+// KEYS[2]: the active sorted set key
+// ARGV[1]: the member of the task removed from the active sorted set
+// ARGV[2]: the value stored when the lock was acquired, or an empty string to pause it whatever its value
+// ARGV[3]: how long the marker is kept in milliseconds, or 0 to keep it until it is resumed or released
+// ARGV[4]: the channel notified when a slot frees up, or an empty string to skip it
+// ARGV[5...]: metadata name/value pairs stored in the marker as meta:<name> fields
+var pauseScript = newScript(legacyActiveScript + nowScript + lockValueScript + unitsScript + activeUnitsScript + `
+if redis.call('EXISTS', KEYS[1]) == 0 or released(KEYS[1]) or paused(KEYS[1]) then
+	return {0, activeUnits(KEYS[2])}
+end
+local value = lockValue(KEYS[1])
+if ARGV[2] ~= '' and value ~= ARGV[2] then
+	return {-1, activeUnits(KEYS[2])}
+end
+redis.call('ZREM', KEYS[2], unpack(units(KEYS[1], ARGV[1])))
+if redis.call('TYPE', KEYS[1]).ok == 'string' then
+	redis.call('DEL', KEYS[1])
+	redis.call('HSET', KEYS[1], 'value', value)
+end
+redis.call('HDEL', KEYS[1], 'count', 'pending')
+redis.call('HSET', KEYS[1], 'paused', 1, 'paused_at', now)
+for i = 5, #ARGV, 2 do
+	redis.call('HSET', KEYS[1], 'meta:' .. ARGV[i], ARGV[i + 1])
+end
+if tonumber(ARGV[3]) > 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[3])
+else
+	redis.call('PERSIST', KEYS[1])
+end
+if ARGV[4] ~= '' then
+	redis.call('PUBLISH', ARGV[4], ARGV[1])
+end
+return {1, activeUnits(KEYS[2])}
+`)
+
+// releaseOwnedScript deletes the task key and removes its units from the active sorted set,
+// but only when the task key still holds the given value (an owner id or a fencing token).
+// When reentrancy is requested, the hold count is decremented first and the key is only
+// deleted once it reaches zero.
+// When a channel is given and the key was deleted, the postfix is published on it to wake up waiters.
+// It returns {released, active}: 1 when a hold was released, 0 when the key is missing and -1 when it holds
+// another value, and the number of active units left.
+// When a dedup window is given and the key was deleted, the dedup marker key is set for that long.
+// KEYS[1]: the task key
+// KEYS[2]: the active sorted set key
+// KEYS[3]: the dedup marker key, when ARGV[6] is positive
+// ARGV[1]: the member of the task removed from the active sorted set
+// ARGV[2]: the value stored when the lock was acquired
+// ARGV[3]: "1" to release a single reentrant hold, "0" to release the lock
+// ARGV[4]: the channel notified when a slot frees up, or an empty string to skip it
+// ARGV[5]: "1" to delete the task key with UNLINK, "0" with DEL
+// ARGV[6]: the dedup window in milliseconds, or 0 to set no marker
+var releaseOwnedScript = newScript(releaseOwnedHelpers + releaseOwnedBody)
+
+// auditedReleaseOwnedScript is releaseOwnedScript appending an entry to the audit stream, see auditScript.
+var auditedReleaseOwnedScript = newScript(releaseOwnedHelpers + audited("release", `{[-1] = 'stale', [0] = 'missing', [1] = 'released'}`, releaseOwnedBody))
+
+// releaseOwnedHelpers are the helpers releaseOwnedScript is composed of.
+const releaseOwnedHelpers = legacyActiveScript + lockValueScript + unitsScript + deleteScript + activeUnitsScript
+
+// releaseOwnedBody is the body of releaseOwnedScript, after its helpers.
+const releaseOwnedBody = `
+local value = lockValue(KEYS[1])
+if not value then
+	return {0, activeUnits(KEYS[2])}
+end
+if value ~= ARGV[2] then
+	return {-1, activeUnits(KEYS[2])}
+end
+
+if ARGV[3] == '1' and redis.call('TYPE', KEYS[1]).ok == 'hash' then
+	if redis.call('HINCRBY', KEYS[1], 'count', -1) > 0 then
+		return {1, activeUnits(KEYS[2])}
+	end
+end
+
+local members = units(KEYS[1], ARGV[1])
+deleteKey(KEYS[1], ARGV[5] == '1')
+redis.call('ZREM', KEYS[2], unpack(members))
+if tonumber(ARGV[6]) > 0 then
+	redis.call('SET', KEYS[3], 1, 'PX', ARGV[6])
+end
+if ARGV[4] ~= '' then
+	redis.call('PUBLISH', ARGV[4], ARGV[1])
+end
+return {1, activeUnits(KEYS[2])}
+`
+
+// refreshScript resets the TTL of the task key, but only when it exists and,
+// if an owner is given, only when it still holds that owner.
+// The expiry score of the units of the task in the active sorted set is moved along with the TTL.
+// With a maximum lifetime, the TTL is capped so the key expires at most that long after it was acquired (its
+// acquired_at field, missing on keys written by earlier versions), and a key that reached it is not refreshed.
+// It returns 1 when the TTL was reset and 0 otherwise.
+// KEYS[1]: the task key
+// KEYS[2]: the active sorted set key
+// ARGV[1]: the new TTL in milliseconds
+// ARGV[2]: the value stored when the lock was acquired, or an empty string to skip the check
+// ARGV[3]: the member of the task in the active sorted set
+// ARGV[4]: the maximum lifetime of the lock in milliseconds, or 0 for none
+var refreshScript = newScript(legacyActiveScript + nowScript + lockValueScript + unitsScript + `
+if released(KEYS[1]) or paused(KEYS[1]) or (ARGV[2] ~= '' and lockValue(KEYS[1]) ~= ARGV[2]) then
+	return 0
+end
+
+local ttl = tonumber(ARGV[1])
+local maxLifetime = tonumber(ARGV[4])
+if maxLifetime > 0 and redis.call('TYPE', KEYS[1]).ok == 'hash' then
+	local acquiredAt = tonumber(redis.call('HGET', KEYS[1], 'acquired_at'))
+	if acquiredAt then
+		local left = acquiredAt + maxLifetime - now
+		if left <= 0 then
+			return 0
+		end
+		ttl = math.min(ttl, left)
+	end
+end
+
+if redis.call('PEXPIRE', KEYS[1], ttl) == 0 then
+	return 0
+end
+if not pending(KEYS[1]) then
+	addUnits(KEYS[2], now + ttl, units(KEYS[1], ARGV[3]))
+end
+return 1
+`)
+
+// promoteScript moves a pending task key (see acquireScript) to active: its units are added to the active
+// sorted set if the limit allows it, and its TTL is set to the given expiration.
+// It returns {status, active}, where status is 1 when the task was promoted, 3 when the limit is reached
+// and 0 when the task key is missing, holds another value or is not pending, and active is the number of
+// active units, including the promoted ones.
+// KEYS[1]: the task key
+// KEYS[2]: the active sorted set key
+// ARGV[1]: the member of the task in the active sorted set
+// ARGV[2]: the value stored when the lock was acquired, or an empty string to skip the check
+// ARGV[3]: the maximum number of concurrent tasks allowed to this caller, after priority reservations, or -1 for no limit
+// ARGV[4]: the expiration of the task key in milliseconds, unless ARGV[5] is given, or 0 for no expiry
+// ARGV[5]: the Unix time in milliseconds at which the task key expires (set with PEXPIREAT), or 0 to use ARGV[4]
+var promoteScript = newScript(legacyActiveScript + nowScript + lockValueScript + unitsScript + `
+if ARGV[2] ~= '' and lockValue(KEYS[1]) ~= ARGV[2] then
+	return {0, 0}
+end
+if not pending(KEYS[1]) then
+	return {0, 0}
+end
+
+redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', now)
+local members = units(KEYS[1], ARGV[1])
+local active = redis.call('ZCARD', KEYS[2])
+if tonumber(ARGV[3]) >= 0 and active + #members > tonumber(ARGV[3]) then
+	return {3, active}
+end
+
+local ttl = tonumber(ARGV[4])
+local expireAt = tonumber(ARGV[5])
+local expiry = math.huge
+if expireAt > 0 then
+	expiry = expireAt
+	redis.call('PEXPIREAT', KEYS[1], expireAt)
+elseif ttl > 0 then
+	expiry = now + ttl
+	redis.call('PEXPIRE', KEYS[1], ttl)
+else
+	redis.call('PERSIST', KEYS[1])
+end
+redis.call('HDEL', KEYS[1], 'pending')
+addUnits(KEYS[2], expiry, members)
+return {1, active + #members}
+`)
+
+// infoScript reads a task key without modifying it.
+// It returns {-2} when the key is missing, and {pttl, now, field, value, ...} otherwise, where pttl is the
+// remaining TTL in milliseconds (-1 without expiry) and now the Redis server time in Unix milliseconds,
+// followed by the fields of the hash.
+// Keys written by earlier versions as plain strings are returned as a single value field.
+// KEYS[1]: the task key
+var infoScript = newScript(nowScript + `
+local pttl = redis.call('PTTL', KEYS[1])
+if pttl == -2 then
+	return {pttl}
+end
+
+local reply
+if redis.call('TYPE', KEYS[1]).ok == 'string' then
+	reply = {'value', redis.call('GET', KEYS[1])}
+else
+	reply = redis.call('HGETALL', KEYS[1])
+end
+table.insert(reply, 1, now)
+table.insert(reply, 1, pttl)
+return reply
+`)
+
+// statsScript counts the active tasks of the prefix without modifying the active sorted set:
+// members whose expiry passed are not counted, exactly as acquireScript would evict them.
+// It returns 0 when the active key is missing or still a legacy plain set.
+// KEYS[1]: the active sorted set key
+var statsScript = newScript(nowScript + `
+if redis.call('TYPE', KEYS[1]).ok ~= 'zset' then
+	return 0
+end
+return redis.call('ZCOUNT', KEYS[1], '(' .. now, '+inf')
+`)
+
+// rlockScript adds a reader to a read/write lock, unless a writer holds it.
+// The readers are tracked in a sorted set scored by the expiry time of their hold, so a reader that died
+// without unlocking stops counting once its timeout passes. The sorted set itself expires with its last reader.
+// It returns 1 when the read lock was acquired and 0 when a writer holds the lock.
+// KEYS[1]: the writer key (the task key of the postfix)
+// KEYS[2]: the readers sorted set key
+// ARGV[1]: the owner id of the reader
+// ARGV[2]: the expiration of the hold in milliseconds
+var rlockScript = newScript(nowScript + `
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return 0
+end
+
+local ttl = tonumber(ARGV[2])
+redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', now)
+redis.call('ZADD', KEYS[2], now + ttl, ARGV[1])
+if redis.call('PTTL', KEYS[2]) < ttl then
+	redis.call('PEXPIRE', KEYS[2], ttl)
+end
+return 1
+`)
+
+// wlockScript takes the write lock of a read/write lock, unless a writer or any reader holds it.
+// The writer key is a hash holding the owner id and the acquisition time, like a task key.
+// It returns 1 when the write lock was acquired and 0 otherwise.
+// KEYS[1]: the writer key (the task key of the postfix)
+// KEYS[2]: the readers sorted set key
+// ARGV[1]: the owner id of the writer
+// ARGV[2]: the expiration of the hold in milliseconds
+var wlockScript = newScript(nowScript + `
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return 0
+end
+redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', now)
+if redis.call('ZCARD', KEYS[2]) > 0 then
+	return 0
+end
+
+redis.call('HSET', KEYS[1], 'value', ARGV[1], 'count', 1, 'acquired_at', now)
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+return 1
+`)
+
+// wunlockScript deletes the writer key of a read/write lock, but only when it still holds the given owner id.
+// It returns 1 when the write lock was released and 0 otherwise.
+// KEYS[1]: the writer key (the task key of the postfix)
+// ARGV[1]: the owner id of the writer
+var wunlockScript = newScript(lockValueScript + `
+if lockValue(KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+return redis.call('DEL', KEYS[1])
+`)
+
+// reconcileScript removes the members of the active set whose task key no longer exists.
+// The check and the removal are atomic, so a member added meanwhile by an acquisition, which sets its
+// task key in the same script, is never removed.
+// KEYS[1]: the active sorted set key
+// KEYS[2...]: the task keys of the members
+// ARGV[1...]: the members, in the order of their task keys
+var reconcileScript = newScript(`
+local removed = 0
+for i, member in ipairs(ARGV) do
+	if redis.call('EXISTS', KEYS[i + 1]) == 0 then
+		removed = removed + redis.call('ZREM', KEYS[1], member)
+	end
+end
+return removed
+`)
+
+// dequeueScript removes a caller that gave up waiting from the fair queue.
+// KEYS[1]: the fair queue key
+// KEYS[2]: the fair queue deadlines key
+// ARGV[1]: the member of the caller in the fair queue
+var dequeueScript = newScript(`
+redis.call('ZREM', KEYS[1], ARGV[1])
+redis.call('ZREM', KEYS[2], ARGV[1])
+return 1
+`)
+
+// transferScript moves a task key to another postfix without releasing it: the key is renamed, keeping its
+// TTL, value and fields, and the units of the task in the active sorted set are moved to the member of the
+// new postfix with their expiry scores, so the slot stays held throughout.
+// It returns 1 when the lock was moved, 0 when the source key is missing or holds another value, and 2 when
+// the destination key already exists.
+// KEYS[1]: the task key of the source postfix
+// KEYS[2]: the active sorted set key
+// KEYS[3]: the task key of the destination postfix
+// ARGV[1]: the member of the source postfix in the active sorted set
+// ARGV[2]: the member of the destination postfix in the active sorted set
+// ARGV[3]: the value stored when the lock was acquired, or an empty string to skip the check
+var transferScript = newScript(legacyActiveScript + lockValueScript + unitsScript + `
+if redis.call('EXISTS', KEYS[1]) == 0 or (ARGV[3] ~= '' and lockValue(KEYS[1]) ~= ARGV[3]) then
+	return 0
+end
+if redis.call('EXISTS', KEYS[3]) == 1 then
+	return 2
+end
+
+local from = units(KEYS[1], ARGV[1])
+local to = units(KEYS[1], ARGV[2])
+redis.call('RENAME', KEYS[1], KEYS[3])
+for i, member in ipairs(from) do
+	local score = redis.call('ZSCORE', KEYS[2], member)
+	if score then
+		redis.call('ZREM', KEYS[2], member)
+		redis.call('ZADD', KEYS[2], score, to[i])
+	end
+end
+return 1
+`)
+
+// backendAcquireScript is the acquire of the Redis Backend, a subset of acquireScript on the same keys: it sets
+// the task key when it is missing and the active units of the sorted set plus the weight do not exceed the
+// limit, after evicting the expired units and the orphan units of the member like acquireScript.
+// It returns {status, pttl, active}, with the status of acquireScript (acquired, exists or limit reached),
+// the remaining TTL of the existing task key (-1 without expiry) or 0, and the active units.
+// KEYS[1]: the task key
+// KEYS[2]: the active sorted set key
+// ARGV[1]: the member of the task in the active sorted set
+// ARGV[2]: the maximum number of units allowed, or -1 for no limit
+// ARGV[3]: the Unix time in milliseconds at which the task key expires, or 0 for never
+// ARGV[4]: the value stored in the task key
+// ARGV[5]: the weight of the task
+var backendAcquireScript = newScript(legacyActiveScript + nowScript + unitsScript + `
+redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', now)
+local pttl = redis.call('PTTL', KEYS[1])
+if pttl ~= -2 then
+	return {2, pttl, redis.call('ZCARD', KEYS[2])}
+end
+local orphan, unit = ARGV[1], 1
+while redis.call('ZREM', KEYS[2], orphan) == 1 do
+	unit = unit + 1
+	orphan = ARGV[1] .. '\0' .. unit
+end
+local limit, weight = tonumber(ARGV[2]), tonumber(ARGV[5])
+local active = redis.call('ZCARD', KEYS[2])
+if limit >= 0 and active + weight > limit then
+	return {3, 0, active}
+end
+redis.call('HSET', KEYS[1], 'value', ARGV[4], 'count', 1, 'acquired_at', now, 'weight', weight)
+local expiry = tonumber(ARGV[3])
+if expiry > 0 then
+	redis.call('PEXPIREAT', KEYS[1], expiry)
+else
+	expiry = math.huge
+end
+addUnits(KEYS[2], expiry, unitMembers(ARGV[1], weight))
+return {1, 0, active + weight}
+`)
+
+// acquireAllScript sets several task keys, of any prefixes, all or none: the keys are set in order like
+// acquireScript sets one (a hash holding the value, a hold count of 1 and the acquisition time, with its
+// unit in the active sorted set of its prefix), and when one exists or its limit is reached, the keys set
+// before it are deleted and their units removed again, so the script leaves nothing behind.
+// It returns {status, index}: {1, 0} when every key was set, {2, i} when the i-th task key exists and {3, i}
+// when the limit of the i-th prefix is reached.
+// KEYS[2i-1]: the i-th task key
+// KEYS[2i]: the active sorted set key of the i-th prefix
+// ARGV[1]: the value stored in every task key (e.g. an owner id)
+// ARGV[3i-1]: the member of the i-th task in its active sorted set
+// ARGV[3i]: the maximum number of concurrent tasks allowed for the i-th prefix, or -1 for no limit
+// ARGV[3i+1]: the expiration of the i-th task key in milliseconds, or 0 for a task key without expiry
+var acquireAllScript = newScript(nowScript + `
+local set = 0
+local function rollback()
+	for j = 1, set do
+		redis.call('DEL', KEYS[2 * j - 1])
+		redis.call('ZREM', KEYS[2 * j], ARGV[3 * j - 1])
+	end
+end
+for i = 1, #KEYS / 2 do
+	local key, zset = KEYS[2 * i - 1], KEYS[2 * i]
+	local member, allowed, ttl = ARGV[3 * i - 1], tonumber(ARGV[3 * i]), tonumber(ARGV[3 * i + 1])
+	redis.call('ZREMRANGEBYSCORE', zset, '-inf', now)
+	if redis.call('EXISTS', key) == 1 then
+		rollback()
+		return {2, i}
+	end
+	-- The task key is missing, a unit of its member left in the active set is an orphan
+	redis.call('ZREM', zset, member)
+	if allowed >= 0 and redis.call('ZCARD', zset) + 1 > allowed then
+		rollback()
+		return {3, i}
+	end
+	redis.call('HSET', key, 'value', ARGV[1], 'count', 1, 'acquired_at', now, 'weight', 1)
+	local expiry = math.huge
+	if ttl > 0 then
+		redis.call('PEXPIRE', key, ttl)
+		expiry = now + ttl
+	end
+	redis.call('ZADD', zset, expiry, member)
+	set = i
+end
+return {1, 0}
+`)
+
+// releaseAllScript deletes the task keys set by acquireAllScript and removes their units from the active
+// sorted sets, but only the keys still holding the given value, so a key that expired and was acquired by
+// someone else is left untouched. It returns the number of keys deleted.
+// KEYS[2i-1]: the i-th task key
+// KEYS[2i]: the active sorted set key of the i-th prefix
+// ARGV[1]: the value stored when the locks were acquired
+// ARGV[i+1]: the member of the i-th task in its active sorted set
+var releaseAllScript = newScript(lockValueScript + `
+local deleted = 0
+for i = 1, #KEYS / 2 do
+	if lockValue(KEYS[2 * i - 1]) == ARGV[1] then
+		deleted = deleted + redis.call('DEL', KEYS[2 * i - 1])
+		redis.call('ZREM', KEYS[2 * i], ARGV[i + 1])
+	end
+end
+return deleted
+`)
+
+// poolAcquireScript sets the task key, like acquireScript sets one, only when its weight fits in the limit of
+// every pool, each an active sorted set of its own, and then adds its units to all of them: the counts are all
+// checked before anything is written, so a task never holds the slots of only some of its pools.
+// It returns {status, index}: {1, 0} when the key was set, {2, 0} when it exists and {3, i} when the limit of
+// the i-th pool is reached.
+// KEYS[1]: the task key
+// KEYS[i+1]: the active sorted set key of the i-th pool
+// ARGV[1]: the value stored in the task key (e.g. an owner id)
+// ARGV[2]: the weight of the task, the units it takes in every pool
+// ARGV[3]: the expiration of the task key in milliseconds, or 0 for a task key without expiry
+// ARGV[2i+2]: the member of the task in the i-th pool
+// ARGV[2i+3]: the maximum number of units allowed in the i-th pool, or -1 for no limit
+var poolAcquireScript = newScript(nowScript + unitsScript + `
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return {2, 0}
+end
+local weight, ttl = tonumber(ARGV[2]), tonumber(ARGV[3])
+for i = 2, #KEYS do
+	local zset, member, allowed = KEYS[i], ARGV[2 * i], tonumber(ARGV[2 * i + 1])
+	redis.call('ZREMRANGEBYSCORE', zset, '-inf', now)
+	-- The task key is missing, the units of its member left in the pool are orphans
+	local orphan, unit = member, 1
+	while redis.call('ZREM', zset, orphan) == 1 do
+		unit = unit + 1
+		orphan = member .. '\0' .. unit
+	end
+	if allowed >= 0 and redis.call('ZCARD', zset) + weight > allowed then
+		return {3, i - 1}
+	end
+end
+redis.call('HSET', KEYS[1], 'value', ARGV[1], 'count', 1, 'acquired_at', now, 'weight', weight)
+local expiry = math.huge
+if ttl > 0 then
+	redis.call('PEXPIRE', KEYS[1], ttl)
+	expiry = now + ttl
+end
+for i = 2, #KEYS do
+	addUnits(KEYS[i], expiry, unitMembers(ARGV[2 * i], weight))
+end
+return {1, 0}
+`)
+
+// poolReleaseScript deletes a task key set by poolAcquireScript and removes its units from every pool.
+// When a channel is given for a pool, the member is published on it to wake up its waiters.
+// It returns 1 when the key was deleted, 0 when it is missing and -1 when it holds another value.
+// KEYS[1]: the task key
+// KEYS[i+1]: the active sorted set key of the i-th pool
+// ARGV[1]: the value stored when the lock was acquired, or an empty string to release it whatever its value
+// ARGV[2i]: the member of the task in the i-th pool
+// ARGV[2i+1]: the channel notified when a slot of the i-th pool frees up, or an empty string to skip it
+var poolReleaseScript = newScript(lockValueScript + unitsScript + `
+local value = lockValue(KEYS[1])
+if not value then
+	return 0
+end
+if ARGV[1] ~= '' and value ~= ARGV[1] then
+	return -1
+end
+local members = {}
+for i = 2, #KEYS do
+	members[i] = units(KEYS[1], ARGV[2 * i - 2])
+end
+redis.call('DEL', KEYS[1])
+for i = 2, #KEYS do
+	redis.call('ZREM', KEYS[i], unpack(members[i]))
+	if ARGV[2 * i - 1] ~= '' then
+		redis.call('PUBLISH', ARGV[2 * i - 1], ARGV[2 * i - 2])
+	end
+end
+return 1
+`)
+
+// poolRefreshScript resets the TTL of a task key set by poolAcquireScript, but only when it still holds the
+// given value, and moves the expiry score of its units in every pool along with it.
+// It returns 1 when the TTL was reset and 0 otherwise.
+// KEYS[1]: the task key
+// KEYS[i+1]: the active sorted set key of the i-th pool
+// ARGV[1]: the new TTL in milliseconds
+// ARGV[2]: the value stored when the lock was acquired
+// ARGV[i+2]: the member of the task in the i-th pool
+var poolRefreshScript = newScript(nowScript + lockValueScript + unitsScript + `
+if lockValue(KEYS[1]) ~= ARGV[2] or redis.call('PEXPIRE', KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+for i = 2, #KEYS do
+	addUnits(KEYS[i], now + tonumber(ARGV[1]), units(KEYS[1], ARGV[i + 1]))
+end
+return 1
+`)
+
+// redlockReleaseScript deletes the key of a Redlock lock on one node, or of a mutex (see AcquireMutex), but only
+// when it still holds the given owner id.
+// It returns 1 when the key was deleted and 0 otherwise.
+// KEYS[1]: the task key
+// ARGV[1]: the owner id of the lock
+var redlockReleaseScript = newScript(lockValueScript + `
+if lockValue(KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+return redis.call('DEL', KEYS[1])
+`)
+
+// mutexRefreshScript resets the TTL of the key of a mutex (see AcquireMutex), but only when it still holds the
+// given owner id. It returns 1 when the TTL was reset and 0 otherwise.
+// KEYS[1]: the mutex key
+// ARGV[1]: the owner id of the mutex
+// ARGV[2]: the new TTL in milliseconds
+var mutexRefreshScript = newScript(lockValueScript + `
+if lockValue(KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+`)
+
+// runScript runs the script with EVALSHA, so its body is only sent to a server that does not know it yet:
+// on a NOSCRIPT error (first use, server restart, SCRIPT FLUSH, or a new cluster node), it falls back to
+// EVAL, which also caches it. In a pipeline, whose NOSCRIPT errors are only known after Exec, the script is
+// sent with EVAL. On a client RegisterFunctions loaded the function library on, it runs with FCALL instead.
+func runScript(ctx context.Context, client redis.Scripter, script *redis.Script, keys []string, args ...any) *redis.Cmd {
+	if _, ok := client.(redis.Pipeliner); ok {
+		return script.Eval(ctx, client, keys, args...)
+	}
+	if cmd, ok := fcall(ctx, client, script, keys, args...); ok {
+		return cmd
+	}
+	return script.Run(ctx, client, keys, args...)
+}
+
+// auditScript defines audit, appending an entry to the audit stream set with WithAuditStream for an event
+// (acquire or release) of the task key: the event, the task key, the owner and the outcome, named from the
+// status of the reply by outcomes. The ID that XADD generates holds the Redis time of the entry.
+// The stream key and the owner are the last key and argument of the call; they are removed from KEYS and
+// ARGV before the body of the script runs, so its indices are unchanged. The XADD runs with pcall, so a
+// failure does not abort the script after its writes: the error message is appended to the reply, 1 otherwise.
+const auditScript = `
+local auditStream = table.remove(KEYS)
+local auditOwner = table.remove(ARGV)
+local function audit(reply, event, outcomes)
+	local owner = auditOwner
+	if owner == '' and event == 'acquire' and reply[2] ~= 0 then
+		owner = reply[2]
+	end
+	local added = redis.pcall('XADD', auditStream, '*', 'event', event, 'key', KEYS[1], 'owner', owner,
+		'outcome', outcomes[reply[1]] or tostring(reply[1]))
+	if type(added) == 'table' and added.err then
+		table.insert(reply, added.err)
+	else
+		table.insert(reply, 1)
+	end
+	return reply
+end
+`
+
+// audited returns the body of a script, whose reply is a table starting with a status, wrapped so it calls
+// audit with its reply for the event, see auditScript. The body runs in a function, so its returns end it.
+func audited(event, outcomes, body string) string {
+	return auditScript + "local reply = (function()" + body + "end)()\nreturn audit(reply, '" + event + "', " + outcomes + ")\n"
+}
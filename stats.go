@@ -0,0 +1,106 @@
+package tasklocker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Stats reports the occupancy of a prefix, as returned by GetStats.
+type Stats struct {
+	// Active is the number of active tasks, counted like AcquireLock does.
+	Active int
+	// Limit is the maximum number of concurrent tasks the stats were computed for.
+	Limit int
+	// Free is the number of slots still available, Limit minus Active and never negative.
+	Free int
+	// Overshoot is the number of active tasks above Limit, 0 unless the limit was lowered below the number
+	// of running tasks. No acquisition succeeds until Overshoot tasks (and one more) finish.
+	Overshoot int
+}
+
+// GetStats reports the active task count, the limit and the free slots of the prefix in a single call,
+// for admission decisions. Active is read from the prefix:__active sorted set that AcquireLock counts,
+// ignoring holders whose timeout passed, so it matches what the next acquisition would observe.
+// The active sorted set is not modified.
+// Parameters:
+// - ctx: The context for the Redis operations.
+// - client: The Redis client instance.
+// - prefix: The prefix for the task keys.
+// - allowedConcurrentTasks: The maximum number of concurrent tasks allowed.
+// - opts: The key options, e.g. WithSeparator or WithHashTag.
+func GetStats(ctx context.Context, client redis.UniversalClient, prefix string, allowedConcurrentTasks int, opts ...Option) (Stats, error) {
+	o := newPrefixOptions(prefix, opts)
+	client = o.clientFor(prefix, client)
+	ctx, cancel := o.opContext(ctx)
+	defer cancel()
+	if err := o.validatePrefix(prefix); err != nil {
+		return Stats{}, err
+	}
+
+	active, err := runScript(ctx, client, statsScript, []string{o.keyspace(prefix).active()}).Int()
+	if err != nil {
+		return Stats{}, wrapRedisError("run stats script", err)
+	}
+	return Stats{
+		Active:    active,
+		Limit:     allowedConcurrentTasks,
+		Free:      max(allowedConcurrentTasks-active, 0),
+		Overshoot: max(active-allowedConcurrentTasks, 0),
+	}, nil
+}
+
+// MultiStats reports the Stats of several prefixes with a single pipelined round-trip, e.g. to poll the
+// capacity of every prefix at the top of a scheduling tick. Limit and Free are computed with the limit set
+// by WithLimit, or registered for the prefix (see Register), and DefaultLimit otherwise.
+// A prefix whose stats cannot be read is missing from the returned map, and its error, naming the prefix,
+// is returned joined with the others, so the stats of the other prefixes are still usable.
+// Parameters:
+// - ctx: The context for the Redis operations.
+// - client: The Redis client instance.
+// - prefixes: The prefixes for the task keys.
+// - opts: The options, e.g. WithLimit, WithSeparator or WithHashTag.
+func MultiStats(ctx context.Context, client redis.UniversalClient, prefixes []string, opts ...Option) (map[string]Stats, error) {
+	o := newOptions(opts)
+	ctx, cancel := o.opContext(ctx)
+	defer cancel()
+	var errs []error
+	pipe := client.Pipeline()
+	cmds := make(map[string]*redis.Cmd, len(prefixes))
+	limits := make(map[string]int, len(prefixes))
+	for _, prefix := range prefixes {
+		if _, ok := limits[prefix]; ok {
+			continue
+		}
+		// Every prefix gets its registered options, see Register
+		po := newPrefixOptions(prefix, opts)
+		limits[prefix] = po.Limit
+		if err := po.validatePrefix(prefix); err != nil {
+			errs = append(errs, fmt.Errorf("prefix %q: %w", prefix, err))
+			continue
+		}
+		cmds[prefix] = runScript(ctx, pipe, statsScript, []string{po.keyspace(prefix).active()})
+	}
+	if len(cmds) > 0 {
+		_, _ = pipe.Exec(ctx) // errors are decoded per command below
+	}
+
+	stats := make(map[string]Stats, len(cmds))
+	for prefix, cmd := range cmds {
+		active, err := cmd.Int()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("prefix %q: %w", prefix, wrapRedisError("run stats script", err)))
+			continue
+		}
+		limit := limits[prefix]
+		stats[prefix] = Stats{
+			Active:    active,
+			Limit:     limit,
+			Free:      max(limit-active, 0),
+			Overshoot: max(active-limit, 0),
+		}
+	}
+	return stats, errors.Join(errs...)
+}
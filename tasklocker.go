@@ -2,66 +2,1162 @@ package tasklocker
 
 import (
 	"context"
+	"crypto/rand"
+	"errors"
 	"fmt"
+	"math"
+	mathrand "math/rand/v2"
+	"strconv"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
+// defaultValue is the value stored in the task key by AcquireLock.
+const defaultValue = "1"
+
+// Acquire tries to acquire a lock for concurrent tasks using Redis, configured with functional options.
+// Without options it allows DefaultLimit concurrent tasks, expires the lock after DefaultTimeout
+// and stores a random owner id in the task key.
+// If ctx is canceled while the lock is being acquired, the lock is released again before returning
+// and the context error is returned (wrapped), so the slot does not leak until the TTL.
+// It returns the lock (nil when not acquired), a boolean indicating whether the lock is acquired,
+// a boolean indicating whether the key exists, and an error if something goes wrong.
+// Parameters:
+// - ctx: The context for the Redis operations, also used by Unlock.
+// - client: The Redis client instance.
+// - prefix: The prefix for the task key.
+// - postfix: The unique identifier for the task (e.g., task id).
+// - opts: The options, e.g. WithLimit, WithTimeout, WithOwner or WithRetry.
+func Acquire(ctx context.Context, client redis.UniversalClient, prefix, postfix string, opts ...Option) (*Lock, bool, bool, error) {
+	o := newPrefixOptions(prefix, opts)
+	start := o.Clock()
+	reply, err := acquire(ctx, client, prefix, postfix, o)
+	if err == nil {
+		o.observeLatency(ctx, reply, start)
+	}
+	return reply.lock, reply.lock != nil, reply.exists, err
+}
+
+// observeLatency calls the OnAcquireLatency and OnAcquireExemplar callbacks with the time the acquisition
+// of the reply took since start, the latter with the span context of the reply (ctx when it has none).
+func (o *Options) observeLatency(ctx context.Context, reply acquireReply, start time.Time) {
+	latency := o.Clock().Sub(start)
+	if o.OnAcquireLatency != nil {
+		o.OnAcquireLatency(latency)
+	}
+	if o.OnAcquireExemplar != nil {
+		if reply.trace != nil {
+			ctx = reply.trace
+		}
+		o.OnAcquireExemplar(ctx, latency, reply.result())
+	}
+}
+
+// acquire implements Acquire: it validates the key, generates the owner id if needed
+// and runs the acquire script, retrying while the limit is reached when o.Retry is set.
+func acquire(ctx context.Context, client redis.UniversalClient, prefix, postfix string, o *Options) (acquireReply, error) {
+	if err := o.validate(prefix, postfix); err != nil {
+		return acquireReply{}, err
+	}
+	client = o.clientFor(prefix, client)
+	if o.Owner == "" && !o.FencingToken {
+		owner, err := o.newOwner()
+		if err != nil {
+			return acquireReply{}, err
+		}
+		o.Owner = owner
+	}
+
+	keys := o.keyspace(prefix)
+	start := o.Clock()
+	for retry := 1; ; retry++ {
+		// Check the key, count the active tasks and set the key in a single atomic script,
+		// so no other process can slip in between the count and the set
+		reply, err := evalAcquire(ctx, client, keys, postfix, o, -1)
+		if reply.lock != nil {
+			reply.lock.attempts = retry
+		}
+		final := err != nil || reply.lock != nil || reply.exists || reply.mismatch || o.Retry == nil
+		if final && err == nil && reply.lock == nil && o.OnRejected != nil {
+			switch o.OnRejected(reply.result(), reply.active) {
+			case RejectRetry:
+				var backoff Backoff
+				if o.Retry != nil {
+					backoff = *o.Retry
+				}
+				if err := sleep(ctx, backoff.delay(retry)); err != nil {
+					if o.Fair {
+						dequeue(ctx, client, keys, postfix)
+					}
+					return acquireReply{}, err
+				}
+				continue
+			case RejectFail:
+				err = fmt.Errorf("%w: %s after %d attempts", ErrRejected, reply.result(), retry)
+				reply = acquireReply{trace: reply.trace}
+			}
+		}
+		if final {
+			if o.Fair && reply.lock == nil && !reply.exists {
+				// Give up our place in the fair queue, so we don't hold back the callers behind us
+				dequeue(ctx, client, keys, postfix)
+			}
+			return reply, err
+		}
+
+		// The limit is reached, wait before trying again unless the retry budget is exhausted
+		delay := o.Retry.delay(retry)
+		if o.Retry.exhausted(retry, o.Clock().Sub(start)+delay) {
+			if o.Fair {
+				dequeue(ctx, client, keys, postfix)
+			}
+			return acquireReply{}, fmt.Errorf("%w: limit still reached after %d attempts in %s", ErrAcquireTimeout, retry, o.Clock().Sub(start).Round(time.Millisecond))
+		}
+		if o.OnBlocked != nil && (retry == 1 || o.OnBlockedEveryRetry) {
+			o.OnBlocked(reply.active, retry)
+		}
+		if o.OnRetry != nil {
+			o.OnRetry(retry, reply.active)
+		}
+		if err := sleep(ctx, delay); err != nil {
+			if o.Fair {
+				dequeue(ctx, client, keys, postfix)
+			}
+			return acquireReply{}, err
+		}
+	}
+}
+
+// fairQueueTimeout is how long a caller keeps its place in the fair queue without retrying.
+// Callers that stop retrying (e.g. crashed) are evicted from the queue once it passes.
+const fairQueueTimeout = 30 * time.Second
+
+// dequeue removes the postfix from the fair queue, using a context that is not canceled since
+// it typically runs because ctx is done. Errors are ignored: the entry expires after fairQueueTimeout anyway.
+func dequeue(ctx context.Context, client redis.UniversalClient, keys keyspace, postfix string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), releaseTimeout)
+	defer cancel()
+	_ = runScript(ctx, client, dequeueScript, []string{keys.queue(), keys.waiters()}, keys.member(postfix)).Err()
+}
+
 // AcquireLock tries to acquire a lock for concurrent tasks using Redis.
 // It returns a boolean indicating whether the lock is acquired, a boolean indicating whether the key exists,
 // and an error if something goes wrong.
+// The existence check, the active task count and the set happen atomically in a single Lua script.
+// Active tasks are tracked in a sorted set under prefix:__active, scored by the expiry time of each holder,
+// so the count is a ZCARD and never enumerates keys. Holders whose timeout passed are evicted before counting,
+// so a holder that died without calling ReleaseLock frees its slot as soon as its timeout passes.
+// Parameters:
+// - ctx: The context for the Redis operations.
+// - client: The Redis client instance.
+// - prefix: The prefix for the task key.
+// - postfix: The unique identifier for the task (e.g., task id).
+// - allowedConcurrentTasks: The maximum number of concurrent tasks allowed.
+// - timeout: The duration after which the lock should be automatically released (its TTL). The Redis
+// round-trips are bounded by ctx, or by WithOpTimeout.
+// - opts: Further options, e.g. WithDedupWindow, with which a recent duplicate is reported as an existing key.
+func AcquireLock(ctx context.Context, client redis.UniversalClient, prefix, postfix string, allowedConcurrentTasks int, timeout time.Duration, opts ...Option) (bool, bool, error) {
+	result, err := AcquireLockResult(ctx, client, prefix, postfix, allowedConcurrentTasks, timeout, opts...)
+	return result == Acquired, result == AlreadyRunning || result == DuplicateRecent, err
+}
+
+// AcquireResult is the outcome of an acquisition, for callers who prefer a switch over the
+// (acquired, exists) booleans of AcquireLock.
+type AcquireResult int
+
+// The outcomes of an acquisition. The zero value means no outcome, because an error occurred.
+//
+//	AcquireResult    AcquireLock (acquired, exists)
+//	Acquired         (true, false)
+//	AlreadyRunning   (false, true)
+//	AtCapacity       (false, false)
+//	DuplicateRecent  (false, true)
+//	VersionMismatch  (false, false)
+const (
+	// Acquired means the lock was acquired.
+	Acquired AcquireResult = iota + 1
+	// AlreadyRunning means the task key already exists, the task is running or locked elsewhere.
+	AlreadyRunning
+	// AtCapacity means the concurrency limit of the prefix is reached.
+	AtCapacity
+	// DuplicateRecent means the task completed and released its lock within the WithDedupWindow window.
+	DuplicateRecent
+	// VersionMismatch means the version key did not hold the version expected with WithVersion.
+	VersionMismatch
+)
+
+// String returns the name of the result.
+func (r AcquireResult) String() string {
+	switch r {
+	case Acquired:
+		return "Acquired"
+	case AlreadyRunning:
+		return "AlreadyRunning"
+	case AtCapacity:
+		return "AtCapacity"
+	case DuplicateRecent:
+		return "DuplicateRecent"
+	case VersionMismatch:
+		return "VersionMismatch"
+	default:
+		return "AcquireResult(" + strconv.Itoa(int(r)) + ")"
+	}
+}
+
+// Reason is the machine-readable outcome of an acquisition, as returned by AcquireWithReason, for metric
+// labels and structured logs. Its values are stable and safe to store in dashboards.
+type Reason string
+
+// The reasons of an acquisition.
+const (
+	// ReasonAcquired means the lock was acquired.
+	ReasonAcquired Reason = "acquired"
+	// ReasonKeyExists means the task key already exists, the task is running or locked elsewhere.
+	ReasonKeyExists Reason = "key_exists"
+	// ReasonDuplicateRecent means the task was released within the WithDedupWindow window.
+	ReasonDuplicateRecent Reason = "duplicate_recent"
+	// ReasonAtCapacity means the concurrency limit is reached, including when WithRetry exhausted its budget
+	// waiting for a slot (ErrAcquireTimeout).
+	ReasonAtCapacity Reason = "at_capacity"
+	// ReasonVersionMismatch means the version key did not hold the version expected with WithVersion.
+	ReasonVersionMismatch Reason = "version_mismatch"
+	// ReasonError means the acquisition failed with an error, e.g. Redis being unavailable.
+	ReasonError Reason = "error"
+)
+
+// Reason returns the Reason of the result, ReasonError for the zero value returned along with an error.
+func (r AcquireResult) Reason() Reason {
+	switch r {
+	case Acquired:
+		return ReasonAcquired
+	case AlreadyRunning:
+		return ReasonKeyExists
+	case AtCapacity:
+		return ReasonAtCapacity
+	case DuplicateRecent:
+		return ReasonDuplicateRecent
+	case VersionMismatch:
+		return ReasonVersionMismatch
+	default:
+		return ReasonError
+	}
+}
+
+// AcquireWithReason behaves like Acquire, but reports why the lock was or wasn't acquired as a single Reason
+// instead of the (acquired, exists) booleans, so callers can increment the right metric and log consistently:
+//
+//	lock, reason, err := tasklocker.AcquireWithReason(ctx, client, prefix, postfix, tasklocker.WithLimit(3))
+//	acquisitions.WithLabelValues(prefix, string(reason)).Inc()
+//
+// The reason is ReasonError when err is not nil, except for ErrAcquireTimeout, which is ReasonAtCapacity.
+// Parameters:
+// - ctx: The context for the Redis operations, also used by Unlock.
+// - client: The Redis client instance.
+// - prefix: The prefix for the task key.
+// - postfix: The unique identifier for the task (e.g., task id).
+// - opts: The options, e.g. WithLimit, WithTimeout, WithOwner or WithRetry.
+func AcquireWithReason(ctx context.Context, client redis.UniversalClient, prefix, postfix string, opts ...Option) (*Lock, Reason, error) {
+	o := newPrefixOptions(prefix, opts)
+	start := o.Clock()
+	reply, err := acquire(ctx, client, prefix, postfix, o)
+	switch {
+	case errors.Is(err, ErrAcquireTimeout):
+		return nil, ReasonAtCapacity, err
+	case err != nil:
+		return nil, ReasonError, err
+	}
+	o.observeLatency(ctx, reply, start)
+	return reply.lock, reply.result().Reason(), nil
+}
+
+// AcquireLockResult behaves like AcquireLock, but reports the outcome as a single AcquireResult
+// instead of two booleans, so a switch statement handles each case:
+//
+//	switch result, err := tasklocker.AcquireLockResult(ctx, client, prefix, postfix, 3, time.Minute); {
+//	case err != nil:
+//		// Redis failed
+//	case result == tasklocker.Acquired:
+//		// run the task
+//	case result == tasklocker.AlreadyRunning:
+//		// skip the duplicate
+//	case result == tasklocker.AtCapacity:
+//		// retry later
+//	}
+//
+// The result is 0 (none of the outcomes) when err is not nil.
+// Parameters:
+// - ctx: The context for the Redis operations.
+// - client: The Redis client instance.
+// - prefix: The prefix for the task key.
+// - postfix: The unique identifier for the task (e.g., task id).
+// - allowedConcurrentTasks: The maximum number of concurrent tasks allowed.
+// - timeout: The duration after which the lock should be automatically released (its TTL). The Redis
+// round-trips are bounded by ctx, or by WithOpTimeout.
+// - opts: Further options, e.g. WithDedupWindow to report DuplicateRecent.
+func AcquireLockResult(ctx context.Context, client redis.UniversalClient, prefix, postfix string, allowedConcurrentTasks int, timeout time.Duration, opts ...Option) (AcquireResult, error) {
+	reply, err := acquire(ctx, client, prefix, postfix, newPrefixOptions(prefix, append([]Option{WithLimit(allowedConcurrentTasks), WithTimeout(timeout), WithOwner(defaultValue)}, opts...)))
+	if err != nil {
+		return 0, err
+	}
+	return reply.result(), nil
+}
+
+// AcquireDryRun reports what AcquireLockResult would decide at this moment, without acquiring anything:
+// Acquired when the lock would be acquired, AlreadyRunning when the key exists and AtCapacity when
+// the limit is reached. The existence check and the count are read atomically in a single script,
+// so the answer is consistent, but another caller may take the slot right after it.
+// Parameters:
+// - ctx: The context for the Redis operations.
+// - client: The Redis client instance.
+// - prefix: The prefix for the task key.
+// - postfix: The unique identifier for the task (e.g., task id).
+// - allowedConcurrentTasks: The maximum number of concurrent tasks allowed.
+func AcquireDryRun(ctx context.Context, client redis.UniversalClient, prefix, postfix string, allowedConcurrentTasks int) (AcquireResult, error) {
+	o := newPrefixOptions(prefix, []Option{WithLimit(allowedConcurrentTasks)})
+	if err := o.validate(prefix, postfix); err != nil {
+		return 0, err
+	}
+	keys := o.keyspace(prefix)
+
+	status, err := runScript(ctx, client, dryRunScript, []string{keys.task(postfix), keys.active()}, o.limit(), o.Weight).Int()
+	if err != nil {
+		return 0, wrapRedisError("run dry run script", err)
+	}
+	switch status {
+	case statusAcquired:
+		return Acquired, nil
+	case statusExists:
+		return AlreadyRunning, nil
+	case statusLimitReached:
+		return AtCapacity, nil
+	default:
+		return 0, fmt.Errorf("%w: dry run script status %d", ErrUnexpectedReply, status)
+	}
+}
+
+// AcquireLockUntil behaves like AcquireLock but the lock expires at deadline instead of after a timeout,
+// e.g. for tasks that must be done "until 14:00". The expiry is set with PEXPIREAT to the absolute
+// deadline, so the lock is released exactly then, however long the hold lasts.
+// An error wrapping ErrInvalidTimeout is returned when the deadline already passed.
 // Parameters:
 // - ctx: The context for the Redis operations.
 // - client: The Redis client instance.
 // - prefix: The prefix for the task key.
 // - postfix: The unique identifier for the task (e.g., task id).
 // - allowedConcurrentTasks: The maximum number of concurrent tasks allowed.
+// - deadline: The time at which the lock should be automatically released.
+func AcquireLockUntil(ctx context.Context, client redis.UniversalClient, prefix, postfix string, allowedConcurrentTasks int, deadline time.Time) (bool, bool, error) {
+	reply, err := acquire(ctx, client, prefix, postfix, newPrefixOptions(prefix, []Option{WithLimit(allowedConcurrentTasks), WithDeadline(deadline), WithOwner(defaultValue)}))
+	return reply.lock != nil, reply.exists, err
+}
+
+// AcquireLockOwned behaves like AcquireLock but stores an owner id as the value of the task key,
+// so the lock can later be released with ReleaseLockOwned without deleting another holder's key.
+// If owner is empty, a random UUID is generated. The owner id is returned in both cases.
+// Parameters:
+// - ctx: The context for the Redis operations.
+// - client: The Redis client instance.
+// - prefix: The prefix for the task key.
+// - postfix: The unique identifier for the task (e.g., task id).
+// - allowedConcurrentTasks: The maximum number of concurrent tasks allowed.
+// - timeout: The duration after which the lock should be automatically released.
+// - owner: The owner id stored in the task key, or empty to generate one.
+func AcquireLockOwned(ctx context.Context, client redis.UniversalClient, prefix, postfix string, allowedConcurrentTasks int, timeout time.Duration, owner string) (bool, bool, string, error) {
+	if owner == "" {
+		var err error
+		if owner, err = newUUID(); err != nil {
+			return false, false, "", err
+		}
+	}
+
+	_, acquired, exists, err := Acquire(ctx, client, prefix, postfix, WithLimit(allowedConcurrentTasks), WithTimeout(timeout), WithOwner(owner))
+	return acquired, exists, owner, err
+}
+
+// AcquireAny acquires a slot of the prefix for a task without a natural unique id, e.g. fire-and-forget work
+// that only needs the concurrency gate. It generates a random (UUID) postfix, which can't already exist, and
+// returns it so the lock can be released with ReleaseLock. The postfix is empty when the lock is not acquired,
+// because the limit is reached.
+// With WithCandidates, the postfix is drawn among the candidates by weight instead: a candidate whose key exists
+// (or was released within the WithDedupWindow window) is not free, and another one is drawn among the rest, one
+// attempt each, until one is acquired, the limit is reached or no candidate is left (an empty postfix too).
+// Parameters:
+// - ctx: The context for the Redis operations.
+// - client: The Redis client instance.
+// - prefix: The prefix for the task key.
+// - allowedConcurrentTasks: The maximum number of concurrent tasks allowed.
 // - timeout: The duration after which the lock should be automatically released.
-func AcquireLock(ctx context.Context, client *redis.Client, prefix, postfix string, allowedConcurrentTasks int, timeout time.Duration) (bool, bool, error) {
+// - opts: Further options, e.g. WithOwner or WithMetadata.
+func AcquireAny(ctx context.Context, client redis.UniversalClient, prefix string, allowedConcurrentTasks int, timeout time.Duration, opts ...Option) (string, bool, error) {
+	if o := newPrefixOptions(prefix, opts); len(o.Candidates) > 0 {
+		return acquireCandidate(ctx, client, prefix, allowedConcurrentTasks, timeout, o.Candidates, opts)
+	}
+	postfix, err := newUUID()
+	if err != nil {
+		return "", false, err
+	}
+
+	result, err := AcquireLockResult(ctx, client, prefix, postfix, allowedConcurrentTasks, timeout, opts...)
+	if result != Acquired {
+		return "", false, err
+	}
+	return postfix, true, nil
+}
+
+// acquireCandidate implements AcquireAny with WithCandidates, drawing the candidates by weight until one is
+// acquired.
+func acquireCandidate(ctx context.Context, client redis.UniversalClient, prefix string, allowedConcurrentTasks int, timeout time.Duration, weights map[string]float64, opts []Option) (string, bool, error) {
+	candidates := make([]string, 0, len(weights))
+	var total float64
+	for postfix, weight := range weights {
+		if weight < 0 || math.IsNaN(weight) || math.IsInf(weight, 0) {
+			return "", false, fmt.Errorf("%w: weight of candidate %q must be finite and not negative, got %g", ErrInvalidOption, postfix, weight)
+		}
+		if weight > 0 {
+			candidates = append(candidates, postfix)
+			total += weight
+		}
+	}
+	for len(candidates) > 0 {
+		// Draw a candidate with a probability proportional to its weight, the last one absorbing rounding errors
+		i, r := len(candidates)-1, mathrand.Float64()*total
+		for j, postfix := range candidates[:i] {
+			if r -= weights[postfix]; r < 0 {
+				i = j
+				break
+			}
+		}
+		postfix := candidates[i]
+		result, err := AcquireLockResult(ctx, client, prefix, postfix, allowedConcurrentTasks, timeout, opts...)
+		switch {
+		case result == Acquired:
+			return postfix, true, nil
+		case err != nil || (result != AlreadyRunning && result != DuplicateRecent):
+			return "", false, err
+		}
+		total -= weights[postfix]
+		candidates = append(candidates[:i], candidates[i+1:]...)
+	}
+	return "", false, nil
+}
+
+// AcquireLockWithToken behaves like AcquireLock but also returns a fencing token when the lock is acquired.
+// The token is a monotonically increasing integer per prefix, generated with INCR on prefix:__seq
+// and stored as the value of the task key. Pass it to downstream systems so they can reject
+// work from a holder whose lock expired, and to ReleaseLockWithToken to release the lock safely.
+// The token is 0 when the lock is not acquired.
+// Parameters:
+// - ctx: The context for the Redis operations.
+// - client: The Redis client instance.
+// - prefix: The prefix for the task key.
+// - postfix: The unique identifier for the task (e.g., task id).
+// - allowedConcurrentTasks: The maximum number of concurrent tasks allowed.
+// - timeout: The duration after which the lock should be automatically released.
+func AcquireLockWithToken(ctx context.Context, client redis.UniversalClient, prefix, postfix string, allowedConcurrentTasks int, timeout time.Duration) (bool, bool, int64, error) {
+	lock, acquired, exists, err := Acquire(ctx, client, prefix, postfix, WithLimit(allowedConcurrentTasks), WithTimeout(timeout), WithFencingToken())
+	if !acquired {
+		return false, exists, 0, err
+	}
+	return true, false, lock.token, nil
+}
+
+// AcquireLockEx behaves like AcquireLock but also returns the remaining TTL of the existing lock
+// when the key already exists, read with PTTL in the same atomic script that detects the key.
+// This lets callers decide whether to wait for the existing lock or give up without a second round-trip.
+// The TTL is -1 when the existing key has no expiry, and 0 when the key does not exist.
+// Parameters:
+// - ctx: The context for the Redis operations.
+// - client: The Redis client instance.
+// - prefix: The prefix for the task key.
+// - postfix: The unique identifier for the task (e.g., task id).
+// - allowedConcurrentTasks: The maximum number of concurrent tasks allowed.
+// - timeout: The duration after which the lock should be automatically released.
+func AcquireLockEx(ctx context.Context, client redis.UniversalClient, prefix, postfix string, allowedConcurrentTasks int, timeout time.Duration) (bool, bool, time.Duration, error) {
+	reply, err := acquire(ctx, client, prefix, postfix, newPrefixOptions(prefix, []Option{WithLimit(allowedConcurrentTasks), WithTimeout(timeout), WithOwner(defaultValue)}))
+	return reply.lock != nil, reply.exists, reply.ttl, err
+}
+
+// AcquireLockScan behaves like AcquireLock but counts the active tasks with an iterative SCAN
+// over prefix:* instead of the active set, so it also counts keys set by other means. With WithCountPatterns,
+// the keys matching the given patterns are counted instead, e.g. to count several prefixes as one pool.
+// The count is taken before the atomic existence check and set, so concurrent acquisitions
+// may briefly exceed allowedConcurrentTasks. Use AcquireLock when the limit must hold strictly.
+// When the SCAN fails, the acquisition is refused with the error, unless WithFailOpen is given.
+// Parameters:
+// - ctx: The context for the Redis operations.
+// - client: The Redis client instance.
+// - prefix: The prefix for the task key.
+// - postfix: The unique identifier for the task (e.g., task id).
+// - allowedConcurrentTasks: The maximum number of concurrent tasks allowed.
+// - timeout: The duration after which the lock should be automatically released.
+// - scanCount: The COUNT hint passed to every SCAN call (0 uses the Redis default).
+// - opts: Further options, e.g. WithFailOpen.
+func AcquireLockScan(ctx context.Context, client redis.UniversalClient, prefix, postfix string, allowedConcurrentTasks int, timeout time.Duration, scanCount int64, opts ...Option) (bool, bool, error) {
+	o := newPrefixOptions(prefix, append([]Option{WithLimit(allowedConcurrentTasks), WithTimeout(timeout), WithOwner(defaultValue)}, opts...))
+	client = o.clientFor(prefix, client)
+	if err := o.validate(prefix, postfix); err != nil {
+		return false, false, err
+	}
+	keys := o.keyspace(prefix)
+
+	// Count how many tasks are currently active (matching the prefix) without issuing KEYS,
+	// unless there is no limit to compare the count against
+	var active int
+	var err error
+	if o.Limit != Unlimited {
+		var patterns []string
+		if patterns, err = o.countPatterns(keys); err != nil {
+			return false, false, err
+		}
+		active, err = countKeys(ctx, client, keys, patterns, scanCount, newScanBudget(o.MaxScanIterations))
+	}
+	if err != nil {
+		if !o.FailOpen {
+			return false, false, err
+		}
+		// Acquire as if no task were active: the existence check still runs atomically in the script
+		o.Logger.Warn("tasklocker: counting failed, acquiring without the limit", "key", keys.task(postfix), "error", err)
+		active = 0
+	}
+
+	// Check the key and set it atomically, using the active count from the scan
+	reply, err := evalAcquire(ctx, client, keys, postfix, o, active)
+	return reply.lock != nil, reply.exists, err
+}
+
+// acquireReply is the decoded reply of the acquire script.
+type acquireReply struct {
+	lock     *Lock         // the acquired lock, nil when not acquired
+	exists   bool          // whether the task key already exists, or the task was released within the dedup window
+	recent   bool          // whether the task was released within the dedup window
+	mismatch bool          // whether the version key did not hold the expected version
+	ttl      time.Duration // the remaining TTL of the existing task key, -1 when it has no expiry
+	active   int           // the active task count when the limit is reached
+
+	trace context.Context // the context of the acquire span of the attempt, see WithOnAcquireExemplar
+}
+
+// result returns the AcquireResult of the reply.
+func (r acquireReply) result() AcquireResult {
+	switch {
+	case r.lock != nil:
+		return Acquired
+	case r.recent:
+		return DuplicateRecent
+	case r.exists:
+		return AlreadyRunning
+	case r.mismatch:
+		return VersionMismatch
+	default:
+		return AtCapacity
+	}
+}
+
+// evalAcquire runs acquireScript and decodes its reply.
+// When active is not negative, it is used as the active task count instead of the active set.
+// The task key holds o.Owner, unless o.FencingToken is set, in which case a fencing token is generated and stored instead.
+// With o.Reentrant, a task key already holding o.Owner is re-acquired and its hold count incremented.
+func evalAcquire(ctx context.Context, client redis.UniversalClient, keys keyspace, postfix string, o *Options, active int) (acquireReply, error) {
+	spanCtx, span := o.Tracer.Start(ctx, spanAcquire)
+	defer span.End()
+	span.SetAttribute("prefix", keys.prefix)
+	span.SetAttribute("postfix", postfix)
+	span.SetAttribute("allowed_concurrent", o.Limit)
+
+	if o.Backend != nil {
+		reply, err := acquireBackend(spanCtx, client, keys, postfix, o)
+		if err != nil {
+			span.SetAttribute("outcome", outcomeError)
+			span.RecordError(err)
+		}
+		reply.trace = spanCtx
+		return reply, err
+	}
+	if reply, full := o.fastReject(spanCtx, client, keys, postfix, active); full {
+		span.SetAttribute("outcome", outcomeLimitReached)
+		reply.trace = spanCtx
+		return reply, nil
+	}
+
+	var cmd *redis.Cmd
+	_ = o.retryTransient(spanCtx, func(ctx context.Context) error {
+		cmd = o.acquireCmd(ctx, client, keys, postfix, active)
+		return cmd.Err()
+	}) // the error is decoded from cmd below
+	reply, err := decodeAcquire(ctx, client, keys, postfix, o, cmd, span)
+	if o.LocalFallback && errors.Is(err, ErrRedisUnavailable) {
+		reply, err = acquireLocal(ctx, client, keys, postfix, o, err)
+	}
+	reply.trace = spanCtx
+	return reply, err
+}
+
+// fastReject probes the active set of the count scope with ZCOUNT when o.FastRejectWhenFull is set, and reports
+// whether its unexpired units leave no room for the weight, along with the reply of a rejected acquisition.
+// A failed probe is not reported, the acquire script then runs and returns the error.
+func (o *Options) fastReject(ctx context.Context, client redis.UniversalClient, keys keyspace, postfix string, active int) (acquireReply, bool) {
+	limit := o.limit()
+	if !o.FastRejectWhenFull || active >= 0 || limit < 0 || o.Pending > 0 || o.Fair || o.ownedMode() != "0" {
+		return acquireReply{}, false
+	}
+	limit += o.burst() // the probe can't tell whether burst tokens are left, only reject when none could help
+	ctx, cancel := o.opContext(ctx)
+	defer cancel()
+	units, err := client.ZCount(ctx, keys.active(), "("+strconv.FormatInt(o.Clock().UnixMilli(), 10), "+inf").Result()
+	if err != nil || int(units)+o.Weight <= limit {
+		return acquireReply{}, false
+	}
+	o.Logger.Debug("tasklocker: limit reached (fast reject)", "key", keys.task(postfix), "active", units, "limit", limit)
+	o.Metrics.IncRejected(keys.prefix)
+	o.Metrics.ObserveActive(keys.prefix, int(units))
+	o.recordContention(ctx, keys.prefix, true)
+	return acquireReply{active: int(units)}, true
+}
+
+// acquireCmd runs acquireScript for the postfix on client, which may be a pipeline.
+func (o *Options) acquireCmd(ctx context.Context, client redis.Scripter, keys keyspace, postfix string, active int) *redis.Cmd {
+	scriptKeys, args := o.acquireArgs(keys, postfix, active)
+	return runScript(ctx, client, o.acquireScript(), scriptKeys, args...)
+}
+
+// acquireArgs returns the keys and arguments of acquireScript for the postfix.
+func (o *Options) acquireArgs(keys keyspace, postfix string, active int) ([]string, []any) {
+	var queueTimeout int64
+	if o.Fair {
+		queueTimeout = fairQueueTimeout.Milliseconds()
+	}
+	var expireAt, scopeExpireAt int64
+	if !o.Deadline.IsZero() {
+		expireAt = o.Deadline.UnixMilli()
+	}
+	if !keys.bucketEnd.IsZero() {
+		// The locks and the keys of a time bucket expire with it
+		scopeExpireAt = keys.bucketEnd.UnixMilli()
+		if expireAt == 0 || scopeExpireAt < expireAt {
+			expireAt = scopeExpireAt
+		}
+	}
+	var ttl int64 // 0 for NoExpiry
+	if o.Timeout != NoExpiry {
+		ttl = formatMs(o.jitteredTimeout())
+	}
+	if o.Pending > 0 {
+		// A pending lock lives for its grace period, Promote applies the timeout or the deadline
+		ttl, expireAt = formatMs(o.Pending), 0
+	}
+	var tenantLimit int // 0 without a tenant
+	if o.Tenant != "" {
+		tenantLimit = o.TenantLimit
+	}
+	args := []any{keys.member(postfix), o.limit(), ttl, active, o.Owner, flag(o.FencingToken), o.ownedMode(), queueTimeout, expireAt, o.Weight, flag(o.Pending > 0), tenantLimit, o.Tenant, o.Data, flag(o.VersionKey != ""), o.Version, scopeExpireAt, o.burst(), formatMs(o.BurstWindow)}
+	if keys.shorten(postfix) != postfix {
+		// Keep the original of a hashed postfix in the task key, other metadata fields are set after it
+		args = append(args, "postfix", postfix)
+	}
+	args = append(args, o.metadataArgs()...)
+	versionKey := keys.task(postfix) // not read without a version
+	if o.VersionKey != "" {
+		versionKey = o.VersionKey
+	}
+	scriptKeys := []string{keys.task(postfix), keys.active(), keys.sequence(), keys.queue(), keys.waiters(), keys.tenant(o.Tenant), versionKey, keys.burst()}
+	if o.DedupWindow > 0 {
+		scriptKeys = append(scriptKeys, keys.done(postfix))
+	}
+	if o.AuditStream != "" {
+		// Removed by the audited script before its body runs, see auditScript
+		scriptKeys, args = append(scriptKeys, o.AuditStream), append(args, o.Owner)
+	}
+	return scriptKeys, args
+}
+
+// decodeAcquire decodes the reply of acquireScript, logging and counting the outcome.
+// The lock is bound to ctx and client, and released again when ctx was canceled meanwhile.
+func decodeAcquire(ctx context.Context, client redis.UniversalClient, keys keyspace, postfix string, o *Options, cmd *redis.Cmd, span Span) (acquireReply, error) {
 	// Create the task-specific key using the prefix and postfix (e.g., google_places_brands_processor:1)
-	taskKey := fmt.Sprintf("%s:%s", prefix, postfix)
+	taskKey := keys.task(postfix)
+
+	auditErr := takeAudit(cmd, o.auditMode(), taskKey)
+	reply, err := cmd.Int64Slice()
+	if err == nil && auditErr != nil {
+		err = auditErr
+		if reply[0] == statusAcquired {
+			// Nothing holds the lock the entry was not written for, release it right away, without an entry
+			// for the release of a lock the stream never saw acquired
+			owner := o.Owner
+			if o.FencingToken {
+				owner = strconv.FormatInt(reply[1], 10)
+			}
+			mode := o.releaseMode()
+			mode.audit = nil
+			releaseCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), releaseTimeout)
+			defer cancel()
+			if _, _, releaseErr := release(releaseCtx, client, keys, postfix, owner, mode); releaseErr != nil {
+				err = fmt.Errorf("%w (release failed: %w)", err, releaseErr)
+			}
+		}
+	}
+	if err != nil {
+		if !errors.Is(err, ErrAuditFailed) {
+			err = wrapRedisError("run acquire script", err)
+		}
+		o.Logger.Warn("tasklocker: acquire failed", "key", taskKey, "error", err)
+		span.SetAttribute("outcome", outcomeError)
+		span.RecordError(err)
+		return acquireReply{}, err
+	}
+	status, token, pttl, activeTasks, evicted := reply[0], reply[1], reply[2], reply[3], int(reply[4])
+	o.Metrics.ObserveActive(keys.prefix, int(activeTasks))
+	if evicted > 0 {
+		o.Logger.Debug("tasklocker: expired tasks evicted", "key", taskKey, "evicted", evicted)
+		if o.OnEvicted != nil {
+			o.OnEvicted(evicted)
+		}
+	}
+
+	switch status {
+	case statusAcquired:
+		// Lock acquired successfully, the stored value is the token when one was generated
+		owner := o.Owner
+		if o.FencingToken {
+			owner = strconv.FormatInt(token, 10)
+		}
+		if ctx.Err() != nil {
+			// The caller gave up while the script ran and will never learn it holds the lock,
+			// release it right away instead of leaking the slot until the TTL
+			err := releaseCanceled(ctx, client, keys, postfix, owner, o)
+			o.Logger.Warn("tasklocker: acquire canceled", "key", taskKey, "error", err)
+			span.SetAttribute("outcome", outcomeError)
+			span.RecordError(err)
+			return acquireReply{}, err
+		}
+		o.Logger.Debug("tasklocker: lock acquired", "key", taskKey, "active", activeTasks, "limit", o.Limit)
+		o.Metrics.IncAcquired(keys.prefix)
+		o.recordContention(ctx, keys.prefix, false)
+		if o.OnThreshold != nil && o.Pending == 0 && o.reachedThreshold(int(activeTasks)) {
+			o.OnThreshold(int(activeTasks), o.Limit)
+		}
+		span.SetAttribute("outcome", outcomeAcquired)
+		return acquireReply{lock: &Lock{ctx: ctx, client: client, keys: keys, postfix: postfix, key: taskKey, owner: owner, token: token, evicted: evicted, attempts: 1, active: int(activeTasks), mode: o.releaseMode(), acquiredAt: o.Clock(), clock: o.Clock, onHoldTime: o.OnHoldTime, opTimeout: o.OpTimeout, opDefault: o.DefaultOpTimeout, lifetime: o.MaxLifetime}}, nil
+	case statusExists:
+		// The key exists, return true for "exist" along with its remaining TTL
+		ttl := time.Duration(pttl) * time.Millisecond
+		if pttl < 0 {
+			ttl = -1
+		}
+		o.Logger.Debug("tasklocker: key exists", "key", taskKey, "active", activeTasks, "ttl", ttl)
+		o.Metrics.IncDuplicate(keys.prefix)
+		span.SetAttribute("outcome", outcomeExists)
+		return acquireReply{exists: true, ttl: ttl}, nil
+	case statusRecent:
+		// The task was released within the dedup window, report it as a duplicate along with the marker's TTL
+		o.Logger.Debug("tasklocker: task recently processed", "key", taskKey, "ttl", time.Duration(pttl)*time.Millisecond)
+		o.Metrics.IncDuplicate(keys.prefix)
+		span.SetAttribute("outcome", outcomeExists)
+		return acquireReply{exists: true, recent: true, ttl: time.Duration(pttl) * time.Millisecond}, nil
+	case statusLimitReached:
+		if int(activeTasks) > o.Limit+o.burst() {
+			// More tasks hold a slot than the limit allows, typically because the limit was lowered while
+			// they ran: nothing acquires until enough of them finish, make that visible
+			o.Logger.Warn("tasklocker: active tasks exceed the limit", "key", taskKey, "active", activeTasks, "limit", o.Limit)
+		}
+		o.Logger.Debug("tasklocker: limit reached", "key", taskKey, "active", activeTasks, "limit", o.limit())
+		o.Metrics.IncRejected(keys.prefix)
+		o.recordContention(ctx, keys.prefix, true)
+		span.SetAttribute("outcome", outcomeLimitReached)
+		return acquireReply{active: int(activeTasks)}, nil // Lock cannot be acquired
+	case statusVersion:
+		// The version key moved on, the task is stale
+		o.Logger.Debug("tasklocker: version mismatch", "key", taskKey, "version_key", o.VersionKey, "version", o.Version)
+		span.SetAttribute("outcome", outcomeVersionMismatch)
+		return acquireReply{mismatch: true, active: int(activeTasks)}, nil
+	case statusTenantLimit:
+		// The prefix has room, but the tenant holds its share of it
+		o.Logger.Debug("tasklocker: tenant limit reached", "key", taskKey, "tenant", o.Tenant, "limit", o.TenantLimit)
+		o.Metrics.IncRejected(keys.prefix)
+		o.recordContention(ctx, keys.prefix, true)
+		span.SetAttribute("outcome", outcomeLimitReached)
+		return acquireReply{active: int(activeTasks)}, nil
+	case statusNotPaused:
+		err := fmt.Errorf("%w: %q", ErrNotPaused, taskKey)
+		o.Logger.Debug("tasklocker: task not paused", "key", taskKey)
+		span.SetAttribute("outcome", outcomeError)
+		span.RecordError(err)
+		return acquireReply{}, err
+	default:
+		err := fmt.Errorf("%w: acquire script status %d", ErrUnexpectedReply, status)
+		span.SetAttribute("outcome", outcomeError)
+		span.RecordError(err)
+		return acquireReply{}, err
+	}
+}
+
+// reachedThreshold reports whether an acquisition leaving active units in use reached o.WarnThreshold of the
+// limit: it crossed the threshold, the units in use before it (active minus its weight) being below it,
+// or, with o.OnThresholdEveryCall, it is at or above the threshold.
+func (o *Options) reachedThreshold(active int) bool {
+	if o.Limit == Unlimited {
+		return false
+	}
+	level := o.WarnThreshold * float64(o.Limit)
+	if float64(active) < level {
+		return false
+	}
+	return o.OnThresholdEveryCall || float64(active-o.Weight) < level
+}
+
+// releaseTimeout bounds the release of a lock acquired after its context was canceled.
+const releaseTimeout = 5 * time.Second
+
+// releaseCanceled releases a lock that was acquired after ctx was canceled, using a context that is
+// not canceled, and returns the context error (joined with the release error, if any).
+func releaseCanceled(ctx context.Context, client redis.UniversalClient, keys keyspace, postfix, owner string, o *Options) error {
+	releaseCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), releaseTimeout)
+	defer cancel()
+	if _, _, err := release(releaseCtx, client, keys, postfix, owner, o.releaseMode()); err != nil {
+		return fmt.Errorf("acquire canceled: %w (release failed: %w)", ctx.Err(), err)
+	}
+	return fmt.Errorf("acquire canceled: %w", ctx.Err())
+}
+
+// ownedMode returns the acquire script argument telling what to do with an existing task key holding o.Owner.
+func (o *Options) ownedMode() string {
+	switch {
+	case o.Reentrant:
+		return "1"
+	case o.ExtendOwned:
+		return "2"
+	case o.RefreshExisting:
+		return "3"
+	case o.resume:
+		return "4"
+	default:
+		return "0"
+	}
+}
+
+// flag converts a boolean to the "1" or "0" script argument.
+func flag(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+// newOwner generates an owner id with o.OwnerFunc, or a random UUID when it is not set.
+func (o *Options) newOwner() (string, error) {
+	if o.OwnerFunc == nil {
+		return newUUID()
+	}
+	owner := o.OwnerFunc()
+	if owner == "" {
+		// An empty owner would make Release delete the key whoever holds it
+		return "", fmt.Errorf("failed to generate owner id: owner function returned an empty id")
+	}
+	return owner, nil
+}
+
+// newUUID generates a random (version 4) UUID using crypto/rand.
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("failed to generate owner id: %w", err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// formatMs converts the timeout to the milliseconds of the PEXPIRE script argument, the same way PSetEx does,
+// so sub-second timeouts are honored exactly. Positive timeouts below a millisecond are rounded up to one.
+func formatMs(timeout time.Duration) int64 {
+	if timeout > 0 && timeout < time.Millisecond {
+		return 1
+	}
+	return int64(timeout / time.Millisecond)
+}
+
+// Release releases a lock acquired with Acquire, configured with functional options.
+// With WithOwner, the key is only deleted while it still holds that owner id; without it,
+// the key is deleted unconditionally like ReleaseLock. With WithOwner and WithReentrant, a single
+// hold is released and the key is only deleted once every reentrant hold was released.
+// It returns true when a key (or a reentrant hold) was released.
+// Parameters:
+// - ctx: The context for the Redis operations.
+// - client: The Redis client instance.
+// - prefix: The prefix for the task key.
+// - postfix: The unique identifier for the task (e.g., task id).
+// - opts: The options, e.g. WithOwner or WithHashTag.
+func Release(ctx context.Context, client redis.UniversalClient, prefix, postfix string, opts ...Option) (bool, error) {
+	released, _, err := ReleaseActive(ctx, client, prefix, postfix, opts...)
+	return released, err
+}
 
-	// Check if the specific key already exists
-	exists, err := client.Exists(ctx, taskKey).Result()
+// ReleaseActive releases a lock like Release, and also returns the number of active tasks (units, with
+// weights) of the prefix, or of its count scope, left after the release, counted atomically in the release
+// script. When the lock was released and the count is 0, the caller was the last holder, e.g. to let the
+// last task of a group tear down shared resources. Expired holders not yet evicted are not counted.
+// Parameters:
+// - ctx: The context for the Redis operations.
+// - client: The Redis client instance.
+// - prefix: The prefix for the task key.
+// - postfix: The unique identifier for the task (e.g., task id).
+// - opts: The options, e.g. WithOwner or WithHashTag.
+func ReleaseActive(ctx context.Context, client redis.UniversalClient, prefix, postfix string, opts ...Option) (bool, int, error) {
+	o := newPrefixOptions(prefix, opts)
+	client = o.clientFor(prefix, client)
+	if err := o.validateKey(prefix, postfix); err != nil {
+		return false, 0, err
+	}
+	keys := o.keyspace(prefix)
+
+	spanCtx, span := o.Tracer.Start(ctx, spanRelease)
+	defer span.End()
+	span.SetAttribute("prefix", keys.prefix)
+	span.SetAttribute("postfix", postfix)
+
+	var (
+		released bool
+		active   int
+	)
+	err := o.retryTransient(spanCtx, func(ctx context.Context) error {
+		var err error
+		released, active, err = release(ctx, client, keys, postfix, o.Owner, o.releaseMode())
+		return err
+	})
+	span.SetAttribute("released", released)
 	if err != nil {
-		return false, false, fmt.Errorf("failed to check if key exists: %v", err)
+		span.RecordError(err)
+		o.Logger.Warn("tasklocker: release failed", "key", keys.task(postfix), "error", err)
+		return false, 0, err
+	}
+	o.Logger.Debug("tasklocker: lock released", "key", keys.task(postfix), "deleted", released, "active", active)
+	o.Metrics.IncReleased(keys.prefix)
+	return released, active, nil
+}
+
+// ReleaseWithCooldown releases a lock like Release, but instead of deleting the task key it keeps it for the
+// cooldown in a released state: the slot is free at once for the acquisitions counting the active set (every
+// acquire function but AcquireLockScan, whose SCAN still sees the key), but the postfix can't be acquired
+// again until the cooldown passes, e.g. to stop an immediate retry of a task that just ran. The states are:
+//
+//	held --ReleaseWithCooldown--> released (slot free, key kept) --cooldown passes--> missing (acquirable)
+//
+// While released, the acquire functions report the key as existing (AcquireLockResult as DuplicateRecent, and
+// AcquireLockEx with the remaining cooldown as its TTL), even to a reentrant or refreshing acquisition of the
+// same owner, and Refresh reports the lock lost. Release deletes the key, which ends the cooldown early. With WithOwner, the lock is
+// only released while it still holds that owner id; reentrant holds are all released at once. It returns true
+// when a lock was released, false when the key was missing, already released or held by another owner.
+// Parameters:
+// - ctx: The context for the Redis operations.
+// - client: The Redis client instance.
+// - prefix: The prefix for the task key.
+// - postfix: The unique identifier for the task (e.g., task id).
+// - cooldown: How long the released key blocks the postfix.
+// - opts: The options, e.g. WithOwner, WithStrictRelease or WithNotify.
+func ReleaseWithCooldown(ctx context.Context, client redis.UniversalClient, prefix, postfix string, cooldown time.Duration, opts ...Option) (bool, error) {
+	o := newPrefixOptions(prefix, opts)
+	client = o.clientFor(prefix, client)
+	if err := o.validateKey(prefix, postfix); err != nil {
+		return false, err
 	}
-	if exists > 0 {
-		// The key exists, return true for "exist"
-		return false, true, nil
+	if cooldown <= 0 {
+		return false, fmt.Errorf("%w: cooldown must be positive, got %s", ErrInvalidTimeout, cooldown)
+	}
+	keys := o.keyspace(prefix)
+	mode := o.releaseMode()
+	var channel string
+	if mode.notify {
+		channel = keys.freed()
 	}
 
-	// Count how many tasks are currently active (matching the prefix)
-	keys, err := client.Keys(ctx, fmt.Sprintf("%s:*", prefix)).Result()
+	var released bool
+	err := o.retryTransient(ctx, func(ctx context.Context) error {
+		cmd := runScript(ctx, client, releaseCooldownScript, []string{keys.task(postfix), keys.active()}, keys.member(postfix), o.Owner, formatMs(cooldown), channel)
+		var err error
+		released, _, err = decodeRelease(cmd, keys.task(postfix), releaseMode{strict: mode.strict})
+		return err
+	})
 	if err != nil {
-		return false, false, fmt.Errorf("failed to get keys with prefix: %v", err)
+		o.Logger.Warn("tasklocker: release failed", "key", keys.task(postfix), "error", err)
+		return false, err
 	}
+	o.Logger.Debug("tasklocker: lock released with cooldown", "key", keys.task(postfix), "released", released, "cooldown", cooldown)
+	o.Metrics.IncReleased(keys.prefix)
+	return released, nil
+}
+
+// releaseMode configures how the release scripts free a lock.
+type releaseMode struct {
+	reentrant bool          // release a single reentrant hold
+	notify    bool          // publish the freed slot for WaitForSlot
+	unlink    bool          // delete the task key with UNLINK instead of DEL
+	dedup     time.Duration // how long the dedup marker is kept, 0 to set none
+	strict    bool          // report a release that released nothing as an error
+	local     bool          // release the in-process lock of the key first, see WithLocalFallback
+	backend   Backend       // the store of the lock instead of Redis, see WithBackend
+	audit     *auditMode    // the audit entry to append, nil for none, see WithAuditStream
+}
+
+// releaseMode returns the release mode set by the options.
+func (o *Options) releaseMode() releaseMode {
+	return releaseMode{reentrant: o.Reentrant, notify: o.Notify, unlink: o.Unlink, dedup: o.DedupWindow, strict: o.StrictRelease, local: o.LocalFallback, backend: o.Backend, audit: o.auditMode()}
+}
 
-	// If the number of active tasks exceeds the allowedConcurrentTasks, do not acquire the lock
-	if len(keys) >= allowedConcurrentTasks {
-		return false, false, nil // Lock cannot be acquired
+// release deletes the task key and frees its slot in the active set.
+// When owner is not empty, the key is only deleted while it holds owner, and with mode.reentrant
+// only once its hold count reaches zero. With mode.notify, the freed slot is published for WaitForSlot.
+// It also returns the number of active units of the count scope left after the release.
+// With mode.local, a lock of the key taken in-process while Redis was unavailable is released instead,
+// without touching Redis. With mode.backend, the lock is released in the backend, which counts the units left.
+func release(ctx context.Context, client redis.UniversalClient, keys keyspace, postfix, owner string, mode releaseMode) (bool, int, error) {
+	if mode.local && localLocks.release(keys.task(postfix), owner) {
+		return true, 0, nil
+	}
+	if mode.backend != nil {
+		released, err := mode.backend.Release(ctx, BackendLock{Key: keys.task(postfix), Scope: keys.active(), Member: keys.member(postfix), Owner: owner})
+		if err != nil {
+			return false, 0, err
+		}
+		active, err := mode.backend.Count(ctx, keys.active())
+		return released, active, err
+	}
+	return decodeRelease(releaseCmd(ctx, client, keys, postfix, owner, mode), keys.task(postfix), mode)
+}
+
+// releaseCmd runs the release script for the postfix on client, which may be a pipeline.
+// Both scripts reply {1, active} when the key (or a reentrant hold) was released, see decodeRelease.
+func releaseCmd(ctx context.Context, client redis.Scripter, keys keyspace, postfix, owner string, mode releaseMode) *redis.Cmd {
+	var channel string
+	if mode.notify {
+		channel = keys.freed()
+	}
+	scriptKeys := []string{keys.task(postfix), keys.active()}
+	var dedup int64
+	if mode.dedup > 0 {
+		scriptKeys, dedup = append(scriptKeys, keys.done(postfix)), formatMs(mode.dedup)
+	}
+	var audit []any
+	if mode.audit != nil {
+		// Removed by the audited scripts before their body runs, see auditScript
+		scriptKeys, audit = append(scriptKeys, mode.audit.stream), []any{owner}
+	}
+	if owner != "" {
+		// Delete the task-specific key only if we still own it
+		script := releaseOwnedScript
+		if mode.audit != nil {
+			script = auditedReleaseOwnedScript
+		}
+		return runScript(ctx, client, script, scriptKeys, append([]any{keys.member(postfix), owner, flag(mode.reentrant), channel, flag(mode.unlink), dedup}, audit...)...)
 	}
 
-	// Try to acquire the lock for the task by setting a key with an expiration time
-	err = client.SetEx(ctx, taskKey, 1, timeout).Err()
+	// Delete the task-specific key and free its slot in the active set
+	script := releaseScript
+	if mode.audit != nil {
+		script = auditedReleaseScript
+	}
+	return runScript(ctx, client, script, scriptKeys, append([]any{keys.member(postfix), channel, flag(mode.unlink), dedup}, audit...)...)
+}
+
+// decodeRelease decodes the reply of a release script: whether a key (or a reentrant hold) was released,
+// and the number of active units left. With mode.strict, a release that released nothing returns an error
+// wrapping ErrLockNotHeld when the key is missing, and ErrStaleLock when it is held by another owner.
+// With mode.audit, the audit result of the reply is decoded for the task key first, see takeAudit.
+func decodeRelease(cmd *redis.Cmd, key string, mode releaseMode) (bool, int, error) {
+	auditErr := takeAudit(cmd, mode.audit, key)
+	reply, err := cmd.Int64Slice()
 	if err != nil {
-		return false, false, fmt.Errorf("failed to set key: %v", err)
+		return false, 0, wrapRedisError("run release script", err)
+	}
+	if len(reply) != 2 {
+		return false, 0, fmt.Errorf("%w: release script reply %v", ErrUnexpectedReply, reply)
 	}
+	active := int(reply[1])
+	switch {
+	case auditErr != nil:
+		return reply[0] == 1, active, auditErr
+	case reply[0] == 1:
+		return true, active, nil
+	case !mode.strict:
+		return false, active, nil
+	case reply[0] == 0:
+		return false, active, fmt.Errorf("%w: nothing to release, the key is missing", ErrLockNotHeld)
+	default:
+		return false, active, fmt.Errorf("%w: the key is held by another owner", ErrStaleLock)
+	}
+}
 
-	return true, false, nil // Lock acquired successfully
+// ReleaseLock releases the lock for concurrent tasks by deleting the task key
+// and removing it from the active set in Redis.
+// Parameters:
+// - ctx: The context for the Redis operations.
+// - client: The Redis client instance.
+// - prefix: The prefix for the task key.
+// - postfix: The unique identifier for the task (e.g., task id).
+// - opts: Further options, e.g. WithDedupWindow to keep a dedup marker.
+func ReleaseLock(ctx context.Context, client redis.UniversalClient, prefix, postfix string, opts ...Option) error {
+	_, err := Release(ctx, client, prefix, postfix, opts...)
+	return err
 }
 
-// ReleaseLock releases the lock for concurrent tasks by decrementing the counter in Redis.
+// ReleaseLockExists releases the lock like ReleaseLock, and reports whether the task key was deleted.
+// False means the key was already gone, typically because the lock expired before the task finished,
+// which hints that the timeout is too short for the task.
 // Parameters:
 // - ctx: The context for the Redis operations.
 // - client: The Redis client instance.
 // - prefix: The prefix for the task key.
 // - postfix: The unique identifier for the task (e.g., task id).
-func ReleaseLock(ctx context.Context, client *redis.Client, prefix, postfix string) error {
-	// Construct the task key using the prefix and postfix (e.g., google_places_brands_processor:1)
-	taskKey := fmt.Sprintf("%s:%s", prefix, postfix)
+func ReleaseLockExists(ctx context.Context, client redis.UniversalClient, prefix, postfix string) (bool, error) {
+	return Release(ctx, client, prefix, postfix)
+}
 
-	// Delete the task-specific key to release the lock
-	return client.Del(ctx, taskKey).Err()
+// ReleaseLockWithToken releases the lock like ReleaseLock, but only when the task key still holds
+// the fencing token returned by AcquireLockWithToken. This prevents a holder whose lock expired
+// from releasing the lock of the next holder.
+// It returns true when the lock was released and false when the key is missing or holds another token.
+// Parameters:
+// - ctx: The context for the Redis operations.
+// - client: The Redis client instance.
+// - prefix: The prefix for the task key.
+// - postfix: The unique identifier for the task (e.g., task id).
+// - token: The fencing token returned by AcquireLockWithToken.
+func ReleaseLockWithToken(ctx context.Context, client redis.UniversalClient, prefix, postfix string, token int64) (bool, error) {
+	// Delete the task-specific key only if it still holds our token
+	return Release(ctx, client, prefix, postfix, WithOwner(strconv.FormatInt(token, 10)))
+}
+
+// ReleaseLockToken releases the lock like ReleaseLockWithToken, but reports a refused release as an error:
+// when the task key is missing or holds another token, because the lock expired and may have been
+// re-acquired, nothing is deleted and an error wrapping ErrStaleLock is returned.
+// Parameters:
+// - ctx: The context for the Redis operations.
+// - client: The Redis client instance.
+// - prefix: The prefix for the task key.
+// - postfix: The unique identifier for the task (e.g., task id).
+// - token: The fencing token returned by AcquireLockWithToken.
+func ReleaseLockToken(ctx context.Context, client redis.UniversalClient, prefix, postfix string, token int64) error {
+	released, err := ReleaseLockWithToken(ctx, client, prefix, postfix, token)
+	if err != nil {
+		return err
+	}
+	if !released {
+		return fmt.Errorf("%w: %s no longer holds token %d", ErrStaleLock, postfix, token)
+	}
+	return nil
+}
+
+// ReleaseLockOwned releases the lock like ReleaseLock, but only when the task key still holds
+// the owner id used by AcquireLockOwned. If the lock expired and was acquired by someone else,
+// their key is left untouched.
+// It returns true when the lock was released and false when the key is missing or owned by someone else.
+// Parameters:
+// - ctx: The context for the Redis operations.
+// - client: The Redis client instance.
+// - prefix: The prefix for the task key.
+// - postfix: The unique identifier for the task (e.g., task id).
+// - owner: The owner id returned by AcquireLockOwned.
+func ReleaseLockOwned(ctx context.Context, client redis.UniversalClient, prefix, postfix, owner string) (bool, error) {
+	// Delete the task-specific key only if we still own it
+	return Release(ctx, client, prefix, postfix, WithOwner(owner))
 }
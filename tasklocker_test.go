@@ -0,0 +1,103 @@
+package tasklocker_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/youssefsiam38/tasklocker"
+)
+
+// newRedis starts a miniredis server for the test and returns it with a client. The clock the scripts read
+// with TIME is set to now, see advance.
+func newRedis(t testing.TB) (*miniredis.Miniredis, *redis.Client) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	mr.SetTime(time.Now())
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return mr, client
+}
+
+// advance moves the clock of miniredis forward by d, both the TTLs (FastForward) and the TIME the scripts
+// score the active sets against (SetTime).
+func advance(mr *miniredis.Miniredis, now *time.Time, d time.Duration) {
+	*now = now.Add(d)
+	mr.SetTime(*now)
+	mr.FastForward(d)
+}
+
+func TestAcquireLock(t *testing.T) {
+	_, client := newRedis(t)
+	ctx := context.Background()
+
+	for _, postfix := range []string{"1", "2"} {
+		acquired, exists, err := tasklocker.AcquireLock(ctx, client, "jobs", postfix, 2, time.Minute)
+		if err != nil || !acquired || exists {
+			t.Fatalf("AcquireLock(%s) = %v, %v, %v, want acquired", postfix, acquired, exists, err)
+		}
+	}
+
+	// The limit is reached
+	acquired, exists, err := tasklocker.AcquireLock(ctx, client, "jobs", "3", 2, time.Minute)
+	if err != nil || acquired || exists {
+		t.Fatalf("AcquireLock(3) = %v, %v, %v, want limit reached", acquired, exists, err)
+	}
+
+	// The key already exists
+	acquired, exists, err = tasklocker.AcquireLock(ctx, client, "jobs", "1", 2, time.Minute)
+	if err != nil || acquired || !exists {
+		t.Fatalf("AcquireLock(1) = %v, %v, %v, want exists", acquired, exists, err)
+	}
+
+	// Releasing frees a slot
+	if err := tasklocker.ReleaseLock(ctx, client, "jobs", "1"); err != nil {
+		t.Fatal(err)
+	}
+	acquired, exists, err = tasklocker.AcquireLock(ctx, client, "jobs", "3", 2, time.Minute)
+	if err != nil || !acquired || exists {
+		t.Fatalf("AcquireLock(3) after release = %v, %v, %v, want acquired", acquired, exists, err)
+	}
+}
+
+func TestAcquireLockExpired(t *testing.T) {
+	mr, client := newRedis(t)
+	ctx := context.Background()
+	now := time.Now()
+	mr.SetTime(now)
+
+	if acquired, _, err := tasklocker.AcquireLock(ctx, client, "jobs", "1", 1, time.Minute); err != nil || !acquired {
+		t.Fatalf("AcquireLock(1) = %v, %v, want acquired", acquired, err)
+	}
+	advance(mr, &now, 2*time.Minute)
+
+	// The expired task neither exists nor counts towards the limit
+	acquired, exists, err := tasklocker.AcquireLock(ctx, client, "jobs", "2", 1, time.Minute)
+	if err != nil || !acquired || exists {
+		t.Fatalf("AcquireLock(2) = %v, %v, %v, want acquired", acquired, exists, err)
+	}
+}
+
+func ExampleAcquireLock() {
+	mr, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer mr.Close()
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+	ctx := context.Background()
+
+	for _, postfix := range []string{"1", "2", "3", "1"} {
+		acquired, exists, err := tasklocker.AcquireLock(ctx, client, "thumbnails", postfix, 2, time.Minute)
+		fmt.Println(postfix, acquired, exists, err)
+	}
+	// Output:
+	// 1 true false <nil>
+	// 2 true false <nil>
+	// 3 false false <nil>
+	// 1 false true <nil>
+}
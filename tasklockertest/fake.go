@@ -0,0 +1,192 @@
+// Package tasklockertest provides an in-memory test double of tasklocker.Locker, so code depending on
+// tasklocker.Acquirer or tasklocker.AcquireReleaser can be unit-tested without Redis or miniredis.
+package tasklockertest
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/youssefsiam38/tasklocker"
+)
+
+// FakeLocker is an in-memory implementation of tasklocker.AcquireReleaser for tests. Like a Locker, it
+// respects the concurrency limit, reports an existing key as a duplicate and expires locks after their
+// timeout, measured on its own clock, which only moves with Advance. Of the options, it honors WithLimit,
+// WithTimeout, WithWeight and WithOwner, and the key options for Lock.Key. Locks acquired without WithOwner
+// get the owner ids fake-owner-1, fake-owner-2 and so on. Errors are simulated with FailWith.
+// A FakeLocker is safe for concurrent use.
+type FakeLocker struct {
+	prefix string
+	opts   []tasklocker.Option
+
+	mu    sync.Mutex
+	now   time.Time
+	err   error
+	seq   int                 // the number of locks acquired, for their owner ids
+	locks map[string]fakeLock // by postfix
+}
+
+// fakeLock is a lock held in a FakeLocker.
+type fakeLock struct {
+	owner  string
+	weight int
+	expiry time.Time // zero for no expiry
+}
+
+var _ tasklocker.AcquireReleaser = (*FakeLocker)(nil)
+
+// New returns a FakeLocker for the prefix, allowing allowedConcurrentTasks concurrent tasks whose locks
+// expire after timeout, like tasklocker.New. The options apply to every call.
+func New(prefix string, allowedConcurrentTasks int, timeout time.Duration, opts ...tasklocker.Option) *FakeLocker {
+	return &FakeLocker{
+		prefix: prefix,
+		opts:   append([]tasklocker.Option{tasklocker.WithLimit(allowedConcurrentTasks), tasklocker.WithTimeout(timeout)}, opts...),
+		now:    time.Now(),
+		locks:  make(map[string]fakeLock),
+	}
+}
+
+// Acquire acquires the lock of the postfix like Locker.Acquire, with the options of the FakeLocker followed
+// by opts. The returned lock is released by its Unlock and renewed by its Refresh, in memory.
+func (f *FakeLocker) Acquire(ctx context.Context, postfix string, opts ...tasklocker.Option) (*tasklocker.Lock, bool, bool, error) {
+	o, all := f.options(opts)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return nil, false, false, f.err
+	}
+	f.expire()
+	if _, ok := f.locks[postfix]; ok {
+		return nil, false, true, nil
+	}
+	active := 0
+	for _, held := range f.locks {
+		active += held.weight
+	}
+	if o.Limit != tasklocker.Unlimited && active+o.Weight > o.Limit {
+		return nil, false, false, nil
+	}
+
+	f.seq++
+	owner := o.Owner
+	if owner == "" {
+		owner = "fake-owner-" + strconv.Itoa(f.seq)
+	}
+	f.locks[postfix] = fakeLock{owner: owner, weight: o.Weight, expiry: f.expiry(o.Timeout)}
+	key := tasklocker.KeyFor(f.prefix, postfix, all...)
+	unlock := func() error {
+		_, err := f.release(postfix, owner)
+		return err
+	}
+	refresh := func(timeout time.Duration) (bool, error) {
+		return f.refresh(postfix, owner, timeout)
+	}
+	return tasklocker.NewLock(ctx, key, owner, unlock, refresh), true, false, nil
+}
+
+// Release releases the lock of the postfix like Locker.Release, with the options of the FakeLocker followed
+// by opts: only while it holds the WithOwner owner id, when one is given.
+func (f *FakeLocker) Release(ctx context.Context, postfix string, opts ...tasklocker.Option) (bool, error) {
+	o, _ := f.options(opts)
+	return f.release(postfix, o.Owner)
+}
+
+// FailWith makes every following call (Acquire, Release, and the Unlock and Refresh of the returned locks)
+// fail with err, e.g. an error wrapping tasklocker.ErrRedisUnavailable, until FailWith(nil) is called.
+func (f *FakeLocker) FailWith(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.err = err
+}
+
+// Advance moves the clock of the FakeLocker forward by d, expiring the locks whose timeout passed.
+func (f *FakeLocker) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+	f.expire()
+}
+
+// Held reports whether the lock of the postfix is held.
+func (f *FakeLocker) Held(postfix string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.expire()
+	_, ok := f.locks[postfix]
+	return ok
+}
+
+// Active returns the number of units in use, the weights of the held locks.
+func (f *FakeLocker) Active() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.expire()
+	active := 0
+	for _, held := range f.locks {
+		active += held.weight
+	}
+	return active
+}
+
+// release deletes the lock of the postfix while it holds owner, or whatever it holds when owner is empty.
+func (f *FakeLocker) release(postfix, owner string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return false, f.err
+	}
+	f.expire()
+	held, ok := f.locks[postfix]
+	if !ok || (owner != "" && held.owner != owner) {
+		return false, nil
+	}
+	delete(f.locks, postfix)
+	return true, nil
+}
+
+// refresh resets the expiry of the lock of the postfix to timeout while it holds owner.
+func (f *FakeLocker) refresh(postfix, owner string, timeout time.Duration) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return false, f.err
+	}
+	f.expire()
+	held, ok := f.locks[postfix]
+	if !ok || held.owner != owner {
+		return false, nil
+	}
+	held.expiry = f.expiry(timeout)
+	f.locks[postfix] = held
+	return true, nil
+}
+
+// expire deletes the locks whose expiry passed. f.mu must be held.
+func (f *FakeLocker) expire() {
+	for postfix, held := range f.locks {
+		if !held.expiry.IsZero() && !f.now.Before(held.expiry) {
+			delete(f.locks, postfix)
+		}
+	}
+}
+
+// expiry returns the expiry of a lock with the timeout, zero for tasklocker.NoExpiry. f.mu must be held.
+func (f *FakeLocker) expiry(timeout time.Duration) time.Time {
+	if timeout == tasklocker.NoExpiry {
+		return time.Time{}
+	}
+	return f.now.Add(timeout)
+}
+
+// options applies the options of the FakeLocker followed by opts to the defaults of tasklocker, and returns
+// them along with the options, for the key options.
+func (f *FakeLocker) options(opts []tasklocker.Option) (tasklocker.Options, []tasklocker.Option) {
+	all := append(f.opts[:len(f.opts):len(f.opts)], opts...)
+	o := tasklocker.Options{Limit: tasklocker.DefaultLimit, Timeout: tasklocker.DefaultTimeout, Weight: 1}
+	for _, opt := range all {
+		opt(&o)
+	}
+	return o, all
+}
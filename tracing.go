@@ -0,0 +1,52 @@
+package tasklocker
+
+import "context"
+
+// Tracer starts spans around the Redis operations of the package, so lock acquisition shows up in
+// distributed traces. It is small enough to be implemented on top of an OpenTelemetry trace.Tracer
+// (or any other tracing library) without this package depending on it.
+type Tracer interface {
+	// Start starts a span named name (e.g. tasklocker.AcquireLock) as a child of the span in ctx,
+	// and returns the context carrying the new span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	// SetAttribute records an attribute of the operation (e.g. prefix, postfix, outcome).
+	SetAttribute(key string, value any)
+	// RecordError records that the operation failed.
+	RecordError(err error)
+	// End ends the span.
+	End()
+}
+
+// Span names used by the package.
+const (
+	spanAcquire      = "tasklocker.AcquireLock"
+	spanRelease      = "tasklocker.ReleaseLock"
+	spanAcquireBatch = "tasklocker.AcquireLockBatch"
+	spanReleaseBatch = "tasklocker.ReleaseLockBatch"
+	spanTryFill      = "tasklocker.TryFill"
+)
+
+// Outcomes recorded in the outcome attribute of the acquire span.
+const (
+	outcomeAcquired        = "acquired"
+	outcomeExists          = "exists"
+	outcomeLimitReached    = "limit_reached"
+	outcomeVersionMismatch = "version_mismatch"
+	outcomeError           = "error"
+)
+
+// nopTracer is the default Tracer, its spans record nothing.
+type nopTracer struct{}
+
+func (nopTracer) Start(ctx context.Context, _ string) (context.Context, Span) { return ctx, nopSpan{} }
+
+// nopSpan is the span of nopTracer.
+type nopSpan struct{}
+
+func (nopSpan) SetAttribute(string, any) {}
+func (nopSpan) RecordError(error)        {}
+func (nopSpan) End()                     {}
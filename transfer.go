@@ -0,0 +1,54 @@
+package tasklocker
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// TransferLock moves the lock of fromPostfix to toPostfix atomically, e.g. when a task is renamed during a
+// migration, so the slot stays held instead of being released (and possibly taken) and re-acquired. The task
+// key is renamed with its remaining TTL, owner id or fencing token, metadata and hold count, and its units in
+// the active set move along.
+// It returns an error wrapping ErrLockNotHeld when the key of fromPostfix is missing, or holds another owner
+// id with WithOwner, and one wrapping ErrLockExists when the key of toPostfix already exists; nothing is moved
+// then. A Lock handle of fromPostfix keeps its postfix, release the moved lock with Release of toPostfix
+// (and the same owner). On Redis Cluster, both keys must hash to the same slot (see HashTag).
+// Parameters:
+// - ctx: The context for the Redis operations.
+// - client: The Redis client instance.
+// - prefix: The prefix for the task keys.
+// - fromPostfix: The unique identifier the lock is held for.
+// - toPostfix: The unique identifier to move the lock to.
+// - opts: The options, e.g. WithOwner or WithHashTag.
+func TransferLock(ctx context.Context, client redis.UniversalClient, prefix, fromPostfix, toPostfix string, opts ...Option) error {
+	o := newPrefixOptions(prefix, opts)
+	client = o.clientFor(prefix, client)
+	if err := o.validateKey(prefix, fromPostfix); err != nil {
+		return err
+	}
+	if err := o.validateKey(prefix, toPostfix); err != nil {
+		return err
+	}
+	keys := o.keyspace(prefix)
+
+	var status int
+	err := o.retryTransient(ctx, func(ctx context.Context) error {
+		var err error
+		status, err = runScript(ctx, client, transferScript, []string{keys.task(fromPostfix), keys.active(), keys.task(toPostfix)}, keys.member(fromPostfix), keys.member(toPostfix), o.Owner).Int()
+		return err
+	})
+	if err != nil {
+		return wrapRedisError("run transfer script", err)
+	}
+	switch status {
+	case 1:
+		o.Logger.Debug("tasklocker: lock transferred", "from", keys.task(fromPostfix), "to", keys.task(toPostfix))
+		return nil
+	case 2:
+		return fmt.Errorf("%w: %q", ErrLockExists, keys.task(toPostfix))
+	default:
+		return fmt.Errorf("%w: %q", ErrLockNotHeld, keys.task(fromPostfix))
+	}
+}
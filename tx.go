@@ -0,0 +1,64 @@
+package tasklocker
+
+import (
+	"context"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// AcquireTx queues the acquisition of a lock into a transaction or pipeline controlled by the caller, so
+// the acquire script runs in the same MULTI/EXEC as the caller's own commands. It returns a function to
+// call after EXEC, which decodes the outcome like Acquire: the lock (nil when not acquired), whether it
+// was acquired, whether the key exists, and the error of the script, e.g. redis.TxFailedErr when a
+// watched key changed and nothing was executed.
+// A transaction does not roll back: when the script does not acquire (the key exists or the limit is
+// reached), the other queued commands still run. To commit them only together with the lock, WATCH the
+// keys returned by AcquireKeys, check that AcquireDryRun reports Acquired, then queue the acquisition
+// and the writes with TxPipelined: EXEC fails, and nothing runs, if another caller changed the watched
+// keys in between. Locks of other tasks expiring in between only free slots, so the check still holds.
+// WithRetry is ignored, since nothing can be retried from within a transaction. On Redis Cluster, every
+// key of the transaction must hash to the same slot (see HashTag).
+// Parameters:
+// - ctx: The context for the Redis operations, also used by Unlock.
+// - client: The Redis client the lock is released with.
+// - pipe: The transaction or pipeline the acquire script is queued into (e.g. from client.TxPipeline).
+// - prefix: The prefix for the task key.
+// - postfix: The unique identifier for the task (e.g., task id).
+// - opts: The options, e.g. WithLimit, WithTimeout or WithOwner.
+func AcquireTx(ctx context.Context, client redis.UniversalClient, pipe redis.Pipeliner, prefix, postfix string, opts ...Option) (func() (*Lock, bool, bool, error), error) {
+	o := newPrefixOptions(prefix, opts)
+	if err := o.validate(prefix, postfix); err != nil {
+		return nil, err
+	}
+	if o.Owner == "" && !o.FencingToken {
+		owner, err := o.newOwner()
+		if err != nil {
+			return nil, err
+		}
+		o.Owner = owner
+	}
+	keys := o.keyspace(prefix)
+
+	cmd := o.acquireCmd(ctx, pipe, keys, postfix, -1)
+	return func() (*Lock, bool, bool, error) {
+		reply, err := decodeAcquire(ctx, client, keys, postfix, o, cmd, nopSpan{})
+		return reply.lock, reply.lock != nil, reply.exists, err
+	}, nil
+}
+
+// AcquireKeys returns the keys the acquisition of the postfix reads, to WATCH them before AcquireTx:
+// the task key and the active set of the prefix, followed by the fair queue keys with WithFairQueue and the
+// burst key with WithBurst.
+// Pass the same key options as on acquire.
+func AcquireKeys(prefix, postfix string, opts ...Option) []string {
+	o := newPrefixOptions(prefix, opts)
+	keys := o.keyspace(prefix)
+	watched := []string{keys.task(postfix), keys.active()}
+	if o.Fair {
+		watched = append(watched, keys.queue(), keys.waiters())
+	}
+	if o.burst() > 0 {
+		watched = append(watched, keys.burst())
+	}
+	return watched
+}
@@ -0,0 +1,277 @@
+package tasklocker
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// defaultBaseDelay is the delay before the first retry when Backoff.BaseDelay is not set.
+const defaultBaseDelay = 100 * time.Millisecond
+
+// Backoff configures the delay between retries, and optionally bounds them.
+// The zero value retries every 100ms without backoff or jitter, until ctx is done.
+// The retries stop at the first of ctx being done, MaxAttempts attempts, or MaxElapsed elapsed.
+type Backoff struct {
+	// BaseDelay is the delay before the first retry. Defaults to 100ms.
+	BaseDelay time.Duration
+	// MaxDelay caps the delay between retries. Zero means no cap.
+	MaxDelay time.Duration
+	// Multiplier grows the delay after every retry (e.g. 2 doubles it). Values <= 1 keep it constant.
+	Multiplier float64
+	// JitterFraction randomizes every delay by up to ±JitterFraction of its value (e.g. 0.2 for ±20%).
+	JitterFraction float64
+	// MaxAttempts caps the number of attempts, including the first one. Zero means no cap.
+	MaxAttempts int
+	// MaxElapsed caps the total time spent retrying, independently of ctx: no retry starts that
+	// would begin after it. Zero means no cap.
+	MaxElapsed time.Duration
+}
+
+// exhausted reports whether no attempt may follow the given one, the next attempt starting after elapsed.
+func (b Backoff) exhausted(attempt int, elapsed time.Duration) bool {
+	return (b.MaxAttempts > 0 && attempt >= b.MaxAttempts) || (b.MaxElapsed > 0 && elapsed > b.MaxElapsed)
+}
+
+// delay returns the delay before the given retry (starting at 1), with backoff and jitter applied.
+func (b Backoff) delay(retry int) time.Duration {
+	d := b.BaseDelay
+	if d <= 0 {
+		d = defaultBaseDelay
+	}
+	for i := 1; i < retry && b.Multiplier > 1; i++ {
+		d = time.Duration(float64(d) * b.Multiplier)
+		if b.MaxDelay > 0 && d >= b.MaxDelay {
+			break
+		}
+	}
+	if b.MaxDelay > 0 && d > b.MaxDelay {
+		d = b.MaxDelay
+	}
+	return jitter(d, b.JitterFraction)
+}
+
+// jitter randomizes d by up to ±fraction of its value (e.g. 0.2 for ±20%).
+func jitter(d time.Duration, fraction float64) time.Duration {
+	if fraction > 0 {
+		d += time.Duration((rand.Float64()*2 - 1) * fraction * float64(d))
+	}
+	return d
+}
+
+// AcquireLockWait acquires a lock like AcquireLock, but while the concurrency limit is reached it keeps
+// retrying with the given backoff until the lock is acquired or ctx is done.
+// It does not retry when the task key already exists, since that is a duplicate task rather than
+// a capacity issue, and it returns (false, true, nil) right away in that case.
+// When ctx is done before the lock is acquired, it returns ctx.Err(). Use a ctx deadline, or the MaxAttempts
+// and MaxElapsed fields of the backoff, to bound the total wait: when the backoff budget is exhausted first,
+// an error wrapping ErrAcquireTimeout is returned.
+// Parameters:
+// - ctx: The context for the Redis operations and the wait.
+// - client: The Redis client instance.
+// - prefix: The prefix for the task key.
+// - postfix: The unique identifier for the task (e.g., task id).
+// - allowedConcurrentTasks: The maximum number of concurrent tasks allowed.
+// - timeout: The duration after which the lock should be automatically released.
+// - backoff: The delay between retries.
+// - opts: Further options, e.g. WithOnBlocked to be told when the wait starts.
+func AcquireLockWait(ctx context.Context, client redis.UniversalClient, prefix, postfix string, allowedConcurrentTasks int, timeout time.Duration, backoff Backoff, opts ...Option) (bool, bool, error) {
+	opts = append([]Option{WithLimit(allowedConcurrentTasks), WithTimeout(timeout), WithOwner(defaultValue), WithRetry(backoff)}, opts...)
+	_, acquired, exists, err := Acquire(ctx, client, prefix, postfix, opts...)
+	return acquired, exists, err
+}
+
+// keyspaceChannelPattern matches the keyspace notification channels of a key in every database.
+const keyspaceChannelPattern = "__keyspace@*__:"
+
+// WaitForRelease blocks until the task key of the postfix no longer exists, e.g. to run a job depending on
+// that exact task, or until ctx is done. It returns nil once the key is gone (released or expired), and
+// ctx.Err() when ctx is done first.
+// The key is checked with EXISTS, again every time a keyspace notification arrives for it, and otherwise
+// with the delays of the WithRetry backoff (every 100ms by default). Notifications are only published when
+// the server's notify-keyspace-events setting includes them (e.g. "Kg$hxe"); without them WaitForRelease
+// falls back to polling. On Redis Cluster the notifications stay on the node of the key and polling is used.
+// Parameters:
+// - ctx: The context for the Redis operations and the wait.
+// - client: The Redis client instance.
+// - prefix: The prefix for the task key.
+// - postfix: The unique identifier for the task (e.g., task id).
+// - opts: The key options, e.g. WithSeparator or WithHashTag, and WithRetry to set the polling delay.
+func WaitForRelease(ctx context.Context, client redis.UniversalClient, prefix, postfix string, opts ...Option) error {
+	o := newPrefixOptions(prefix, opts)
+	client = o.clientFor(prefix, client)
+	if err := o.validateKey(prefix, postfix); err != nil {
+		return err
+	}
+	key := o.keyspace(prefix).task(postfix)
+
+	// Subscribe before the first check, so a release happening right after it is not missed
+	pubsub := client.PSubscribe(ctx, keyspaceChannelPattern+escapePattern(key))
+	defer pubsub.Close()
+	if _, err := pubsub.Receive(ctx); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return wrapRedisError("subscribe to keyspace notifications", err)
+	}
+	events := pubsub.Channel()
+
+	var backoff Backoff
+	if o.Retry != nil {
+		backoff = *o.Retry
+	}
+	for retry := 1; ; retry++ {
+		n, err := client.Exists(ctx, key).Result()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return wrapRedisError("check task key", err)
+		}
+		if n == 0 {
+			return nil
+		}
+
+		timer := time.NewTimer(backoff.delay(retry))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-events:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// WaitUntilBelow blocks until fewer than threshold tasks of the prefix are active, counted like CountActive,
+// or until ctx is done, e.g. for a scheduler pausing bulk dispatch until the prefix drained to half its limit,
+// a hysteresis WaitForSlot (which wakes up on the first freed slot) does not give. It returns the count
+// observed below threshold, or the last count observed and ctx.Err() when ctx is done first.
+// The count is read again every time a release is announced with WithNotify, and otherwise with the delays
+// of the WithRetry backoff (every 100ms by default), so locks expiring by TTL are noticed too.
+// Parameters:
+// - ctx: The context for the Redis operations and the wait.
+// - client: The Redis client instance.
+// - prefix: The prefix for the task keys.
+// - threshold: The count to drop below, at least 1.
+// - opts: The key options, e.g. WithSeparator or WithHashTag, WithScanCount, and WithRetry to set the polling delay.
+func WaitUntilBelow(ctx context.Context, client redis.UniversalClient, prefix string, threshold int, opts ...Option) (int, error) {
+	o := newPrefixOptions(prefix, opts)
+	if err := o.validatePrefix(prefix); err != nil {
+		return 0, err
+	}
+	if threshold <= 0 {
+		return 0, fmt.Errorf("%w: threshold must be positive, got %d", ErrInvalidOption, threshold)
+	}
+
+	// Subscribe before the first count, so a release happening right after it is not missed
+	pubsub := o.clientFor(prefix, client).Subscribe(ctx, o.keyspace(prefix).freed())
+	defer pubsub.Close()
+	if _, err := pubsub.Receive(ctx); err != nil {
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		return 0, wrapRedisError("subscribe to freed slots", err)
+	}
+	freed := pubsub.Channel()
+
+	var backoff Backoff
+	if o.Retry != nil {
+		backoff = *o.Retry
+	}
+	var active int
+	for retry := 1; ; retry++ {
+		n, err := CountActive(ctx, client, prefix, opts...)
+		if err != nil {
+			if ctx.Err() != nil {
+				return active, ctx.Err()
+			}
+			return n, err
+		}
+		if active = n; active < threshold {
+			return active, nil
+		}
+
+		timer := time.NewTimer(backoff.delay(retry))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return active, ctx.Err()
+		case <-freed:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// retryTransient calls fn, calling it again after the o.RedisBackoff delay while it fails with
+// a transient error, up to o.RedisRetries times or until ctx is done. It returns the last error of fn.
+// Every call of fn gets ctx bounded by o.DefaultOpTimeout (see opContext).
+func (o *Options) retryTransient(ctx context.Context, fn func(ctx context.Context) error) error {
+	attempt := func() error {
+		opCtx, cancel := o.opContext(ctx)
+		defer cancel()
+		return fn(opCtx)
+	}
+	err := attempt()
+	for retry := 1; retry <= o.RedisRetries && isTransient(err); retry++ {
+		if sleep(ctx, o.RedisBackoff.delay(retry)) != nil {
+			return err
+		}
+		o.Logger.Debug("tasklocker: retrying transient redis error", "retry", retry, "error", err)
+		err = attempt()
+	}
+	return err
+}
+
+// sleep waits for d, returning ctx.Err() if ctx is done first.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// WaitForSlot blocks until a lock of the prefix is released with WithNotify or ctx is done,
+// so waiters can sleep on a pub/sub notification instead of polling Redis with retries.
+// It returns nil when notified and ctx.Err() when ctx is done. Try to acquire again after it returns:
+// another waiter may have taken the freed slot first.
+// Locks that expire by TTL are not announced, and a release happening between a failed acquisition
+// and the subscription is missed, so bound every wait with a ctx timeout as a fallback.
+// Parameters:
+// - ctx: The context for the subscription and the wait.
+// - client: The Redis client instance.
+// - prefix: The prefix for the task keys.
+// - opts: The key options, e.g. WithHashTag.
+func WaitForSlot(ctx context.Context, client redis.UniversalClient, prefix string, opts ...Option) error {
+	o := newPrefixOptions(prefix, opts)
+	client = o.clientFor(prefix, client)
+	if err := o.validatePrefix(prefix); err != nil {
+		return err
+	}
+	pubsub := client.Subscribe(ctx, o.keyspace(prefix).freed())
+	defer pubsub.Close()
+
+	// Wait for the subscription to be confirmed before listening for messages
+	if _, err := pubsub.Receive(ctx); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return wrapRedisError("subscribe to freed slots", err)
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-pubsub.Channel():
+		return nil
+	}
+}